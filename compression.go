@@ -0,0 +1,400 @@
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// deflateExtension is the name of the permessage-deflate extension.
+// Ref Spec: https://tools.ietf.org/html/rfc7692#section-7
+const deflateExtension = "permessage-deflate"
+
+// deflateParams are the extension parameters sent with the permessage-deflate
+// extension to ask both endpoints not to keep the compression context between
+// messages, so that every message can be compressed and decompressed on its
+// own.
+// Ref Spec: https://tools.ietf.org/html/rfc7692#section-7.1.1
+const deflateParams = "; server_no_context_takeover; client_no_context_takeover"
+
+// flateReaderTail is appended to the payload data of compressed messages before
+// they are decompressed. It consists of the bytes removed from the end of the
+// compressed data by the sender, followed by a final empty block so that the
+// decompressor reaches the end of the data.
+// Ref Spec: https://tools.ietf.org/html/rfc7692#section-7.2.2
+const flateReaderTail = "\x00\x00\xff\xff" + "\x01\x00\x00\xff\xff"
+
+// maxWindowBits is the base-2 logarithm of the largest LZ77 sliding window
+// size, which compress/flate always uses when compressing.
+const maxWindowBits = 15
+
+// maxWindowSize is the size of the largest LZ77 sliding window, which is the
+// amount of decompressed data kept to decompress the next message when the
+// connected endpoint keeps the compression context between messages.
+const maxWindowSize = 1 << maxWindowBits
+
+// deflateOptions are the parameters of the permessage-deflate extension agreed
+// upon during the opening handshake.
+type deflateOptions struct {
+	/*
+		clientWindowBits is the base-2 logarithm of the LZ77 sliding window
+		size the client uses to compress messages.
+	*/
+	clientWindowBits int
+
+	/*
+		serverWindowBits is the base-2 logarithm of the LZ77 sliding window
+		size the server uses to compress messages.
+	*/
+	serverWindowBits int
+
+	/*
+		serverNoContextTakeover and clientNoContextTakeover indicate that the
+		server and the client respectively must not keep the compression
+		context between messages.
+	*/
+	serverNoContextTakeover bool
+	clientNoContextTakeover bool
+}
+
+// parseDeflate parses an element of the Sec-WebSocket-Extensions HTTP Header
+// field ('e'). It returns false if the element is not the permessage-deflate
+// extension or if any of its parameters are not valid.
+//
+// Ref Spec: https://tools.ietf.org/html/rfc7692#section-7.1
+func parseDeflate(e string) (*deflateOptions, bool) {
+	p := strings.Split(e, ";")
+
+	if strings.TrimSpace(p[0]) != deflateExtension {
+		return nil, false
+	}
+
+	o := &deflateOptions{
+		clientWindowBits: maxWindowBits,
+		serverWindowBits: maxWindowBits,
+	}
+
+	for _, v := range p[1:] {
+		n, w := v, ""
+
+		if i := strings.Index(v, "="); i != -1 {
+			n, w = v[:i], strings.Trim(strings.TrimSpace(v[i+1:]), `"`)
+		}
+
+		switch strings.TrimSpace(n) {
+		case "server_no_context_takeover":
+			{
+				o.serverNoContextTakeover = true
+			}
+		case "client_no_context_takeover":
+			{
+				o.clientNoContextTakeover = true
+			}
+		case "client_max_window_bits":
+			{
+				// The value is optional when offered by a client.
+				if w == "" {
+					continue
+				}
+
+				b, k := parseWindowBits(w)
+
+				if !k {
+					return nil, false
+				}
+
+				o.clientWindowBits = b
+			}
+		case "server_max_window_bits":
+			{
+				b, k := parseWindowBits(w)
+
+				if !k {
+					return nil, false
+				}
+
+				o.serverWindowBits = b
+			}
+		default:
+			{
+				return nil, false
+			}
+		}
+	}
+
+	return o, true
+}
+
+// parseWindowBits parses the value of a max window bits extension parameter
+// ('v'), which must be an integer between 8 and 15.
+func parseWindowBits(v string) (int, bool) {
+	b, err := strconv.Atoi(v)
+	return b, err == nil && b >= 8 && b <= maxWindowBits
+}
+
+// acceptDeflate returns the parameters of the first permessage-deflate
+// extension offer amongst the list of extensions offered by a client ('l')
+// which the server can accept, or nil if there isn't any. Offers asking the
+// server to use a smaller LZ77 sliding window are declined, since compress/flate
+// always uses the largest one.
+//
+// Unless context takeover is allowed ('t'), both endpoints are asked not to
+// keep the compression context between messages, irrespective of the offer.
+//
+// Ref Spec: https://tools.ietf.org/html/rfc7692#section-5.1
+func acceptDeflate(l []string, t bool) *deflateOptions {
+	for _, e := range l {
+		if o, k := parseDeflate(e); k && o.serverWindowBits == maxWindowBits {
+			if !t {
+				o.serverNoContextTakeover = true
+				o.clientNoContextTakeover = true
+			}
+			return o
+		}
+	}
+	return nil
+}
+
+// response returns the element of the Sec-WebSocket-Extensions HTTP Header
+// field sent by the server to accept the permessage-deflate extension. Since
+// a client offering a max window bits value is able to use a smaller LZ77
+// sliding window, it is asked to do so.
+//
+// Ref Spec: https://tools.ietf.org/html/rfc7692#section-7.1.2.2
+func (o *deflateOptions) response() string {
+	e := deflateExtension
+
+	if o.serverNoContextTakeover {
+		e += "; server_no_context_takeover"
+	}
+
+	if o.clientNoContextTakeover {
+		e += "; client_no_context_takeover"
+	}
+
+	if o.clientWindowBits < maxWindowBits {
+		e += "; client_max_window_bits=" + strconv.Itoa(o.clientWindowBits)
+	}
+
+	return e
+}
+
+// deflateAccepted returns the parameters of the permessage-deflate extension
+// accepted by the server, given the value of the Sec-WebSocket-Extensions HTTP
+// Header field of its response ('h'), or nil if it wasn't accepted.
+func deflateAccepted(h string) *deflateOptions {
+	for _, e := range headerToSlice(h) {
+		if o, k := parseDeflate(e); k {
+			return o
+		}
+	}
+	return nil
+}
+
+// compressionLevelValid returns true when the compression level provided
+// ('l') is a valid compress/flate compression level.
+func compressionLevelValid(l int) bool {
+	return l >= flate.HuffmanOnly && l <= flate.BestCompression
+}
+
+// deflate compresses the payload data of a message ('p') using the compression
+// level provided ('l').
+//
+// Ref Spec: https://tools.ietf.org/html/rfc7692#section-7.2.1
+func deflate(p []byte, l int) []byte {
+	b := &bytes.Buffer{}
+
+	// Error is only returned for invalid compression levels.
+	w, _ := flate.NewWriter(b, l)
+
+	return flushDeflate(w, b, p)
+}
+
+// flushDeflate compresses 'p' using the compressor provided ('w'), which
+// writes to 'b', and returns the compressed data.
+func flushDeflate(w *flate.Writer, b *bytes.Buffer, p []byte) []byte {
+	w.Write(p)
+	w.Flush()
+
+	// Remove the 4 bytes (0x00 0x00 0xff 0xff) at the end of the block
+	// generated by flushing.
+	return b.Bytes()[:b.Len()-4]
+}
+
+// deflate compresses the payload data of a message ('p') sent by the socket
+// instance. When context takeover is in use, the same compressor is used for
+// every message so that messages can refer to data sent in earlier ones. Note
+// that the caller is expected to hold s.writeMutex.
+func (s *Socket) deflate(p []byte) []byte {
+	// A zero value means the default compression level.
+	l := s.compressionLevel
+
+	if l == 0 {
+		l = flate.DefaultCompression
+	}
+
+	if !s.writeContextTakeover {
+		return deflate(p, l)
+	}
+
+	if s.deflater == nil {
+		s.deflateBuf = &bytes.Buffer{}
+		s.deflater, _ = flate.NewWriter(s.deflateBuf, l)
+	}
+
+	s.deflateBuf.Reset()
+
+	// The buffer is reused for the next message.
+	return append([]byte{}, flushDeflate(s.deflater, s.deflateBuf, p)...)
+}
+
+// newInflater returns a reader which decompresses the payload data of a
+// compressed message read from 'r'. When the connected endpoint keeps the
+// compression context between messages, 'd' is the decompressed data of the
+// previous messages it refers to.
+//
+// Ref Spec: https://tools.ietf.org/html/rfc7692#section-7.2.2
+func newInflater(r io.Reader, d []byte) io.ReadCloser {
+	return flate.NewReaderDict(io.MultiReader(r, strings.NewReader(flateReaderTail)), d)
+}
+
+// keepInflated keeps the last decompressed data received ('p') when the
+// connected endpoint keeps the compression context between messages, so that
+// the next message can refer to it. Only the size of the largest LZ77 sliding
+// window is kept.
+func (s *Socket) keepInflated(p []byte) {
+	if !s.readContextTakeover {
+		return
+	}
+
+	s.inflated = append(s.inflated, p...)
+
+	if n := len(s.inflated) - maxWindowSize; n > 0 {
+		copy(s.inflated, s.inflated[n:])
+		s.inflated = s.inflated[:maxWindowSize]
+	}
+}
+
+// inflate decompresses the payload data of a compressed message ('p'). The
+// decompressed data is also written to 'h' (if any) as it is decompressed. The
+// connection should be failed with the close error returned, if any.
+func (s *Socket) inflate(p []byte, h io.Writer) ([]byte, *CloseError) {
+	r := newInflater(bytes.NewReader(p), s.inflated)
+	defer r.Close()
+
+	var l io.Reader = r
+
+	// Decompressed messages must not exceed MaxMessageSize either.
+	if s.MaxMessageSize > 0 {
+		l = io.LimitReader(l, s.MaxMessageSize+1)
+	}
+
+	if h != nil {
+		l = io.TeeReader(l, h)
+	}
+
+	b, err := ioutil.ReadAll(l)
+
+	if err != nil {
+		return nil, &CloseError{
+			Code:   CloseInvalidFramePayloadData,
+			Reason: "invalid compressed data",
+		}
+	}
+
+	if s.MaxMessageSize > 0 && int64(len(b)) > s.MaxMessageSize {
+		return nil, &CloseError{
+			Code:   CloseMessageTooBig,
+			Reason: "message too big",
+		}
+	}
+
+	s.keepInflated(b)
+
+	return b, nil
+}
+
+// inflateReader decompresses the payload data of a compressed message read
+// using NextReader.
+type inflateReader struct {
+	/*
+		socket is the socket instance the message is read from.
+	*/
+	socket *Socket
+
+	/*
+		reader decompresses the payload data of the message.
+	*/
+	reader io.ReadCloser
+
+	/*
+		text indicates that the message is a text message, whose decompressed
+		payload data must be valid UTF-8.
+	*/
+	text bool
+
+	/*
+		utf8 validates the decompressed payload data of text messages.
+	*/
+	utf8 utf8Validator
+
+	/*
+		n is the number of decompressed payload data bytes read so far.
+	*/
+	n int64
+
+	/*
+		err is the error which stopped the message from being read.
+	*/
+	err error
+}
+
+// Read reads the decompressed payload data of the message into 'p'.
+func (r *inflateReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	n, err := r.reader.Read(p)
+
+	if _, k := err.(flate.CorruptInputError); k {
+		return n, r.socket.failMessage(&CloseError{
+			Code:   CloseInvalidFramePayloadData,
+			Reason: "invalid compressed data",
+		})
+	}
+
+	// Decompressed messages must not exceed MaxMessageSize either, which is
+	// checked as the message is decompressed rather than once the whole
+	// message is decompressed.
+	r.n += int64(n)
+
+	if m := r.socket.MaxMessageSize; m > 0 && r.n > m {
+		r.reader.Close()
+		r.err = r.socket.failMessage(&CloseError{
+			Code:   CloseMessageTooBig,
+			Reason: "message too big",
+		})
+		return 0, r.err
+	}
+
+	// The payload data of text messages must be valid UTF-8.
+	// Ref Spec: https://tools.ietf.org/html/rfc6455#section-8.1
+	if r.text && (!r.utf8.write(p[:n]) || err == io.EOF && !r.utf8.done()) {
+		return n, r.socket.failMessage(&CloseError{
+			Code:   CloseInvalidFramePayloadData,
+			Reason: "invalid utf-8",
+		})
+	}
+
+	r.socket.keepInflated(p[:n])
+
+	if err == io.EOF {
+		r.reader.Close()
+	}
+
+	return n, err
+}
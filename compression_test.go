@@ -0,0 +1,728 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcceptDeflate(t *testing.T) {
+	type testCase struct {
+		h string
+		v bool
+		c int
+	}
+
+	testCases := []testCase{
+		{h: "", v: false},
+		{h: "x-webkit-deflate-frame", v: false},
+		{h: "permessage-deflate", v: true, c: 15},
+		{h: "permessage-deflate; client_max_window_bits", v: true, c: 15},
+		{h: "permessage-deflate; client_max_window_bits=10", v: true, c: 10},
+		{h: `permessage-deflate; client_max_window_bits="9"`, v: true, c: 9},
+		{h: "permessage-deflate; server_no_context_takeover; client_no_context_takeover", v: true, c: 15},
+		// Invalid parameters.
+		{h: "permessage-deflate; client_max_window_bits=7", v: false},
+		{h: "permessage-deflate; unknown", v: false},
+		// The server can't use a smaller LZ77 sliding window.
+		{h: "permessage-deflate; server_max_window_bits=10", v: false},
+		{h: "permessage-deflate; server_max_window_bits=15", v: true, c: 15},
+		// A later offer is accepted when an earlier one is declined.
+		{h: "permessage-deflate; server_max_window_bits=10, permessage-deflate; client_max_window_bits=12", v: true, c: 12},
+	}
+
+	for i, c := range testCases {
+		o := acceptDeflate(headerToSlice(c.h), false)
+
+		if (o != nil) != c.v {
+			t.Errorf(`test case %d: expected '%t' for "%s"`, i, c.v, c.h)
+			continue
+		}
+
+		if o != nil && (o.clientWindowBits != c.c || o.serverWindowBits != 15) {
+			t.Errorf(`test case %d: expected window bits to be '%d' and '15', but they are '%d' and '%d'`, i, c.c, o.clientWindowBits, o.serverWindowBits)
+		}
+	}
+}
+
+func TestSocketCompressionWindowBits(t *testing.T) {
+	r, err := http.NewRequest("GET", "example.com", nil)
+
+	if err != nil {
+		t.Fatal("error occured while creating request:", err)
+	}
+
+	makeRequestValid(r)
+	r.Header.Set("Sec-WebSocket-Extensions", "permessage-deflate; client_max_window_bits=10")
+
+	conn, p := net.Pipe()
+	defer conn.Close()
+	defer p.Close()
+
+	w := &hijackerMock{
+		ResponseRecorder: httptest.NewRecorder(),
+		conn:             conn,
+	}
+
+	h := make(chan string, 1)
+
+	go func() {
+		g, err := http.ReadResponse(bufio.NewReader(p), r)
+
+		if err != nil {
+			t.Error("unexpected error returned", err)
+			h <- ""
+			return
+		}
+
+		h <- g.Header.Get("Sec-WebSocket-Extensions")
+	}()
+
+	q := &Request{
+		CheckOrigin: func(r *http.Request) bool {
+			return true
+		},
+		EnableCompression: true,
+	}
+
+	s, err := q.Upgrade(w, r)
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	if c, v := s.CompressionWindowBits(); c != 10 || v != 15 {
+		t.Errorf("expected window bits to be '10' and '15', but they are '%d' and '%d'", c, v)
+	}
+
+	e := <-h
+
+	if !strings.Contains(e, "client_max_window_bits=10") {
+		t.Errorf(`expected client to be asked to use the window bits offered, but the response is "%s"`, e)
+	}
+
+	// Client endpoint reporting the window bits accepted by the server.
+	c := &Socket{}
+	c.setCompression(deflateAccepted(e))
+
+	if b, v := c.CompressionWindowBits(); b != 10 || v != 15 {
+		t.Errorf("expected window bits to be '10' and '15', but they are '%d' and '%d'", b, v)
+	}
+
+	// Window bits are not reported when compression is not in use.
+	if b, v := (&Socket{}).CompressionWindowBits(); b != 0 || v != 0 {
+		t.Errorf("expected window bits to be '0' and '0', but they are '%d' and '%d'", b, v)
+	}
+}
+
+func TestInflate(t *testing.T) {
+	type testCase struct {
+		p []byte
+		m int64
+		e int
+	}
+
+	testCases := []testCase{
+		{p: []byte{}},
+		{p: []byte(strings.Repeat("hello ", 100))},
+		{p: []byte(strings.Repeat("hello ", 100)), m: 600},
+		// Decompressed message exceeding MaxMessageSize.
+		{p: []byte(strings.Repeat("hello ", 100)), m: 599, e: CloseMessageTooBig},
+	}
+
+	for i, c := range testCases {
+		s := &Socket{MaxMessageSize: c.m}
+
+		p, e := s.inflate(deflate(c.p, flate.DefaultCompression), nil)
+
+		if c.e != 0 {
+			if e == nil || e.Code != c.e {
+				t.Errorf("test case %d: expected Close Error Code to be '%d', but got '%v'", i, c.e, e)
+			}
+			continue
+		}
+
+		if e != nil {
+			t.Fatalf("test case %d: unexpected error returned %v", i, e)
+		}
+
+		if !bytes.Equal(p, c.p) {
+			t.Errorf("test case %d: expected decompressed payload data to match the original", i)
+		}
+	}
+
+	s := &Socket{}
+
+	if _, e := s.inflate([]byte{255, 255, 255}, nil); e == nil || e.Code != CloseInvalidFramePayloadData {
+		t.Errorf("expected Close Error Code to be '%d', but got '%v'", CloseInvalidFramePayloadData, e)
+	}
+}
+
+func TestSocketCompression(t *testing.T) {
+	p := []byte(strings.Repeat("compressed ", 50))
+
+	// Client endpoint sending a compressed and an uncompressed message.
+	b := &bytes.Buffer{}
+	c := newSocket(nil, bufio.NewReadWriter(nil, bufio.NewWriter(b)), false)
+	c.compression = true
+
+	if err := c.WriteMessage(OpcodeText, p); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	// RSV1 must be set.
+	if b.Bytes()[0]&64 == 0 {
+		t.Error("expected RSV1 to be set")
+	}
+
+	if b.Len() >= len(p) {
+		t.Errorf("expected message to be compressed, but it is '%d' bytes long", b.Len())
+	}
+
+	if _, err := c.WriteFrom(OpcodeText, bytes.NewReader(p)); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	// Server endpoint receiving the messages.
+	r := bufio.NewReaderSize(bytes.NewReader(b.Bytes()), b.Len()+16)
+	s := newSocket(nil, bufio.NewReadWriter(r, nil), true)
+	s.compression = true
+
+	for i := 0; i < 2; i++ {
+		m := &bytes.Buffer{}
+
+		if _, _, err := s.ReadInto(m); err != nil {
+			t.Fatalf("message %d: unexpected error returned %v", i, err)
+		}
+
+		if !bytes.Equal(m.Bytes(), p) {
+			t.Errorf("message %d: unexpected message payload data", i)
+		}
+	}
+}
+
+func TestSocketCompressionReadHello(t *testing.T) {
+	// Client endpoint sending a compressed hello message.
+	b := &bytes.Buffer{}
+	c := newSocket(nil, bufio.NewReadWriter(nil, bufio.NewWriter(b)), false)
+	c.compression = true
+
+	if err := c.WriteMessage(OpcodeText, []byte(`{"user":"one"}`)); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	// Server endpoint receiving the hello message.
+	r := bufio.NewReaderSize(bytes.NewReader(b.Bytes()), b.Len()+16)
+	s := newSocket(nil, bufio.NewReadWriter(r, nil), true)
+	s.compression = true
+
+	var v struct {
+		User string `json:"user"`
+	}
+
+	if err := s.ReadHello(&v); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	if v.User != "one" {
+		t.Errorf(`expected user to be "one" but it is "%s"`, v.User)
+	}
+}
+
+func TestSocketCompressionNextReaderMaxMessageSize(t *testing.T) {
+	// Highly compressible message which is small on the wire.
+	p := make([]byte, 1<<20)
+
+	b := &bytes.Buffer{}
+	c := newSocket(nil, bufio.NewReadWriter(nil, bufio.NewWriter(b)), false)
+	c.compression = true
+
+	if err := c.WriteMessage(OpcodeBinary, p); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	// Server endpoint receiving the message.
+	r := bufio.NewReaderSize(bytes.NewReader(b.Bytes()), b.Len()+16)
+	w := &bytes.Buffer{}
+	s := newSocket(nil, bufio.NewReadWriter(r, bufio.NewWriter(w)), true)
+	s.compression = true
+	s.MaxMessageSize = int64(b.Len()) * 2
+
+	_, m, err := s.NextReader()
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	n, err := io.Copy(ioutil.Discard, m)
+
+	if e, k := err.(*CloseError); !k || e.Code != CloseMessageTooBig {
+		t.Fatalf("expected Close Error Code to be '%d', but got '%v'", CloseMessageTooBig, err)
+	}
+
+	if n > s.MaxMessageSize {
+		t.Errorf("expected at most '%d' bytes to be read, but '%d' were read", s.MaxMessageSize, n)
+	}
+
+	// The connection is failed with a message too big error (1009).
+	f, err := newFrame(bufio.NewReader(w))
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	if e, _ := NewCloseError(f.payload); f.opcode != OpcodeClose || e.Code != CloseMessageTooBig {
+		t.Errorf("expected a close frame with Close Error Code '%d' to be sent", CloseMessageTooBig)
+	}
+}
+
+func TestSocketCompressionListenMaxMessageSize(t *testing.T) {
+	// Highly compressible message which is small on the wire.
+	p := make([]byte, 1<<20)
+
+	b := &bytes.Buffer{}
+	c := newSocket(nil, bufio.NewReadWriter(nil, bufio.NewWriter(b)), false)
+	c.compression = true
+
+	if err := c.WriteMessage(OpcodeBinary, p); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	s, q := newSocketPair(t)
+	defer s.TCPClose()
+	defer q.TCPClose()
+
+	s.compression = true
+	s.MaxMessageSize = int64(b.Len()) * 2
+
+	s.ReadHandler = func(o int, p []byte) {
+		t.Error("expected read handler not to be invoked")
+	}
+
+	go s.Listen()
+
+	if _, err := q.conn.Write(b.Bytes()); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	// The connection is failed with a message too big error (1009).
+	q.SetReadDeadline(time.Now().Add(time.Second * 2))
+
+	f, err := newFrame(q.buf.Reader)
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	if e, _ := NewCloseError(f.payload); f.opcode != OpcodeClose || e.Code != CloseMessageTooBig {
+		t.Errorf("expected a close frame with Close Error Code '%d' to be sent", CloseMessageTooBig)
+	}
+}
+
+func TestSocketCompressionNegotiated(t *testing.T) {
+	type testCase struct {
+		c bool
+		s bool
+		v bool
+	}
+
+	testCases := []testCase{
+		{c: true, s: true, v: true},
+		{c: true, s: false, v: false},
+		{c: false, s: true, v: false},
+	}
+
+	for i, tc := range testCases {
+		done := make(chan []byte, 1)
+
+		h := func(w http.ResponseWriter, r *http.Request) {
+			q := &Request{
+				EnableCompression: tc.s,
+			}
+
+			s, err := q.Upgrade(w, r)
+
+			if err != nil {
+				t.Error("unexpected error returned", err)
+				return
+			}
+
+			if s.compression != tc.v {
+				t.Errorf("test case %d: expected server compression to be '%t'", i, tc.v)
+			}
+
+			// Echo messages back.
+			s.ReadHandler = func(o int, p []byte) {
+				s.WriteMessage(o, p)
+			}
+
+			s.Listen()
+		}
+
+		m := httptest.NewServer(http.HandlerFunc(h))
+
+		d := &Dialer{
+			EnableCompression: tc.c,
+		}
+
+		c, _, err := d.Dial(adaptURL(m.URL))
+
+		if err != nil {
+			t.Fatal("unexpected error returned", err)
+		}
+
+		if c.compression != tc.v {
+			t.Errorf("test case %d: expected client compression to be '%t'", i, tc.v)
+		}
+
+		// The digest is computed over the decompressed payload data.
+		e := sha256.Sum256([]byte("hello hello hello"))
+
+		c.MessageHash = sha256.New
+
+		c.ReadHandler = func(o int, p []byte) {
+			if d := c.Digest(); !bytes.Equal(d, e[:]) {
+				t.Errorf("test case %d: expected digest to be '%x', but it is '%x'", i, e, d)
+			}
+
+			done <- p
+		}
+
+		go c.Listen()
+
+		if err := c.WriteMessage(OpcodeText, []byte("hello hello hello")); err != nil {
+			t.Fatal("unexpected error returned", err)
+		}
+
+		select {
+		case p := <-done:
+			{
+				if string(p) != "hello hello hello" {
+					t.Errorf(`test case %d: expected echoed message to be "hello hello hello", but it is "%s"`, i, p)
+				}
+			}
+		case <-time.After(time.Second * 2):
+			{
+				t.Errorf("test case %d: timed out", i)
+			}
+		}
+
+		c.TCPClose()
+		m.Close()
+	}
+}
+
+func TestAcceptDeflateContextTakeover(t *testing.T) {
+	type testCase struct {
+		h string
+		t bool
+		e string
+	}
+
+	testCases := []testCase{
+		// Context takeover is not allowed by default.
+		{h: "permessage-deflate", t: false, e: "permessage-deflate; server_no_context_takeover; client_no_context_takeover"},
+		// Context takeover is kept unless the client asks otherwise.
+		{h: "permessage-deflate", t: true, e: "permessage-deflate"},
+		{h: "permessage-deflate; server_no_context_takeover", t: true, e: "permessage-deflate; server_no_context_takeover"},
+		{h: "permessage-deflate; client_no_context_takeover", t: true, e: "permessage-deflate; client_no_context_takeover"},
+	}
+
+	for i, c := range testCases {
+		o := acceptDeflate(headerToSlice(c.h), c.t)
+
+		if o == nil {
+			t.Errorf(`test case %d: expected offer "%s" to be accepted`, i, c.h)
+			continue
+		}
+
+		if r := o.response(); r != c.e {
+			t.Errorf(`test case %d: expected response to be "%s", but it is "%s"`, i, c.e, r)
+		}
+	}
+}
+
+func TestSocketCompressionContextTakeover(t *testing.T) {
+	type testCase struct {
+		t bool
+	}
+
+	testCases := []testCase{
+		{t: false},
+		{t: true},
+	}
+
+	p := []byte(strings.Repeat("compressed independently ", 20))
+
+	for i, c := range testCases {
+		// Server endpoint sending the same message twice.
+		b := &bytes.Buffer{}
+		s := newSocket(nil, bufio.NewReadWriter(nil, bufio.NewWriter(b)), true)
+		s.setCompression(&deflateOptions{
+			serverNoContextTakeover: !c.t,
+			clientNoContextTakeover: !c.t,
+		})
+
+		for j := 0; j < 2; j++ {
+			if err := s.WriteMessage(OpcodeText, p); err != nil {
+				t.Fatalf("test case %d: unexpected error returned %v", i, err)
+			}
+		}
+
+		r := bufio.NewReader(bytes.NewReader(b.Bytes()))
+
+		f, err := parseFrame(r, true, nil)
+
+		if err != nil {
+			t.Fatalf("test case %d: unexpected error returned %v", i, err)
+		}
+
+		g, err := parseFrame(r, true, nil)
+
+		if err != nil {
+			t.Fatalf("test case %d: unexpected error returned %v", i, err)
+		}
+
+		// Without context takeover the compressor is reset for every message,
+		// therefore both messages are compressed the same way. Else the
+		// second message refers to the first one.
+		if e := bytes.Equal(f.payload, g.payload); e == c.t {
+			t.Errorf("test case %d: expected messages to be compressed independently to be '%t'", i, !c.t)
+		}
+
+		// Client endpoint receiving the messages.
+		r = bufio.NewReaderSize(bytes.NewReader(b.Bytes()), b.Len()+16)
+		n := newSocket(nil, bufio.NewReadWriter(r, nil), false)
+		n.setCompression(&deflateOptions{
+			serverNoContextTakeover: !c.t,
+			clientNoContextTakeover: !c.t,
+		})
+
+		for j := 0; j < 2; j++ {
+			m := &bytes.Buffer{}
+
+			if _, _, err := n.ReadInto(m); err != nil {
+				t.Fatalf("test case %d: message %d: unexpected error returned %v", i, j, err)
+			}
+
+			if !bytes.Equal(m.Bytes(), p) {
+				t.Errorf("test case %d: message %d: unexpected message payload data", i, j)
+			}
+		}
+	}
+}
+
+func TestSocketCompressionContextTakeoverNegotiated(t *testing.T) {
+	done := make(chan []byte, 1)
+
+	h := func(w http.ResponseWriter, r *http.Request) {
+		q := &Request{
+			EnableCompression: true,
+			ContextTakeover:   true,
+		}
+
+		s, err := q.Upgrade(w, r)
+
+		if err != nil {
+			t.Error("unexpected error returned", err)
+			return
+		}
+
+		if !s.writeContextTakeover || !s.readContextTakeover {
+			t.Error("expected server to keep the compression context")
+		}
+
+		// Echo messages back.
+		s.ReadHandler = func(o int, p []byte) {
+			s.WriteMessage(o, p)
+		}
+
+		s.Listen()
+	}
+
+	m := httptest.NewServer(http.HandlerFunc(h))
+	defer m.Close()
+
+	d := &Dialer{
+		EnableCompression: true,
+		ContextTakeover:   true,
+	}
+
+	c, _, err := d.Dial(adaptURL(m.URL))
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	defer c.TCPClose()
+
+	if !c.writeContextTakeover || !c.readContextTakeover {
+		t.Error("expected client to keep the compression context")
+	}
+
+	c.ReadHandler = func(o int, p []byte) {
+		done <- p
+	}
+
+	go c.Listen()
+
+	// Later messages refer to the earlier ones.
+	for i := 0; i < 3; i++ {
+		if err := c.WriteMessage(OpcodeText, []byte("hello hello hello")); err != nil {
+			t.Fatal("unexpected error returned", err)
+		}
+
+		select {
+		case p := <-done:
+			{
+				if string(p) != "hello hello hello" {
+					t.Errorf(`message %d: expected echoed message to be "hello hello hello", but it is "%s"`, i, p)
+				}
+			}
+		case <-time.After(time.Second * 2):
+			{
+				t.Fatalf("message %d: timed out", i)
+			}
+		}
+	}
+}
+
+func TestSocketCompressionLevel(t *testing.T) {
+	type testCase struct {
+		l int
+	}
+
+	testCases := []testCase{
+		{l: flate.BestSpeed},
+		{l: flate.BestCompression},
+	}
+
+	p := strings.Repeat("hello ", 100)
+
+	for i, tc := range testCases {
+		done := make(chan []byte, 1)
+
+		h := func(w http.ResponseWriter, r *http.Request) {
+			q := &Request{
+				EnableCompression: true,
+				CompressionLevel:  tc.l,
+			}
+
+			s, err := q.Upgrade(w, r)
+
+			if err != nil {
+				t.Error("unexpected error returned", err)
+				return
+			}
+
+			if s.compressionLevel != tc.l {
+				t.Errorf("test case %d: expected server compression level to be '%d', but it is '%d'", i, tc.l, s.compressionLevel)
+			}
+
+			// Echo messages back.
+			s.ReadHandler = func(o int, p []byte) {
+				s.WriteMessage(o, p)
+			}
+
+			s.Listen()
+		}
+
+		m := httptest.NewServer(http.HandlerFunc(h))
+
+		d := &Dialer{
+			EnableCompression: true,
+			CompressionLevel:  tc.l,
+		}
+
+		c, _, err := d.Dial(adaptURL(m.URL))
+
+		if err != nil {
+			t.Fatal("unexpected error returned", err)
+		}
+
+		if c.compressionLevel != tc.l {
+			t.Errorf("test case %d: expected client compression level to be '%d', but it is '%d'", i, tc.l, c.compressionLevel)
+		}
+
+		c.ReadHandler = func(o int, p []byte) {
+			done <- p
+		}
+
+		go c.Listen()
+
+		if err := c.WriteMessage(OpcodeText, []byte(p)); err != nil {
+			t.Fatal("unexpected error returned", err)
+		}
+
+		select {
+		case e := <-done:
+			{
+				if string(e) != p {
+					t.Errorf("test case %d: unexpected echoed message", i)
+				}
+			}
+		case <-time.After(time.Second * 2):
+			{
+				t.Errorf("test case %d: timed out", i)
+			}
+		}
+
+		c.TCPClose()
+		m.Close()
+	}
+}
+
+func TestCompressionLevelInvalid(t *testing.T) {
+	d := &Dialer{
+		EnableCompression: true,
+		CompressionLevel:  flate.BestCompression + 1,
+	}
+
+	if _, err := d.Request("ws://localhost:8080"); err == nil {
+		t.Error("expected an error to be returned by the dialer")
+	}
+
+	r, err := http.NewRequest("GET", "http://example.com", nil)
+
+	if err != nil {
+		t.Fatal("error occured while creating request:", err)
+	}
+
+	makeRequestValid(r)
+
+	var o UpgradeOutcome
+
+	q := &Request{
+		CheckOrigin: func(r *http.Request) bool {
+			return true
+		},
+		EnableCompression: true,
+		CompressionLevel:  flate.HuffmanOnly - 1,
+		OutcomeHandler: func(e UpgradeOutcome) {
+			o = e
+		},
+	}
+
+	w := httptest.NewRecorder()
+
+	if _, err := q.Upgrade(w, r); err == nil {
+		t.Error("expected an error to be returned by the server")
+	}
+
+	if o != UpgradeBadCompressionLevel {
+		t.Errorf(`expected outcome to be "%s", but it is "%s"`, UpgradeBadCompressionLevel, o)
+	}
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("expected status code to be '%d', but it is '%d'", http.StatusInternalServerError, w.Code)
+	}
+}
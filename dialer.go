@@ -2,19 +2,29 @@ package websocket
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
+	"fmt"
 	"net"
 	"net/http"
 	"net/url"
-	"regexp"
+	"strconv"
 	"strings"
-	"sync"
+	"time"
 )
 
+// DefaultUserAgent is the User-Agent sent with the opening handshake request
+// when Dialer.Header doesn't include one.
+const DefaultUserAgent = "tabone-websocket"
+
 // Dialer is a websocket client.
 type Dialer struct {
 	/*
-		Header to be included in the opening handshake request.
+		Header to be included in the opening handshake request. Values
+		provided are preserved and take precedence over defaults (such as the
+		User-Agent), apart from the header fields required by the opening
+		handshake which are always overwritten. Each request is created with
+		a copy of it, therefore it is never changed by the dialer.
 	*/
 	Header http.Header
 
@@ -27,26 +37,129 @@ type Dialer struct {
 		TLSConfig is used to configure the TLS client.
 	*/
 	TLSConfig *tls.Config
+
+	/*
+		ResumptionToken is an opaque token sent with the opening handshake
+		request, used by applications to resume a previous session. It is
+		not sent when empty.
+	*/
+	ResumptionToken string
+
+	/*
+		ResumptionHeader is the name of the header field the resumption token
+		is sent with. When empty, DefaultResumptionHeader is used.
+	*/
+	ResumptionHeader string
+
+	/*
+		EnableCompression offers to use the permessage-deflate extension. When
+		the server agrees, the payload data of messages sent using
+		WriteMessage is compressed.
+	*/
+	EnableCompression bool
+
+	/*
+		ContextTakeover offers to keep the compression context between
+		messages when the permessage-deflate extension is in use, so that
+		messages can refer to data sent in earlier ones. This improves the
+		compression of similar messages at the cost of keeping a compressor
+		(a few hundred KB) and the last 32KB of decompressed data in memory
+		for the lifetime of the connection, if the server agrees.
+
+		It is disabled by default, in which case both endpoints are asked
+		not to keep the compression context (i.e. server_no_context_takeover
+		and client_no_context_takeover) and every message is compressed on
+		its own.
+
+		Ref Spec: https://tools.ietf.org/html/rfc7692#section-7.1.1
+	*/
+	ContextTakeover bool
+
+	/*
+		CompressionLevel is the compress/flate compression level used to
+		compress messages when the permessage-deflate extension is in use,
+		ranging from flate.HuffmanOnly to flate.BestCompression. Higher levels
+		spend more CPU time to send less data, while lower levels (such as
+		flate.BestSpeed) trade bandwidth for CPU time. A zero value means
+		flate.DefaultCompression, which is a balance between the two.
+	*/
+	CompressionLevel int
 }
 
 // Dial is the method used to start the websocket connection.
 func (d *Dialer) Dial(u string) (*Socket, *http.Response, error) {
-	// Parse URL to return a valid URL instance.
-	l, err := parseURL(u)
+	return d.DialContext(context.Background(), u)
+}
+
+// DialContext is the method used to start the websocket connection using the
+// context provided ('ctx'). The deadline of the context (if any) applies to
+// connecting with the server, the TLS handshake and the opening handshake. If
+// the context is canceled before the opening handshake is completed, the
+// connection is closed and the context's error is returned.
+func (d *Dialer) DialContext(ctx context.Context, u string) (*Socket, *http.Response, error) {
+	// Get a valid websocket opening handshake request instance.
+	q, err := d.Request(u)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	// Get a valid websocket opening handshake request instance.
-	q := d.createRequest(l)
+	l := q.URL
 
-	// Connect with the websocket server.
+	// Connect with the websocket server. The path and query are sent in the
+	// request line of the opening handshake request instead.
 	// Ref Spec: https://tools.ietf.org/html/rfc6455#section-3
-	conn, err := net.Dial("tcp", l.Host+"/"+l.Path+"?"+l.RawQuery)
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", l.Host)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The deadline of the context applies to the rest of the opening
+	// handshake.
+	if t, k := ctx.Deadline(); k {
+		conn.SetDeadline(t)
+	}
+
+	// Unblock the opening handshake when the context is canceled.
+	c := make(chan struct{})
+	w := make(chan struct{})
+
+	go func() {
+		defer close(w)
+
+		select {
+		case <-ctx.Done():
+			{
+				conn.SetDeadline(time.Now())
+			}
+		case <-c:
+		}
+	}()
+
+	s, r, err := d.handshake(ctx, conn, q)
+
+	close(c)
+	<-w
+
 	if err != nil {
+		conn.Close()
+
+		if e := contextErr(ctx); e != nil {
+			return nil, nil, e
+		}
 		return nil, nil, err
 	}
 
+	// Clear the deadline set for the opening handshake.
+	conn.SetDeadline(time.Time{})
+
+	return s, r, nil
+}
+
+// handshake does the TLS handshake (when required) and the opening handshake
+// over the connection provided ('conn').
+func (d *Dialer) handshake(ctx context.Context, conn net.Conn, q *http.Request) (*Socket, *http.Response, error) {
+	l := q.URL
+
 	// When the connection will be over TLS, we need to do the TLS handshake.
 	if l.Scheme == "wss" {
 		g := d.TLSConfig
@@ -66,26 +179,41 @@ func (d *Dialer) Dial(u string) (*Socket, *http.Response, error) {
 		c := tls.Client(conn, g)
 
 		// Do the handshake.
-		if err := c.Handshake(); err != nil {
+		if err := c.HandshakeContext(ctx); err != nil {
 			return nil, nil, err
 		}
 
 		conn = c
 	}
 
+	// Transport used, to give errors related with the connection some context.
+	t := "tcp"
+
+	if l.Scheme == "wss" {
+		t = "tls"
+	}
+
 	// Send request
 	if err := q.Write(conn); err != nil {
-		return nil, nil, err
+		return nil, nil, &OpenError{
+			Reason: fmt.Sprintf("failed to send handshake request over %s connection to %s: %v", t, l.Host, err),
+			Err:    err,
+		}
 	}
 
 	// Buffer connection.
 	b := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
 
-	// Read response
+	// Read response. The connection may be closed by the server before it
+	// responds (ex: right after the TLS handshake), in which case the error
+	// returned is given some context.
 	r, err := http.ReadResponse(b.Reader, q)
 
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, &OpenError{
+			Reason: fmt.Sprintf("failed to read handshake response over %s connection to %s: %v", t, l.Host, err),
+			Err:    err,
+		}
 	}
 
 	// Validate response.
@@ -93,47 +221,114 @@ func (d *Dialer) Dial(u string) (*Socket, *http.Response, error) {
 		return nil, nil, err
 	}
 
-	return &Socket{
-		conn:       conn,
-		buf:        b,
-		writeMutex: &sync.Mutex{},
-	}, r, nil
+	// The server must only agree to use extensions offered by the client.
+	// Ref Spec: https://tools.ietf.org/html/rfc6455#section-4.1
+	e := r.Header.Get("Sec-WebSocket-Extensions")
+	z := deflateAccepted(e)
+
+	if e != "" && (!d.EnableCompression || z == nil) {
+		return nil, nil, &OpenError{Reason: "unexpected extensions: " + e}
+	}
+
+	s := newSocket(conn, b, false)
+	s.subprotocol = r.Header.Get("Sec-WebSocket-Protocol")
+	s.setCompression(z)
+	s.compressionLevel = d.CompressionLevel
+
+	return s, r, nil
+}
+
+// Request returns the websocket opening handshake request Dial would send to
+// connect with the websocket server at URL 'u', without connecting. This is
+// useful to send the request over a custom transport or to inspect it.
+func (d *Dialer) Request(u string) (*http.Request, error) {
+	// Parse URL to return a valid URL instance.
+	l, err := parseURL(u)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.createRequest(l)
 }
 
-// createOpeningHandshakeRequest is used to return a valid websocket opening
+// ParseURL verifies that the URL string provided ('u') is a valid websocket URL
+// without connecting to it, and returns it in the normalized form used by
+// Dial. A URL without a scheme defaults to "ws", while a URL without a port
+// gets the default port of its scheme.
+//
+// Ref Spec: https://tools.ietf.org/html/rfc6455#section-3
+func ParseURL(u string) (*url.URL, error) {
+	return parseURL(u)
+}
+
+// createRequest is used to return a valid websocket opening
 // handshake client request.
 //
 // Ref Spec: https://tools.ietf.org/html/rfc6455#section-4.1
-func (d *Dialer) createRequest(l *url.URL) *http.Request {
-	// Initialize header if not already initialized.
-	if d.Header == nil {
-		d.Header = make(http.Header)
+func (d *Dialer) createRequest(l *url.URL) (*http.Request, error) {
+	// Sub protocols must be valid HTTP tokens, otherwise they would corrupt
+	// the Sec-WebSocket-Protocol header field.
+	// Ref Spec: https://tools.ietf.org/html/rfc6455#section-4.1
+	for _, v := range d.SubProtocols {
+		if !tokenValid(v) {
+			return nil, &OpenError{Reason: "invalid sub protocol: " + v}
+		}
+	}
+
+	if d.EnableCompression && !compressionLevelValid(d.CompressionLevel) {
+		return nil, &OpenError{Reason: "invalid compression level: " + strconv.Itoa(d.CompressionLevel)}
+	}
+
+	// The header provided is copied, so that the header fields of each
+	// request don't end up in the dialer instance (and in the requests
+	// created before).
+	g := d.Header.Clone()
+
+	if g == nil {
+		g = make(http.Header)
 	}
 
 	// When using the default port the Host header field should only consist of
 	// the host (no port is shown).
 	t := l.Host
 
-	switch l.Scheme {
-	case "ws":
-		{
-			re := regexp.MustCompile(":22$")
-			t = re.ReplaceAllString(t, "")
-		}
-	case "wss":
-		{
-			re := regexp.MustCompile(":443$")
-			t = re.ReplaceAllString(t, "")
+	if h, p, err := net.SplitHostPort(l.Host); err == nil && p == defaultPort(l.Scheme) {
+		t = h
+
+		// IPv6 addresses must still be enclosed in square brackets.
+		if strings.Contains(h, ":") {
+			t = "[" + h + "]"
 		}
 	}
 
 	// Include headers
-	d.Header.Set("Host", t)
-	d.Header.Set("Upgrade", "websocket")
-	d.Header.Set("Connection", "upgrade")
-	d.Header.Set("Sec-WebSocket-Version", "13")
-	d.Header.Set("Sec-WebSocket-Key", makeChallengeKey())
-	d.Header.Set("Sec-WebSocket-Protocol", strings.Join(d.SubProtocols, ", "))
+	g.Set("Host", t)
+	g.Set("Upgrade", "websocket")
+	g.Set("Connection", "Upgrade")
+	g.Set("Sec-WebSocket-Version", "13")
+	g.Set("Sec-WebSocket-Key", makeChallengeKey())
+	g.Set("Sec-WebSocket-Protocol", strings.Join(d.SubProtocols, ", "))
+
+	// Offer to use the permessage-deflate extension.
+	if d.EnableCompression {
+		e := deflateExtension
+
+		if !d.ContextTakeover {
+			e += deflateParams
+		}
+
+		g.Set("Sec-WebSocket-Extensions", e)
+	}
+
+	// Include the resumption token (if any).
+	if d.ResumptionToken != "" {
+		g.Set(resumptionHeader(d.ResumptionHeader), d.ResumptionToken)
+	}
+
+	// Include a default User-Agent unless the user has provided one.
+	if g.Get("User-Agent") == "" {
+		g.Set("User-Agent", DefaultUserAgent)
+	}
 
 	// Create request instance
 	q := &http.Request{
@@ -142,9 +337,9 @@ func (d *Dialer) createRequest(l *url.URL) *http.Request {
 		Proto:      "HTTP/1.1",
 		ProtoMajor: 1,
 		ProtoMinor: 1,
-		Header:     d.Header,
+		Header:     g,
 		Host:       l.Host,
 	}
 
-	return q
+	return q, nil
 }
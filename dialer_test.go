@@ -1,17 +1,29 @@
 package websocket
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
+	"errors"
+	"io"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestDialerCreateRequestNilHeader(t *testing.T) {
 	d := &Dialer{Header: nil}
 
-	q := d.createRequest(&url.URL{})
+	q, err := d.createRequest(&url.URL{})
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
 
 	if q.Header == nil {
 		t.Errorf("expected header to be initialized")
@@ -27,7 +39,11 @@ func TestDialerCreateRequestNonNilHeader(t *testing.T) {
 
 	d := &Dialer{Header: h}
 
-	q := d.createRequest(&url.URL{})
+	q, err := d.createRequest(&url.URL{})
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
 
 	if q.Header.Get(k) != v {
 		t.Errorf("expected header to be the one provided in dialer instance")
@@ -43,14 +59,24 @@ func TestDialerCreateRequestHostHeader(t *testing.T) {
 	}
 
 	testCases := []testCase{
-		{u: &url.URL{Scheme: "ws", Host: "localhost:22"}, v: "localhost"},
+		{u: &url.URL{Scheme: "ws", Host: "localhost:80"}, v: "localhost"},
 		{u: &url.URL{Scheme: "wss", Host: "localhost:443"}, v: "localhost"},
-		{u: &url.URL{Scheme: "ws", Host: "localhost:80"}, v: "localhost:80"},
+		{u: &url.URL{Scheme: "ws", Host: "localhost:22"}, v: "localhost:22"},
 		{u: &url.URL{Scheme: "wss", Host: "localhost:80"}, v: "localhost:80"},
+		{u: &url.URL{Scheme: "wss", Host: "localhost:8443"}, v: "localhost:8443"},
+		{u: &url.URL{Scheme: "ws", Host: "localhost:443"}, v: "localhost:443"},
+		{u: &url.URL{Scheme: "wss", Host: "host22:443"}, v: "host22"},
+		{u: &url.URL{Scheme: "wss", Host: "[::1]:443"}, v: "[::1]"},
+		{u: &url.URL{Scheme: "wss", Host: "[::1]:8443"}, v: "[::1]:8443"},
+		{u: &url.URL{Scheme: "wss", Host: "[::1]"}, v: "[::1]"},
 	}
 
 	for i, c := range testCases {
-		q := d.createRequest(c.u)
+		q, err := d.createRequest(c.u)
+
+		if err != nil {
+			t.Fatal("unexpected error returned", err)
+		}
 		v := q.Header.Get("Host")
 
 		if v != c.v {
@@ -64,7 +90,11 @@ func TestDialerCreateRequestHeaders(t *testing.T) {
 		SubProtocols: []string{"chat", "v1"},
 	}
 
-	q := d.createRequest(&url.URL{Scheme: "ws", Host: "localhost"})
+	q, err := d.createRequest(&url.URL{Scheme: "ws", Host: "localhost"})
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
 
 	v := q.Header.Get("Upgrade")
 	e := "websocket"
@@ -108,7 +138,11 @@ func TestDialerCreateRequestRequest(t *testing.T) {
 		Host:   "localhost:8080",
 	}
 
-	q := d.createRequest(u)
+	q, err := d.createRequest(u)
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
 
 	if q.URL != u {
 		t.Errorf("expected URL instance to be the one provided")
@@ -130,3 +164,405 @@ func TestDialerCreateRequestRequest(t *testing.T) {
 		t.Errorf(`expected host to be "%s", but it is "%s"`, u.Host, q.Host)
 	}
 }
+
+func TestDialerCreateRequestSubProtocols(t *testing.T) {
+	type testCase struct {
+		p []string
+		v bool
+	}
+
+	testCases := []testCase{
+		{p: []string{"chat", "v1.json"}, v: true},
+		{p: []string{"chat, v1"}, v: false},
+		{p: []string{"chat v1"}, v: false},
+		{p: []string{""}, v: false},
+	}
+
+	for i, c := range testCases {
+		d := &Dialer{SubProtocols: c.p}
+
+		_, err := d.createRequest(&url.URL{Scheme: "ws", Host: "localhost"})
+
+		if c.v && err != nil {
+			t.Errorf("test case %d: unexpected error returned %s", i, err)
+		}
+
+		if !c.v && err == nil {
+			t.Errorf("test case %d: expected an error", i)
+		}
+	}
+}
+
+func TestDialerDialInvalidSubProtocol(t *testing.T) {
+	d := &Dialer{SubProtocols: []string{"chat, v1"}}
+
+	if _, _, err := d.Dial("ws://localhost:8080"); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestDialerRequest(t *testing.T) {
+	d := &Dialer{}
+
+	q, err := d.Request("ws://localhost:8080/chat?room=1")
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	if q.Method != "GET" {
+		t.Errorf(`expected method to be "GET", but it is "%s"`, q.Method)
+	}
+
+	if q.URL.Path != "/chat" || q.URL.RawQuery != "room=1" {
+		t.Errorf(`expected URL to be "/chat?room=1", but it is "%s"`, q.URL.RequestURI())
+	}
+
+	// Request must pass the validations done by the server endpoint.
+	if err := validateRequest(q); err != nil {
+		t.Error("unexpected error returned", err)
+	}
+
+	if err := validateWSVersionHeader(q); err != nil {
+		t.Error("unexpected error returned", err)
+	}
+
+	if _, err := d.Request("http://localhost:8080"); err == nil {
+		t.Error("expected an error for an invalid scheme")
+	}
+}
+
+func TestDialerRequestTwice(t *testing.T) {
+	h := make(http.Header)
+	h.Set("Origin", "http://localhost")
+
+	d := &Dialer{Header: h}
+
+	a, err := d.Request("ws://localhost:8080/chat")
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	k := a.Header.Get("Sec-WebSocket-Key")
+
+	b, err := d.Request("ws://localhost:8080/chat")
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	// Each request must have its own header fields.
+	if v := a.Header.Get("Sec-WebSocket-Key"); v != k {
+		t.Errorf(`expected key of first request to remain "%s", but it is "%s"`, k, v)
+	}
+
+	if b.Header.Get("Sec-WebSocket-Key") == k {
+		t.Error("expected each request to have a different key")
+	}
+
+	if v := b.Header.Get("Origin"); v != "http://localhost" {
+		t.Errorf(`expected header field provided to be included, but it is "%s"`, v)
+	}
+
+	// The header provided must not be changed.
+	if len(h) != 1 {
+		t.Errorf("expected header provided to be left as is, but it is '%v'", h)
+	}
+}
+
+func TestParseURL(t *testing.T) {
+	type testCase struct {
+		u string
+		v string
+		e bool
+	}
+
+	testCases := []testCase{
+		{u: "ws://localhost:8080/chat", v: "ws://localhost:8080/chat"},
+		{u: "wss://localhost:8443/chat?room=1", v: "wss://localhost:8443/chat?room=1"},
+		{u: "wss://localhost/chat", v: "wss://localhost:443/chat"},
+		{u: "ws://localhost/chat", v: "ws://localhost:80/chat"},
+		{u: "localhost:8080", v: "ws://localhost:8080"},
+		{u: "http://localhost:8080", e: true},
+	}
+
+	for i, c := range testCases {
+		l, err := ParseURL(c.u)
+
+		if c.e {
+			if err == nil {
+				t.Errorf("test case %d: expected an error to be returned", i)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("test case %d: unexpected error returned %v", i, err)
+			continue
+		}
+
+		if v := l.String(); v != c.v {
+			t.Errorf(`test case %d: expected URL to be "%s", but it is "%s"`, i, c.v, v)
+		}
+	}
+}
+
+func TestDialerCreateRequestUserAgent(t *testing.T) {
+	type testCase struct {
+		h http.Header
+		v string
+	}
+
+	testCases := []testCase{
+		{h: nil, v: DefaultUserAgent},
+		{h: http.Header{"User-Agent": []string{"custom agent"}}, v: "custom agent"},
+	}
+
+	for i, c := range testCases {
+		d := &Dialer{Header: c.h}
+
+		q, err := d.createRequest(&url.URL{Scheme: "ws", Host: "localhost:8080"})
+
+		if err != nil {
+			t.Fatal("unexpected error returned", err)
+		}
+
+		if v := q.Header.Get("User-Agent"); v != c.v {
+			t.Errorf(`test case %d: expected User-Agent header field value to be "%s", but it is "%s"`, i, c.v, v)
+		}
+	}
+}
+
+func TestDialerDialPath(t *testing.T) {
+	m := http.NewServeMux()
+
+	m.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.RawQuery != "room=1" {
+			t.Errorf(`expected query to be "room=1", but it is "%s"`, r.URL.RawQuery)
+		}
+
+		q := &Request{}
+
+		s, err := q.Upgrade(w, r)
+
+		if err != nil {
+			t.Error("unexpected error returned", err)
+			return
+		}
+
+		s.TCPClose()
+	})
+
+	h := httptest.NewServer(m)
+	defer h.Close()
+
+	d := &Dialer{}
+
+	s, _, err := d.Dial(adaptURL(h.URL) + "/ws?room=1")
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	s.TCPClose()
+}
+
+func TestDialerDialTLSReset(t *testing.T) {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{newCertificate(t, x509.ExtKeyUsageServerAuth)},
+	})
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	defer l.Close()
+
+	// Server which completes the TLS handshake but resets the connection
+	// before sending the handshake response.
+	go func() {
+		c, err := l.Accept()
+
+		if err != nil {
+			return
+		}
+
+		c.(*tls.Conn).Handshake()
+		c.(*tls.Conn).NetConn().(*net.TCPConn).SetLinger(0)
+		c.Close()
+	}()
+
+	d := &Dialer{
+		TLSConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+
+	_, _, err = d.Dial("wss://" + l.Addr().String())
+
+	e, k := err.(*OpenError)
+
+	if !k {
+		t.Fatalf("expected error instance to be of type *OpenError, but got '%v'", err)
+	}
+
+	if !strings.Contains(e.Reason, "tls") {
+		t.Errorf(`expected reason to mention the tls connection, but it is "%s"`, e.Reason)
+	}
+
+	if errors.Unwrap(e) == nil {
+		t.Error("expected the underlying error to be provided")
+	}
+}
+
+func TestDialerDialSubprotocol(t *testing.T) {
+	type testCase struct {
+		s string
+		v string
+	}
+
+	testCases := []testCase{
+		// Server agrees to use a sub protocol offered.
+		{s: "two", v: "two"},
+		// Server doesn't agree to use any sub protocol.
+		{s: "", v: ""},
+	}
+
+	for i, c := range testCases {
+		p := make(chan string, 1)
+
+		h := func(w http.ResponseWriter, r *http.Request) {
+			q := &Request{
+				SubProtocol: c.s,
+			}
+
+			s, err := q.Upgrade(w, r)
+
+			if err != nil {
+				t.Error("unexpected error returned", err)
+				p <- ""
+				return
+			}
+
+			p <- s.Subprotocol()
+			s.TCPClose()
+		}
+
+		m := httptest.NewServer(http.HandlerFunc(h))
+
+		d := &Dialer{
+			SubProtocols: []string{"one", "two"},
+		}
+
+		s, _, err := d.Dial(adaptURL(m.URL))
+
+		if err != nil {
+			t.Fatal("unexpected error returned", err)
+		}
+
+		if v := s.Subprotocol(); v != c.v {
+			t.Errorf(`test case %d: expected client sub protocol to be "%s", but it is "%s"`, i, c.v, v)
+		}
+
+		if v := <-p; v != c.v {
+			t.Errorf(`test case %d: expected server sub protocol to be "%s", but it is "%s"`, i, c.v, v)
+		}
+
+		s.TCPClose()
+		m.Close()
+	}
+}
+
+func TestDialerDialContext(t *testing.T) {
+	h := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := &Request{}
+
+		s, err := q.Upgrade(w, r)
+
+		if err != nil {
+			t.Error("unexpected error returned", err)
+			return
+		}
+
+		s.TCPClose()
+	}))
+
+	defer h.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	d := &Dialer{}
+
+	s, _, err := d.DialContext(ctx, adaptURL(h.URL))
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	s.TCPClose()
+}
+
+func TestDialerDialContextCanceled(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	defer l.Close()
+
+	// Server which accepts connections but never responds to the opening
+	// handshake request.
+	go func() {
+		for {
+			c, err := l.Accept()
+
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer c.Close()
+				io.Copy(io.Discard, c)
+			}()
+		}
+	}()
+
+	type testCase struct {
+		c func() (context.Context, context.CancelFunc)
+		e error
+	}
+
+	testCases := []testCase{
+		// Context deadline is exceeded.
+		{
+			c: func() (context.Context, context.CancelFunc) {
+				return context.WithTimeout(context.Background(), time.Millisecond*100)
+			},
+			e: context.DeadlineExceeded,
+		},
+		// Context is canceled.
+		{
+			c: func() (context.Context, context.CancelFunc) {
+				ctx, cancel := context.WithCancel(context.Background())
+				time.AfterFunc(time.Millisecond*100, cancel)
+				return ctx, cancel
+			},
+			e: context.Canceled,
+		},
+	}
+
+	for i, c := range testCases {
+		ctx, cancel := c.c()
+
+		d := &Dialer{}
+
+		_, _, err := d.DialContext(ctx, "ws://"+l.Addr().String())
+
+		cancel()
+
+		if err != c.e {
+			t.Errorf(`test case %d: expected error "%v" but got "%v"`, i, c.e, err)
+		}
+	}
+}
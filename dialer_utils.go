@@ -190,32 +190,29 @@ func parseURLHost(u *url.URL) error {
 		return errors.New("invalid scheme: " + u.Scheme)
 	}
 
-	// Regex to retrieve the Port portion of the URL.
-	re := regexp.MustCompile(":(\\d+)")
-	m := re.FindStringSubmatch(u.Host)
-
-	// If the length of m is greater than or equals to 2 it means that there is
-	// a submatch, meaning that the user has provided a port and thus there is
-	// no need to include the default ports.
-	if len(m) >= 2 {
+	// If the user has provided a port there is no need to include the default
+	// one.
+	if u.Port() != "" {
 		return nil
 	}
 
 	// Based on the scheme, set the port.
-	switch u.Scheme {
-	case "ws":
-		{
-			u.Host += ":22"
-		}
-	case "wss":
-		{
-			u.Host += ":443"
-		}
-	}
+	u.Host += ":" + defaultPort(u.Scheme)
 
 	return nil
 }
 
+// defaultPort returns the port used when none is provided for the websocket
+// scheme provided (ws = 80, wss = 443).
+//
+// Ref Spec: https://tools.ietf.org/html/rfc6455#section-3
+func defaultPort(s string) string {
+	if s == "wss" {
+		return "443"
+	}
+	return "80"
+}
+
 // schemeValid is used to determine whether the scheme provided is a valid
 // scheme for the websocket protocol.
 func schemeValid(s string) bool {
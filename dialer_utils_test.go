@@ -49,8 +49,10 @@ func TestParseURLHost(t *testing.T) {
 	testCases := []testCase{
 		{u: &url.URL{Scheme: "ws", Host: "localhost:80"}, h: "localhost:80"},
 		{u: &url.URL{Scheme: "wss", Host: "localhost:80"}, h: "localhost:80"},
-		{u: &url.URL{Scheme: "ws", Host: "localhost"}, h: "localhost:22"},
+		{u: &url.URL{Scheme: "ws", Host: "localhost"}, h: "localhost:80"},
 		{u: &url.URL{Scheme: "wss", Host: "localhost"}, h: "localhost:443"},
+		{u: &url.URL{Scheme: "wss", Host: "[::1]:8443"}, h: "[::1]:8443"},
+		{u: &url.URL{Scheme: "wss", Host: "[::1]"}, h: "[::1]:443"},
 	}
 
 	for i, c := range testCases {
@@ -176,6 +178,42 @@ func TestValidateResponseConnectionHeader(t *testing.T) {
 	}
 }
 
+func TestValidateResponseSecWebsocketAcceptHeader(t *testing.T) {
+	k := "dGhlIHNhbXBsZSBub25jZQ=="
+
+	type testCase struct {
+		a string
+		e bool
+	}
+
+	testCases := []testCase{
+		{a: makeAcceptKey(k), e: false},
+		{a: makeAcceptKeyWithSalt(k, "alternate salt"), e: true},
+	}
+
+	for i, c := range testCases {
+		r := &http.Response{
+			Header: make(http.Header),
+			Request: &http.Request{
+				Header: make(http.Header),
+			},
+		}
+
+		r.Request.Header.Set("Sec-WebSocket-Key", k)
+		r.Header.Set("Sec-WebSocket-Accept", c.a)
+
+		err := validateResponseSecWebsocketAcceptHeader(r)
+
+		if c.e && err == nil {
+			t.Errorf(`test case %d: expected an error for "%s"`, i, c.a)
+		}
+
+		if !c.e && err != nil {
+			t.Errorf(`test case %d: unexpected error returned for "%s"`, i, c.a)
+		}
+	}
+}
+
 func TestValidateResponseSecWebsocketProtocol(t *testing.T) {
 	type testCase struct {
 		c string
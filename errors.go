@@ -4,12 +4,66 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"unicode/utf8"
 )
 
+// Errors returned by NewCloseError when the payload data of a close frame
+// can't be parsed.
+var (
+	errInvalidCloseCode   = errors.New("invalid error code")
+	errInvalidCloseReason = errors.New("invalid close reason")
+)
+
+// errCloseReasonTooLong is returned by CloseWithCode when the reason provided
+// doesn't fit in a close frame.
+var errCloseReasonTooLong = errors.New("close reason too long")
+
+// MaxCloseReason is the maximum number of bytes the reason of a close frame can
+// have, since the first 2 bytes of its payload data are taken by the status
+// code.
+// Ref Spec: https://tools.ietf.org/html/rfc6455#section-5.5.1
+const MaxCloseReason = MaxControlFramePayload - 2
+
+// CloseSource indicates which endpoint initiated the closure of a websocket
+// connection.
+type CloseSource int
+
+// Endpoints which can initiate the closure of a websocket connection.
+const (
+	// CloseSourceLocal is used when the closure was initiated by this
+	// endpoint, including when the connection was failed or lost.
+	CloseSourceLocal CloseSource = iota
+
+	// CloseSourcePeer is used when the closure was initiated by the connected
+	// endpoint sending a close frame.
+	CloseSourcePeer
+)
+
+// String returns a description of the close source for logging purposes.
+func (s CloseSource) String() string {
+	if s == CloseSourcePeer {
+		return "peer close"
+	}
+	return "local close"
+}
+
 // CloseError represents errors related to the websocket closing handshake.
 type CloseError struct {
 	Code   int
 	Reason string
+
+	/*
+		Completed indicates whether the closing handshake has been completed,
+		meaning that a close frame has been both sent and received. It is
+		false when the connection was terminated without the connected
+		endpoint acknowledging the closure (ex: the connection was lost).
+	*/
+	Completed bool
+
+	/*
+		Source indicates which endpoint initiated the closure.
+	*/
+	Source CloseSource
 }
 
 // Error implements the built in error interface.
@@ -17,13 +71,23 @@ func (c *CloseError) Error() string {
 	return fmt.Sprintf("Close Error: %d %s", c.Code, c.Reason)
 }
 
+// Detail returns the same description as Error, followed by the endpoint
+// which initiated the closure (ex: "Close Error: 1000 normal closure (peer
+// close)").
+func (c *CloseError) Detail() string {
+	return fmt.Sprintf("%s (%s)", c.Error(), c.Source)
+}
+
 // ToBytes returns the representation of a CloseError instance in a []bytes
 // that conforms with the way the websocket rfc expects the payload data of
 // CLOSE FRAMES to be.
 //
 // While generating the []bytes, if the CloseError instance has an invalid
 // error code, it will instead create the representation of a 'No Status
-// Received Error' (i.e. 1005).
+// Received Error' (i.e. 1005). Reasons longer than MaxCloseReason bytes are
+// truncated at a UTF-8 boundary so that the payload data fits in a control
+// frame, while reasons which are not valid UTF-8 are left out and an error is
+// returned.
 //
 // Ref Spec: https://tools.ietf.org/html/rfc6455#section-5.5.1
 func (c *CloseError) ToBytes() ([]byte, error) {
@@ -35,10 +99,33 @@ func (c *CloseError) ToBytes() ([]byte, error) {
 			Reason: "no status recieved",
 		}
 		b, _ := n.ToBytes()
-		return b, errors.New("invalid error code")
+		return b, errInvalidCloseCode
 	}
 
-	return append(c.toBytesCode(), []byte(c.Reason)...), nil
+	r := c.Reason
+
+	// The reason must be valid UTF-8, otherwise the connected endpoint would
+	// fail the connection. In this case only the status code is sent.
+	// Ref Spec: https://tools.ietf.org/html/rfc6455#section-5.5.1
+	if !utf8.ValidString(r) {
+		return c.toBytesCode(), errInvalidCloseReason
+	}
+
+	// Truncate reason so that the payload data doesn't exceed the maximum
+	// payload data of control frames. The reason is truncated at the start of
+	// a rune, so that a multibyte UTF-8 sequence isn't split, which would make
+	// the connected endpoint reject the reason as invalid UTF-8.
+	if len(r) > MaxCloseReason {
+		i := MaxCloseReason
+
+		for i > 0 && !utf8.RuneStart(r[i]) {
+			i--
+		}
+
+		r = r[:i]
+	}
+
+	return append(c.toBytesCode(), []byte(r)...), nil
 }
 
 // toBytesCode is used to get a representation of the CloseError instance
@@ -55,7 +142,9 @@ func (c *CloseError) toBytesCode() []byte {
 //
 // While parsing if the error code (i.e. first two bytes) is invalid, it will
 // default the CloseError instance returned to represent a 'No Status Received
-// Error' (i.e. 1005).
+// Error' (i.e. 1005). If the error code is valid but the reason is not valid
+// UTF-8, the CloseError instance returned will still have the error code
+// parsed but not the reason.
 //
 // Ref Spec: https://tools.ietf.org/html/rfc6455#section-5.5.1
 func NewCloseError(b []byte) (*CloseError, error) {
@@ -70,7 +159,16 @@ func NewCloseError(b []byte) (*CloseError, error) {
 		return &CloseError{
 			Code:   CloseNoStatusReceived,
 			Reason: "no status recieved",
-		}, errors.New("invalid error code")
+		}, errInvalidCloseCode
+	}
+
+	// The reason must be valid UTF-8.
+	// Ref Spec: https://tools.ietf.org/html/rfc6455#section-5.5.1
+	if !utf8.Valid(b[2:]) {
+		return &CloseError{
+			Code:   c,
+			Reason: "invalid close reason",
+		}, errInvalidCloseReason
 	}
 
 	return &CloseError{
@@ -79,12 +177,56 @@ func NewCloseError(b []byte) (*CloseError, error) {
 	}, nil
 }
 
+// CloseCodes returns the list of close codes which can be sent in close frames,
+// followed by the lower and upper boundaries of the range of close codes
+// reserved for libraries, frameworks and applications (3000-4999). Note that
+// although recognized, 1005, 1006 and 1015 are not included since these are
+// only used to report the reason of a closure and must never be sent.
+//
+// Ref Spec: https://tools.ietf.org/html/rfc6455#section-7.4
+func CloseCodes() []int {
+	return []int{
+		CloseNormalClosure,
+		CloseGoingAway,
+		CloseProtocolError,
+		CloseUnsupportedData,
+		CloseInvalidFramePayloadData,
+		ClosePolicyViolation,
+		CloseMessageTooBig,
+		CloseMandatoryExtension,
+		CloseInternalServerErr,
+		CloseServiceRestart,
+		CloseTryAgainLater,
+		CloseBadGateway,
+		CloseApplicationMin,
+		CloseApplicationMax,
+	}
+}
+
 // OpenError represents errors related to the websocket opening handshake.
 type OpenError struct {
 	Reason string
+
+	/*
+		Origin contains the value of the Origin HTTP Header field of requests
+		rejected due to their origin.
+	*/
+	Origin string
+
+	/*
+		Err contains the underlying error (if any) which caused the opening
+		handshake to fail.
+	*/
+	Err error
 }
 
 // Error implements the built in error interface.
 func (h *OpenError) Error() string {
 	return "Handshake Error: " + h.Reason
 }
+
+// Unwrap returns the underlying error (if any), so that it can be inspected
+// using errors.Is and errors.As.
+func (h *OpenError) Unwrap() error {
+	return h.Err
+}
@@ -1,7 +1,10 @@
 package websocket
 
 import (
+	"bytes"
+	"strings"
 	"testing"
+	"unicode/utf8"
 )
 
 func TestCloseErrorToBytes(t *testing.T) {
@@ -43,6 +46,60 @@ func TestCloseErrorToBytes(t *testing.T) {
 	}
 }
 
+func TestCloseErrorToBytesLongReason(t *testing.T) {
+	c := &CloseError{Code: CloseGoingAway, Reason: strings.Repeat("a", MaxControlFramePayload)}
+
+	b, err := c.ToBytes()
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	if len(b) != MaxControlFramePayload {
+		t.Errorf("expected payload data to be '%d' bytes long, but it is '%d'", MaxControlFramePayload, len(b))
+	}
+
+	if r := string(b[2:]); r != c.Reason[:MaxCloseReason] {
+		t.Errorf(`expected reason to be "%s", but it is "%s"`, c.Reason[:MaxCloseReason], r)
+	}
+}
+
+func TestCloseErrorToBytesLongReasonMultibyte(t *testing.T) {
+	// The 123rd byte of the reason falls in the middle of the 3 byte '€'.
+	c := &CloseError{Code: CloseGoingAway, Reason: strings.Repeat("a", MaxCloseReason-2) + "€" + "b"}
+
+	b, err := c.ToBytes()
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	r := b[2:]
+
+	if !utf8.Valid(r) {
+		t.Errorf("expected reason to be valid UTF-8, but it is '%v'", r)
+	}
+
+	if e := strings.Repeat("a", MaxCloseReason-2); string(r) != e {
+		t.Errorf(`expected reason to be "%s", but it is "%s"`, e, r)
+	}
+}
+
+func TestCloseErrorToBytesInvalidReason(t *testing.T) {
+	c := &CloseError{Code: CloseGoingAway, Reason: string([]byte{0xff, 0xfe})}
+
+	b, err := c.ToBytes()
+
+	if err != errInvalidCloseReason {
+		t.Errorf(`expected error "%v" but got "%v"`, errInvalidCloseReason, err)
+	}
+
+	// Only the status code is sent.
+	if !bytes.Equal(b, []byte{3, 233}) {
+		t.Errorf("expected slice of bytes to be '%v', but it is '%v'", []byte{3, 233}, b)
+	}
+}
+
 func TestCloseErrorToBytesError(t *testing.T) {
 	b := []byte{3, 237, 110, 111, 32, 115, 116, 97, 116, 117, 115, 32, 114, 101, 99, 105, 101, 118, 101, 100}
 
@@ -122,3 +179,95 @@ func TestNewCloseErrorError(t *testing.T) {
 		}
 	}
 }
+
+func TestNewCloseErrorInvalidReason(t *testing.T) {
+	type testCase struct {
+		r []byte
+	}
+
+	testCases := []testCase{
+		// Structurally invalid bytes.
+		{r: []byte{0xff, 0xfe}},
+		// Overlong encoding of '/'.
+		{r: []byte{0xc0, 0xaf}},
+		// CESU-8 style encoding of the surrogate code point U+D800.
+		{r: []byte{0xed, 0xa0, 0x80}},
+	}
+
+	for i, c := range testCases {
+		e, err := NewCloseError(append([]byte{3, 233}, c.r...))
+
+		if err != errInvalidCloseReason {
+			t.Errorf(`test case %d: expected error "%v" but got "%v"`, i, errInvalidCloseReason, err)
+		}
+
+		if e.Code != CloseGoingAway {
+			t.Errorf("test case %d: expected Code to be '%d', but it is '%d'", i, CloseGoingAway, e.Code)
+		}
+	}
+}
+
+func TestCloseCodes(t *testing.T) {
+	l := CloseCodes()
+
+	type testCase struct {
+		c int
+		v bool
+	}
+
+	testCases := []testCase{
+		{c: CloseNormalClosure, v: true},
+		{c: CloseProtocolError, v: true},
+		{c: CloseInternalServerErr, v: true},
+		{c: CloseServiceRestart, v: true},
+		{c: CloseTryAgainLater, v: true},
+		{c: CloseBadGateway, v: true},
+		{c: CloseApplicationMin, v: true},
+		{c: CloseApplicationMax, v: true},
+		{c: CloseNoStatusReceived, v: false},
+		{c: CloseAbnormalClosure, v: false},
+		{c: CloseTLSHandshake, v: false},
+	}
+
+	for i, c := range testCases {
+		v := false
+
+		for _, e := range l {
+			if e == c.c {
+				v = true
+				break
+			}
+		}
+
+		if v != c.v {
+			t.Errorf("test case %d: expected '%t' for '%d'", i, c.v, c.c)
+		}
+	}
+
+	// All close codes returned must be recognized.
+	for _, e := range l {
+		if !closeErrorExist(e) {
+			t.Errorf("expected close code '%d' to be recognized", e)
+		}
+	}
+}
+
+func TestCloseErrorDetail(t *testing.T) {
+	type testCase struct {
+		s CloseSource
+		d string
+	}
+
+	testCases := []testCase{
+		{s: CloseSourceLocal, d: "Close Error: 1000 normal closure (local close)"},
+		{s: CloseSourcePeer, d: "Close Error: 1000 normal closure (peer close)"},
+	}
+
+	for i, c := range testCases {
+		e := &CloseError{Code: CloseNormalClosure, Reason: "normal closure", Source: c.s}
+
+		if d := e.Detail(); d != c.d {
+			t.Errorf(`test case %d: expected detail to be "%s", but it is "%s"`, i, c.d, d)
+		}
+	}
+}
@@ -40,15 +40,24 @@ func (m *manager) addSocket(s *websocket.Socket) {
 
 func (m *manager) ping(s *websocket.Socket) {
 	t := time.NewTicker(time.Second * 5)
+	defer t.Stop()
 
 	for {
-		<-t.C
-		if err := s.WriteMessage(websocket.OpcodePing, nil); err != nil {
-			log.Println(err)
-			break
+		select {
+		case <-t.C:
+			{
+				if err := s.WriteMessage(websocket.OpcodePing, nil); err != nil {
+					log.Println(err)
+					return
+				}
+			}
+		case <-s.Done():
+			{
+				// Socket has been closed, stop pinging.
+				return
+			}
 		}
 	}
-	t.Stop()
 }
 
 /*
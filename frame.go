@@ -17,6 +17,11 @@ const (
 	OpcodePong         int = 10
 )
 
+// MaxControlFramePayload is the maximum number of bytes the payload data of a
+// control frame (i.e. close, ping and pong frames) can have.
+// Ref Spec: https://tools.ietf.org/html/rfc6455#section-5.5
+const MaxControlFramePayload = 125
+
 // frame represents a Websocket Data Frame.
 // Ref Spec: https://tools.ietf.org/html/rfc6455#section-5.2
 type frame struct {
@@ -25,6 +30,25 @@ type frame struct {
 	*/
 	fin bool
 
+	/*
+		rsv contains the RSV1-3 bits of the frame (RSV1 being the most
+		significant bit).
+	*/
+	rsv int
+
+	/*
+		ignoreRSV makes readInitial accept frames with RSV bits set instead of
+		failing the connection.
+	*/
+	ignoreRSV bool
+
+	/*
+		compressed indicates that the payload data of the message started by
+		the frame is compressed (i.e. RSV1 is set while the permessage-deflate
+		extension is in use).
+	*/
+	compressed bool
+
 	/*
 		opcode defines the interpretation of the payload data.
 	*/
@@ -62,22 +86,53 @@ type frame struct {
 // 	   set to true.
 // 	4. Parsing of payload data.
 func newFrame(b *bufio.Reader) (*frame, error) {
+	return parseFrame(b, false, nil)
+}
+
+// parseFrame creates a new instance of frame by reading from a buffer just like
+// newFrame. When 'r' is true, frames with RSV bits set are accepted instead of
+// failing the connection, leaving it up to the caller to decide what to do
+// with them.
+//
+// If provided, 'v' is invoked to validate the frame once its header is read
+// and before its payload data is read, so that invalid frames are rejected
+// without consuming their (potentially large) payload data.
+func parseFrame(b *bufio.Reader, r bool, v func(*frame) error) (*frame, error) {
 	// Create frame instance.
-	f := &frame{}
+	f := &frame{
+		ignoreRSV: r,
+	}
 
-	reads := []func(*bufio.Reader) error{
-		f.readInitial,
-		f.readLength,
-		f.readMaskKey,
-		f.readPayload,
+	if err := f.readInitial(b); err != nil {
+		return nil, err
+	}
+
+	// Payload length as encoded in the first 2 bytes, before it is replaced
+	// by the extended payload length (if any).
+	n := f.length
+
+	if err := f.readLength(b); err != nil {
+		return nil, err
+	}
+
+	if e := validateFrameHeader(f, n); e != nil {
+		return nil, e
+	}
+
+	if err := f.readMaskKey(b); err != nil {
+		return nil, err
 	}
 
-	for _, read := range reads {
-		if err := read(b); err != nil {
+	if v != nil {
+		if err := v(f); err != nil {
 			return nil, err
 		}
 	}
 
+	if err := f.readPayload(b); err != nil {
+		return nil, err
+	}
+
 	return f, nil
 }
 
@@ -99,9 +154,12 @@ func (f *frame) readInitial(b *bufio.Reader) error {
 		f.fin = true
 	}
 
+	// Reading 'rsv'
+	f.rsv = int(p[0]>>4) & 7 /* 00000111 */
+
 	// Since library doesn't support extensions if RSV1-3 are non zeros, fail
 	// connection
-	if p[0]&112 /* 01110000 */ != 0 {
+	if f.rsv != 0 && !f.ignoreRSV {
 		return &CloseError{
 			Code:   CloseProtocolError,
 			Reason: "no support for extensions",
@@ -183,9 +241,6 @@ func (f *frame) readLength(b *bufio.Reader) error {
 		f.length += uint64(v)
 	}
 
-	// Most Significant Bit must be 0.
-	f.length = f.length & 9223372036854775807
-
 	return nil
 }
 
@@ -227,6 +282,10 @@ func (f *frame) readPayload(b *bufio.Reader) error {
 		return err
 	}
 
+	// Note that 'p' is allocated by readFromBuffer and owned by the frame
+	// instance, therefore unmasking it in place never alters a buffer which
+	// might be reused (ex: the buffer of 'b') before the payload data is
+	// consumed.
 	if f.masked {
 		// Unmask (decode) payload data
 		mask(p, f.key)
@@ -247,12 +306,41 @@ func (f *frame) toBytes() ([]byte, error) {
 		return nil, err
 	}
 
+	// Small unmasked frames (such as the ones sent by servers broadcasting
+	// chat messages) take a faster path.
+	if len(f.payload) <= 125 && len(f.key) == 0 {
+		return f.toBytesSmall(), nil
+	}
+
+	return f.toBytesGeneral(), nil
+}
+
+// toBytesSmall returns the representation of a frame which has no masking key
+// and a payload data of at most 125 bytes, using a single allocation.
+func (f *frame) toBytesSmall() []byte {
+	p := make([]byte, 2+len(f.payload))
+
+	f.toBytesFin(p)
+	f.toBytesRSV(p)
+	f.toBytesOpcode(p)
+	p[1] = byte(len(f.payload))
+
+	copy(p[2:], f.payload)
+
+	return p
+}
+
+// toBytesGeneral returns the representation of any valid frame.
+func (f *frame) toBytesGeneral() []byte {
 	// Slice of bytes used to contain the payload data.
 	p := make([]byte, 2)
 
 	// Include info for FIN bit.
 	f.toBytesFin(p)
 
+	// Include info for RSV bits.
+	f.toBytesRSV(p)
+
 	// Include info for OPCODE bits.
 	f.toBytesOpcode(p)
 
@@ -272,7 +360,7 @@ func (f *frame) toBytes() ([]byte, error) {
 	p = append(p, f.toBytesPayloadData()...)
 
 	// Append and PAYLOAD DATA bits and return whole payload
-	return p, nil
+	return p
 }
 
 // validate verifies that the data of the frame instance will result in a valid
@@ -295,6 +383,15 @@ func (f *frame) validate() *CloseError {
 				Reason: "masking key must either be 0 or 4 bytes long",
 			}
 		}
+	// Payload data of control frames must not exceed 125 bytes.
+	// Ref Spec: https://tools.ietf.org/html/rfc6455#section-5.5
+	case f.opcode >= OpcodeClose && len(f.payload) > MaxControlFramePayload:
+		{
+			return &CloseError{
+				Code:   CloseProtocolError,
+				Reason: "control frame too long",
+			}
+		}
 	// Payload data must have a valid length.
 	case !validatePayload(f.payload):
 		{
@@ -316,6 +413,13 @@ func (f *frame) toBytesFin(p []byte) {
 	}
 }
 
+// toBytesRSV is used by toBytes to include info in 'p' about the RSV1-3 bits
+// of the frame instance. Note that this method should be invoked after
+// toBytesFin.
+func (f *frame) toBytesRSV(p []byte) {
+	p[0] += byte(f.rsv&7) << 4
+}
+
 // toBytesOpcode is used by toBytes to include info in 'p' about the OPCODE
 // bits of the frame instance. Note that this method should be invoked after
 // toBytesFin.
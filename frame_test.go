@@ -2,6 +2,7 @@ package websocket
 
 import (
 	"bufio"
+	"bytes"
 	"testing"
 )
 
@@ -43,9 +44,10 @@ func TestReadInitialForOpcode(t *testing.T) {
 		{b: newBuffer([]byte{0, 0}), v: OpcodeContinuation},
 		{b: newBuffer([]byte{1, 0}), v: OpcodeText},
 		{b: newBuffer([]byte{2, 0}), v: OpcodeBinary},
-		{b: newBuffer([]byte{8, 0}), v: OpcodeClose},
-		{b: newBuffer([]byte{9, 0}), v: OpcodePing},
-		{b: newBuffer([]byte{10, 0}), v: OpcodePong},
+		// Control frames must have the fin bit set.
+		{b: newBuffer([]byte{136, 0}), v: OpcodeClose},
+		{b: newBuffer([]byte{137, 0}), v: OpcodePing},
+		{b: newBuffer([]byte{138, 0}), v: OpcodePong},
 
 		// With mask bit.
 		{b: newBuffer([]byte{128, 0}), v: OpcodeContinuation},
@@ -233,19 +235,21 @@ func TestReadLength(t *testing.T) {
 		i uint64
 		// final length
 		l uint64
+		// extended payload length
+		b []byte
 	}
 
 	testCases := []testCase{
 		{i: 124, l: 124},
 		{i: 125, l: 125},
-		{i: 126, l: 65535},
-		{i: 127, l: 9223372036854775807},
+		{i: 126, l: 65535, b: []byte{255, 255}},
+		{i: 127, l: 9223372036854775807, b: []byte{127, 255, 255, 255, 255, 255, 255, 255}},
 	}
 
 	for i, c := range testCases {
 		f.length = c.i
 
-		b := newBuffer([]byte{255, 255, 255, 255, 255, 255, 255, 255})
+		b := newBuffer(c.b)
 		if err := f.readLength(b); err != nil {
 			t.Errorf("test case %d: unexpected error returned: %v", i, err)
 		}
@@ -301,6 +305,49 @@ func TestReadPayload(t *testing.T) {
 	}
 }
 
+func TestReadPayloadBackToBack(t *testing.T) {
+	e := [][]byte{
+		[]byte("first payload"),
+		[]byte("second payload"),
+	}
+
+	var p []byte
+
+	// Two masked frames sent back to back.
+	for _, v := range e {
+		b, err := (&frame{fin: true, opcode: OpcodeText, key: []byte{10, 15, 1, 120}, payload: v}).toBytes()
+
+		if err != nil {
+			t.Fatal("unexpected error returned", err)
+		}
+
+		p = append(p, b...)
+	}
+
+	b := newBuffer(p)
+
+	f, err := newFrame(b)
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	n, err := newFrame(b)
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	// Reading the second frame must not alter the payload of the first one.
+	if string(f.payload) != string(e[0]) {
+		t.Errorf(`expected payload to be "%s", but it is "%s"`, e[0], f.payload)
+	}
+
+	if string(n.payload) != string(e[1]) {
+		t.Errorf(`expected payload to be "%s", but it is "%s"`, e[1], n.payload)
+	}
+}
+
 func TestToBytesFin(t *testing.T) {
 	type testCase struct {
 		v bool
@@ -486,3 +533,128 @@ func TestToBytesPayloadData(t *testing.T) {
 		}
 	}
 }
+
+func TestParseFrameIgnoreRSV(t *testing.T) {
+	f, err := parseFrame(newBuffer([]byte{193 /* 11000001 */, 0}), true, nil)
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	if f.rsv != 4 {
+		t.Errorf("expected 'rsv' to be '4', but it is '%d'", f.rsv)
+	}
+
+	if f.opcode != OpcodeText {
+		t.Errorf("expected 'opcode' to be '%d', but it is '%d'", OpcodeText, f.opcode)
+	}
+}
+
+func TestParseFrameHeaderError(t *testing.T) {
+	type testCase struct {
+		b []byte
+	}
+
+	testCases := []testCase{
+		// Non minimal 16 bit payload length.
+		{b: []byte{130 /* 10000010 */, 126 /* 01111110 */, 0, 125}},
+		// Non minimal 64 bit payload length.
+		{b: []byte{130 /* 10000010 */, 127 /* 01111111 */, 0, 0, 0, 0, 0, 0, 255, 255}},
+		// Most significant bit of the 64 bit payload length set.
+		{b: []byte{130 /* 10000010 */, 127 /* 01111111 */, 128, 0, 0, 0, 0, 0, 0, 1}},
+		// Fragmented control frame.
+		{b: []byte{9 /* 00001001 */, 0}},
+		// Control frame with more than 125 bytes of payload data.
+		{b: []byte{137 /* 10001001 */, 126 /* 01111110 */, 1, 44}},
+	}
+
+	for i, c := range testCases {
+		_, err := newFrame(newBuffer(c.b))
+
+		if e, k := err.(*CloseError); !k || e.Code != CloseProtocolError {
+			t.Errorf("test case %d: expected a protocol error but got '%v'", i, err)
+		}
+	}
+}
+
+func TestFrameToBytesSmall(t *testing.T) {
+	for _, o := range []int{OpcodeText, OpcodeBinary, OpcodePing} {
+		for l := 0; l <= 125; l++ {
+			for _, n := range []bool{true, false} {
+				f := &frame{
+					fin:     n,
+					opcode:  o,
+					payload: bytes.Repeat([]byte{byte(l)}, l),
+				}
+
+				if !bytes.Equal(f.toBytesSmall(), f.toBytesGeneral()) {
+					t.Fatalf("expected fast path to match general path for opcode '%d', length '%d' and fin '%t'", o, l, n)
+				}
+			}
+		}
+	}
+}
+
+func TestFrameToBytesControlTooLong(t *testing.T) {
+	type testCase struct {
+		o int
+		l int
+		v bool
+	}
+
+	testCases := []testCase{
+		// Payload data of control frames can be up to 125 bytes long.
+		{o: OpcodeClose, l: MaxControlFramePayload, v: true},
+		{o: OpcodePing, l: MaxControlFramePayload, v: true},
+		{o: OpcodePong, l: MaxControlFramePayload, v: true},
+		// Longer payload data would require an extended payload length.
+		{o: OpcodeClose, l: MaxControlFramePayload + 1, v: false},
+		{o: OpcodePing, l: MaxControlFramePayload + 1, v: false},
+		{o: OpcodePong, l: 65536, v: false},
+		// Data frames are not restricted.
+		{o: OpcodeText, l: MaxControlFramePayload + 1, v: true},
+	}
+
+	for i, c := range testCases {
+		f := &frame{
+			fin:     true,
+			opcode:  c.o,
+			key:     []byte{1, 2, 3, 4},
+			payload: make([]byte, c.l),
+		}
+
+		_, err := f.toBytes()
+
+		if c.v && err != nil {
+			t.Errorf("test case %d: unexpected error returned %v", i, err)
+		}
+
+		if !c.v {
+			if e, k := err.(*CloseError); !k || e.Code != CloseProtocolError {
+				t.Errorf("test case %d: expected a protocol error but got '%v'", i, err)
+			}
+		}
+	}
+}
+
+func BenchmarkServerWriteSmall(b *testing.B) {
+	f := &frame{
+		fin:     true,
+		opcode:  OpcodeText,
+		payload: []byte(`{"type":"message","data":"hello world"}`),
+	}
+
+	b.Run("fast", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			f.toBytesSmall()
+		}
+	})
+
+	b.Run("general", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			f.toBytesGeneral()
+		}
+	})
+}
@@ -38,3 +38,98 @@ func validateKey(k []byte) bool {
 func validatePayload(p []byte) bool {
 	return len(p) <= 9223372036854775807
 }
+
+// validateFrameHeader validates the header of a frame ('f') read from the
+// connected endpoint, where 'n' is the payload length as encoded in the first 2
+// bytes of the frame (i.e. 126 and 127 indicate that a 16 and 64 bit extended
+// payload length is used respectively).
+//
+// Ref Spec: https://tools.ietf.org/html/rfc6455#section-5.2
+// Ref Spec: https://tools.ietf.org/html/rfc6455#section-5.5
+func validateFrameHeader(f *frame, n uint64) *CloseError {
+	switch {
+	// The minimal number of bytes must be used to encode the payload length.
+	case n == 126 && f.length <= 125:
+		{
+			return &CloseError{
+				Code:   CloseProtocolError,
+				Reason: "non minimal 16 bit payload length",
+			}
+		}
+	case n == 127 && f.length <= 65535:
+		{
+			return &CloseError{
+				Code:   CloseProtocolError,
+				Reason: "non minimal 64 bit payload length",
+			}
+		}
+	// The most significant bit of a 64 bit payload length must be 0.
+	case n == 127 && f.length>>63 == 1:
+		{
+			return &CloseError{
+				Code:   CloseProtocolError,
+				Reason: "invalid payload length",
+			}
+		}
+	// Control frames must not be fragmented and their payload data must not
+	// exceed 125 bytes.
+	case f.opcode >= OpcodeClose && !f.fin:
+		{
+			return &CloseError{
+				Code:   CloseProtocolError,
+				Reason: "fragmented control frame",
+			}
+		}
+	case f.opcode >= OpcodeClose && f.length > MaxControlFramePayload:
+		{
+			return &CloseError{
+				Code:   CloseProtocolError,
+				Reason: "control frame too long",
+			}
+		}
+	}
+	return nil
+}
+
+// FrameSize returns the number of bytes a frame with a payload data of 'l'
+// bytes will occupy on the wire. This includes the frame header (2, 4 or 10
+// bytes depending on the payload length) and the masking key (4 bytes) if the
+// payload data will be masked ('m'). Note that the opcode ('o') doesn't affect
+// the size of the frame and is only accepted so that the size of a message can
+// be estimated using the same arguments used to send it.
+//
+// Ref Spec: https://tools.ietf.org/html/rfc6455#section-5.2
+func FrameSize(o int, l int, m bool) int {
+	// FIN, RSV 1-3, OPCODE, MASK and PAYLOAD LEN bits.
+	n := 2
+
+	// PAYLOAD LENGTH EXTENDED bits.
+	switch {
+	case l > 65535:
+		{
+			n += 8
+		}
+	case l > 125:
+		{
+			n += 2
+		}
+	}
+
+	// MASKING KEY bits.
+	if m {
+		n += 4
+	}
+
+	return n + l
+}
+
+// frameOverhead returns the number of bytes taken by the header and by the
+// masking key of the frame provided ('f') on the wire. The header size is that
+// of the minimal encoding of the payload length, which endpoints are required
+// to use.
+//
+// Ref Spec: https://tools.ietf.org/html/rfc6455#section-5.2
+func frameOverhead(f *frame) (int, int) {
+	k := len(f.key)
+	return FrameSize(f.opcode, len(f.payload), false) - len(f.payload), k
+}
@@ -61,3 +61,109 @@ func TestValidatePayload(t *testing.T) {
 		}
 	}
 }
+
+func TestFrameSize(t *testing.T) {
+	type testCase struct {
+		l int
+		m bool
+		n int
+	}
+
+	testCases := []testCase{
+		{l: 0, m: false, n: 2},
+		{l: 125, m: false, n: 127},
+		{l: 125, m: true, n: 131},
+		{l: 126, m: false, n: 130},
+		{l: 65535, m: false, n: 65539},
+		{l: 65535, m: true, n: 65543},
+		{l: 65536, m: false, n: 65546},
+		{l: 65536, m: true, n: 65550},
+	}
+
+	for i, c := range testCases {
+		if n := FrameSize(OpcodeBinary, c.l, c.m); n != c.n {
+			t.Errorf("test case %d: expected frame size to be '%d' but it is '%d'", i, c.n, n)
+		}
+
+		// Estimated size must match the size of the frame actually generated.
+		f := &frame{
+			fin:     true,
+			opcode:  OpcodeBinary,
+			payload: make([]byte, c.l),
+		}
+
+		if c.m {
+			f.key = []byte{1, 2, 3, 4}
+		}
+
+		b, err := f.toBytes()
+
+		if err != nil {
+			t.Fatalf("test case %d: unexpected error returned %s", i, err)
+		}
+
+		if len(b) != c.n {
+			t.Errorf("test case %d: expected generated frame to be '%d' bytes but it is '%d'", i, c.n, len(b))
+		}
+	}
+}
+
+func TestValidateFrameHeader(t *testing.T) {
+	type testCase struct {
+		f *frame
+		n uint64
+		r string
+	}
+
+	testCases := []testCase{
+		// Valid data frames.
+		{f: &frame{fin: true, opcode: OpcodeText, length: 125}, n: 125},
+		{f: &frame{fin: false, opcode: OpcodeBinary, length: 126}, n: 126},
+		{f: &frame{fin: true, opcode: OpcodeBinary, length: 65535}, n: 126},
+		{f: &frame{fin: true, opcode: OpcodeBinary, length: 65536}, n: 127},
+		{f: &frame{fin: true, opcode: OpcodeBinary, length: 9223372036854775807}, n: 127},
+		// Valid control frames.
+		{f: &frame{fin: true, opcode: OpcodePing, length: 0}, n: 0},
+		{f: &frame{fin: true, opcode: OpcodeClose, length: 125}, n: 125},
+		// Non minimal 16 bit payload length.
+		{f: &frame{fin: true, opcode: OpcodeText, length: 0}, n: 126, r: "non minimal 16 bit payload length"},
+		{f: &frame{fin: true, opcode: OpcodeText, length: 125}, n: 126, r: "non minimal 16 bit payload length"},
+		// Non minimal 64 bit payload length.
+		{f: &frame{fin: true, opcode: OpcodeText, length: 125}, n: 127, r: "non minimal 64 bit payload length"},
+		{f: &frame{fin: true, opcode: OpcodeText, length: 65535}, n: 127, r: "non minimal 64 bit payload length"},
+		// Most significant bit of the 64 bit payload length set.
+		{f: &frame{fin: true, opcode: OpcodeText, length: 9223372036854775808}, n: 127, r: "invalid payload length"},
+		{f: &frame{fin: true, opcode: OpcodeText, length: 18446744073709551615}, n: 127, r: "invalid payload length"},
+		// Fragmented control frames.
+		{f: &frame{fin: false, opcode: OpcodeClose}, n: 0, r: "fragmented control frame"},
+		{f: &frame{fin: false, opcode: OpcodePing}, n: 0, r: "fragmented control frame"},
+		{f: &frame{fin: false, opcode: OpcodePong}, n: 0, r: "fragmented control frame"},
+		// Control frames with more than 125 bytes of payload data.
+		{f: &frame{fin: true, opcode: OpcodePing, length: 126}, n: 126, r: "control frame too long"},
+		{f: &frame{fin: true, opcode: OpcodePong, length: 65536}, n: 127, r: "control frame too long"},
+	}
+
+	for i, c := range testCases {
+		e := validateFrameHeader(c.f, c.n)
+
+		if c.r == "" {
+			if e != nil {
+				t.Errorf("test case %d: unexpected error returned %v", i, e)
+			}
+			continue
+		}
+
+		if e == nil {
+			t.Errorf("test case %d: expected an error to be returned", i)
+			continue
+		}
+
+		if e.Code != CloseProtocolError {
+			t.Errorf("test case %d: expected Close Error Code to be '%d', but it is '%d'", i, CloseProtocolError, e.Code)
+		}
+
+		if e.Reason != c.r {
+			t.Errorf(`test case %d: expected reason to be "%s", but it is "%s"`, i, c.r, e.Reason)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package websocket
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// EnableKeepAlive starts sending a ping frame to the connected endpoint every
+// 'i', and fails the connection with a going away error (1001) if its pong
+// frame isn't received within 't'. A pong handler (invoking the current one,
+// if any) is installed to keep track of the pong frames received, which also
+// extends the read deadline each time a pong frame is received (by enough time
+// for the next ping frame to be sent and answered), so that reads don't block
+// forever on a connection which is dead.
+//
+// Keepalive stops once the connection is closed. EnableKeepAlive should be
+// invoked before listening for frames.
+func (s *Socket) EnableKeepAlive(i, t time.Duration) {
+	h := s.PongHandler
+
+	// The read deadline leaves some leeway after the next pong frame is due,
+	// so that an unanswered ping frame fails the connection first.
+	d := 2*i + t
+
+	s.PongHandler = func(p []byte) {
+		atomic.StoreInt64(&s.lastPong, time.Now().UnixNano())
+		s.SetReadDeadline(time.Now().Add(d))
+
+		if h != nil {
+			h(p)
+		}
+	}
+
+	s.SetReadDeadline(time.Now().Add(d))
+
+	go s.keepAlive(i, t)
+}
+
+// keepAlive sends a ping frame every 'i' until the connection is closed,
+// failing the connection if a pong frame isn't received within 't'.
+func (s *Socket) keepAlive(i, t time.Duration) {
+	k := time.NewTicker(i)
+	defer k.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			{
+				return
+			}
+		case <-k.C:
+			{
+
+			}
+		}
+
+		p := time.Now().UnixNano()
+
+		if err := s.WriteMessage(OpcodePing, nil); err != nil {
+			return
+		}
+
+		select {
+		case <-s.done:
+			{
+				return
+			}
+		case <-time.After(t):
+			{
+
+			}
+		}
+
+		if atomic.LoadInt64(&s.lastPong) < p {
+			s.CloseWithError(&CloseError{
+				Code:   CloseGoingAway,
+				Reason: "keepalive timed out",
+			})
+			return
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package websocket
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSocketEnableKeepAlive(t *testing.T) {
+	done := make(chan bool, 1)
+
+	s, c := newSocketPair(t)
+	defer c.TCPClose()
+
+	// Number of pong frames received, updated by the reading goroutine.
+	var n int64
+
+	s.PongHandler = func(p []byte) {
+		atomic.AddInt64(&n, 1)
+	}
+
+	s.CloseHandler = func(err error) {
+		done <- true
+	}
+
+	s.EnableKeepAlive(time.Millisecond*20, time.Millisecond*50)
+
+	go s.Listen()
+	go c.Listen()
+
+	// Connected endpoint replies to the ping frames.
+	select {
+	case <-done:
+		{
+			t.Fatal("expected connection to be kept alive")
+		}
+	case <-time.After(time.Millisecond * 300):
+		{
+
+		}
+	}
+
+	if atomic.LoadInt64(&n) == 0 {
+		t.Error("expected previous pong handler to be invoked")
+	}
+
+	s.TCPClose()
+}
+
+func TestSocketEnableKeepAliveTimeout(t *testing.T) {
+	done := make(chan bool, 1)
+
+	s, c := newSocketPair(t)
+	defer c.TCPClose()
+
+	s.CloseHandler = func(err error) {
+		if e, k := err.(*CloseError); !k || e.Code != CloseGoingAway {
+			t.Errorf("expected a going away error but got '%v'", err)
+		}
+
+		done <- true
+	}
+
+	s.EnableKeepAlive(time.Millisecond*20, time.Millisecond*50)
+
+	go s.Listen()
+
+	// Connected endpoint doesn't reply to the ping frames since it isn't
+	// listening.
+	select {
+	case <-done:
+		{
+
+		}
+	case <-time.After(time.Second * 2):
+		{
+			t.Error("expected connection to be closed")
+		}
+	}
+}
+
+func TestSocketMaxOutstandingPings(t *testing.T) {
+	s, c := newSocketPair(t)
+	defer s.TCPClose()
+	defer c.TCPClose()
+
+	s.MaxOutstandingPings = 2
+
+	type testCase struct {
+		o int
+		p bool
+	}
+
+	testCases := []testCase{
+		// Ping frames within the limit are sent.
+		{o: OpcodePing, p: true},
+		{o: OpcodePing, p: true},
+		// Connection is closed instead of sending another ping frame.
+		{o: OpcodeClose, p: false},
+	}
+
+	for i, tc := range testCases {
+		err := s.WriteMessage(OpcodePing, nil)
+
+		if tc.p && err != nil {
+			t.Fatalf("test case %d: unexpected error returned %v", i, err)
+		}
+
+		if !tc.p && err == nil {
+			t.Errorf("test case %d: expected an error to be returned", i)
+		}
+
+		c.SetReadDeadline(time.Now().Add(time.Second * 2))
+
+		f, err := newFrame(c.buf.Reader)
+
+		if err != nil {
+			t.Fatalf("test case %d: unexpected error returned %v", i, err)
+		}
+
+		if f.opcode != tc.o {
+			t.Errorf("test case %d: expected opcode to be '%d', but it is '%d'", i, tc.o, f.opcode)
+		}
+
+		if f.opcode == OpcodeClose {
+			if e, _ := NewCloseError(f.payload); e.Code != CloseGoingAway {
+				t.Errorf("test case %d: expected Close Error Code to be '%d', but it is '%d'", i, CloseGoingAway, e.Code)
+			}
+		}
+	}
+}
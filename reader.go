@@ -0,0 +1,207 @@
+package websocket
+
+import "io"
+
+// messageReader reads the payload data of a single message, frame by frame.
+type messageReader struct {
+	/*
+		socket is the socket instance the message is read from.
+	*/
+	socket *Socket
+
+	/*
+		opcode is the opcode of the message.
+	*/
+	opcode int
+
+	/*
+		payload contains the payload data of the current frame which is yet
+		to be read.
+	*/
+	payload []byte
+
+	/*
+		fin indicates that the final fragment of the message has been
+		received.
+	*/
+	fin bool
+
+	/*
+		compressed indicates that the payload data of the message is
+		compressed, in which case it is validated once decompressed.
+	*/
+	compressed bool
+
+	/*
+		n is the number of payload data bytes received so far.
+	*/
+	n int64
+
+	/*
+		utf8 validates the payload data of text messages as it is received.
+	*/
+	utf8 utf8Validator
+
+	/*
+		err is the error which stopped the message from being read.
+	*/
+	err error
+}
+
+// NextReader returns the opcode of the next text or binary message sent by the
+// connected endpoint, together with a reader used to read its payload data.
+// Fragmented messages are read one frame at a time as the reader is read from,
+// rather than being reassembled in their entirety, with io.EOF being returned
+// once the final fragment is read. Control frames received in the meantime are
+// handled just like while listening.
+//
+// The reader must be read until io.EOF is returned before NextReader is
+// invoked again. Note that NextReader should not be used while listening.
+//
+// If the connection is closed while reading, the close error is returned.
+func (s *Socket) NextReader() (int, io.Reader, error) {
+	f, err := s.nextDataFrame()
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// A message must start with either a text or binary frame.
+	// Ref Spec: https://tools.ietf.org/html/rfc6455#section-5.4
+	if f.opcode == OpcodeContinuation {
+		return 0, nil, s.failMessage(&CloseError{
+			Code:   CloseProtocolError,
+			Reason: "unexpected fragment",
+		})
+	}
+
+	r := &messageReader{
+		socket:     s,
+		opcode:     f.opcode,
+		compressed: f.compressed,
+	}
+
+	if err := r.setFrame(f); err != nil {
+		return f.opcode, nil, err
+	}
+
+	if r.compressed {
+		return f.opcode, &inflateReader{
+			socket: s,
+			reader: newInflater(r, s.inflated),
+			text:   f.opcode == OpcodeText,
+		}, nil
+	}
+
+	return f.opcode, r, nil
+}
+
+// Read reads the payload data of the message into 'p'.
+func (r *messageReader) Read(p []byte) (int, error) {
+	for len(r.payload) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		if r.fin {
+			return 0, io.EOF
+		}
+
+		f, err := r.socket.nextDataFrame()
+
+		if err != nil {
+			r.err = err
+			return 0, err
+		}
+
+		// The rest of the message must be sent in continuation frames.
+		// Ref Spec: https://tools.ietf.org/html/rfc6455#section-5.4
+		if f.opcode != OpcodeContinuation {
+			r.err = r.socket.failMessage(&CloseError{
+				Code:   CloseProtocolError,
+				Reason: "unexpected fragment",
+			})
+			return 0, r.err
+		}
+
+		if err := r.setFrame(f); err != nil {
+			r.err = err
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.payload)
+	r.payload = r.payload[n:]
+
+	return n, nil
+}
+
+// setFrame makes the payload data of the frame provided ('f') the next chunk
+// of the message to be read.
+func (r *messageReader) setFrame(f *frame) error {
+	// The payload data of text messages must be valid UTF-8.
+	// Ref Spec: https://tools.ietf.org/html/rfc6455#section-8.1
+	if r.opcode == OpcodeText && !r.compressed && (!r.utf8.write(f.payload) || f.fin && !r.utf8.done()) {
+		return r.socket.failMessage(&CloseError{
+			Code:   CloseInvalidFramePayloadData,
+			Reason: "invalid utf-8",
+		})
+	}
+
+	r.payload = f.payload
+	r.fin = f.fin
+	r.n += int64(len(f.payload))
+
+	r.socket.fragmentsSize = r.n
+
+	if r.fin {
+		r.socket.fragmentsSize = 0
+	}
+
+	return nil
+}
+
+// nextDataFrame reads frames sent by the connected endpoint until a data frame
+// is received, handling the control frames received in the meantime.
+func (s *Socket) nextDataFrame() (*frame, error) {
+	for {
+		f, err := s.readFrame()
+
+		if err != nil {
+			// If an error occurred due to something which doesn't conform
+			// with the websocket rfc, fail the connection.
+			if c, k := err.(*CloseError); k {
+				s.CloseWithError(c)
+			}
+			return nil, err
+		}
+
+		switch f.opcode {
+		case OpcodeText, OpcodeBinary, OpcodeContinuation:
+			{
+				return f, nil
+			}
+		case OpcodePing:
+			{
+				s.callPingHandler(f.payload)
+			}
+		case OpcodePong:
+			{
+				s.callPongHandler(f.payload)
+			}
+		case OpcodeClose:
+			{
+				s.fragmentsSize = 0
+				s.handleClose(f)
+				return nil, s.closeError
+			}
+		}
+	}
+}
+
+// failMessage fails the connection with the close error provided ('e') and
+// returns it.
+func (s *Socket) failMessage(e *CloseError) error {
+	s.CloseWithError(e)
+	return e
+}
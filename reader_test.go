@@ -0,0 +1,79 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestNextReader(t *testing.T) {
+	// Client endpoint sending a fragmented message with a ping frame in
+	// between its fragments.
+	b := &bytes.Buffer{}
+	c := newSocket(nil, bufio.NewReadWriter(nil, bufio.NewWriter(b)), false)
+
+	w, err := c.NextWriter(OpcodeBinary)
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	w.Write([]byte("first "))
+	c.WriteMessage(OpcodePing, []byte("ping"))
+	w.Write([]byte("second"))
+	w.Close()
+
+	// Server endpoint receiving the message.
+	r := bufio.NewReaderSize(bytes.NewReader(b.Bytes()), b.Len()+16)
+	s := newSocket(nil, bufio.NewReadWriter(r, bufio.NewWriter(&bytes.Buffer{})), true)
+
+	n := 0
+
+	s.PingHandler = func(p []byte) {
+		n++
+	}
+
+	o, m, err := s.NextReader()
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	if o != OpcodeBinary {
+		t.Errorf("expected opcode to be '%d', but it is '%d'", OpcodeBinary, o)
+	}
+
+	type testCase struct {
+		v   string
+		n   int
+		err error
+	}
+
+	// Payload data is read in chunks smaller than the fragments.
+	testCases := []testCase{
+		{v: "firs", n: 0},
+		{v: "t ", n: 0},
+		{v: "seco", n: 1},
+		{v: "nd", n: 1},
+		{v: "", n: 1, err: io.EOF},
+	}
+
+	for i, tc := range testCases {
+		p := make([]byte, 4)
+
+		l, err := m.Read(p)
+
+		if err != tc.err {
+			t.Fatalf(`test case %d: expected error "%v" but got "%v"`, i, tc.err, err)
+		}
+
+		if string(p[:l]) != tc.v {
+			t.Errorf(`test case %d: expected "%s" to be read, but "%s" was read`, i, tc.v, p[:l])
+		}
+
+		if n != tc.n {
+			t.Errorf("test case %d: expected ping handler to be invoked '%d' times but it was invoked '%d' times", i, tc.n, n)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package websocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// recordPrefixSize is the number of bytes used to encode the length of each
+// record.
+const recordPrefixSize = 4
+
+// DefaultMaxRecordSize is the maximum size of the records read by a
+// RecordReader when its MaxRecordSize is not set.
+const DefaultMaxRecordSize = 1 << 20
+
+// ErrRecordTooLarge is the error returned when a record read is larger than the
+// maximum record size of the RecordReader.
+var ErrRecordTooLarge = errors.New("record too large")
+
+// RecordWriter packs multiple records into a single binary message. Each record
+// is prefixed with its length as a 32 bit unsigned integer in network byte
+// order. Records are buffered until Close is invoked, which sends the message.
+type RecordWriter struct {
+	/*
+		socket is the socket instance the message is sent through.
+	*/
+	socket *Socket
+
+	/*
+		buf holds the records written so far.
+	*/
+	buf bytes.Buffer
+}
+
+// NewRecordWriter is a constructor function to create a new RecordWriter
+// instance which sends its records through the socket instance provided.
+func NewRecordWriter(s *Socket) *RecordWriter {
+	return &RecordWriter{
+		socket: s,
+	}
+}
+
+// WriteRecord appends the record 'p' to the message.
+func (w *RecordWriter) WriteRecord(p []byte) error {
+	if uint64(len(p)) > 0xFFFFFFFF {
+		return errors.New("record too large")
+	}
+
+	b := make([]byte, recordPrefixSize)
+	binary.BigEndian.PutUint32(b, uint32(len(p)))
+
+	w.buf.Write(b)
+	w.buf.Write(p)
+
+	return nil
+}
+
+// Close sends the records written as a single binary message. The records are
+// discarded afterwards, so that the writer can be reused for the next message.
+func (w *RecordWriter) Close() error {
+	err := w.socket.WriteMessage(OpcodeBinary, w.buf.Bytes())
+	w.buf.Reset()
+
+	return err
+}
+
+// RecordReader parses the records packed in a message by a RecordWriter.
+type RecordReader struct {
+	/*
+		reader is used to read the payload data of the message.
+	*/
+	reader io.Reader
+
+	/*
+		MaxRecordSize is the maximum number of bytes a record read can have.
+		Since the length prefix is sent by the connected endpoint, records
+		claiming to be larger are rejected with ErrRecordTooLarge before any
+		of their data is read. When zero, DefaultMaxRecordSize is used.
+	*/
+	MaxRecordSize int
+}
+
+// NewRecordReader is a constructor function to create a new RecordReader
+// instance which reads records from the payload data of a message ('r'). The
+// payload data can be provided using either bytes.NewReader (ex: from within a
+// read handler) or a reader fed by Socket.ReadInto.
+func NewRecordReader(r io.Reader) *RecordReader {
+	return &RecordReader{
+		reader: r,
+	}
+}
+
+// ReadRecord returns the next record of the message. io.EOF is returned once
+// there are no more records to be read, while io.ErrUnexpectedEOF is returned
+// if the message ends in the middle of a record. ErrRecordTooLarge is returned
+// if the record is larger than MaxRecordSize.
+func (r *RecordReader) ReadRecord() ([]byte, error) {
+	b := make([]byte, recordPrefixSize)
+
+	if _, err := io.ReadFull(r.reader, b); err != nil {
+		return nil, err
+	}
+
+	l := int64(binary.BigEndian.Uint32(b))
+
+	m := int64(r.MaxRecordSize)
+
+	if m <= 0 {
+		m = DefaultMaxRecordSize
+	}
+
+	if l > m {
+		return nil, ErrRecordTooLarge
+	}
+
+	// The record is read into a buffer which grows as its data is received,
+	// rather than allocating the length claimed up front.
+	p := &bytes.Buffer{}
+
+	n, err := io.CopyN(p, r.reader, l)
+
+	if n < l {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	return p.Bytes(), nil
+}
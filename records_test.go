@@ -0,0 +1,129 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestRecords(t *testing.T) {
+	l := [][]byte{[]byte("first"), {}, []byte("third record")}
+
+	// Client endpoint sending the records.
+	b := &bytes.Buffer{}
+	c := newSocket(nil, bufio.NewReadWriter(nil, bufio.NewWriter(b)), false)
+
+	w := NewRecordWriter(c)
+
+	for _, p := range l {
+		if err := w.WriteRecord(p); err != nil {
+			t.Fatal("unexpected error returned", err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	// Server endpoint receiving the records.
+	q := bufio.NewReaderSize(bytes.NewReader(b.Bytes()), b.Len()+16)
+	s := newSocket(nil, bufio.NewReadWriter(q, nil), true)
+
+	m := &bytes.Buffer{}
+
+	o, _, err := s.ReadInto(m)
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	if o != OpcodeBinary {
+		t.Errorf("expected opcode to be '%d', but it is '%d'", OpcodeBinary, o)
+	}
+
+	r := NewRecordReader(m)
+
+	for i, e := range l {
+		p, err := r.ReadRecord()
+
+		if err != nil {
+			t.Fatalf("record %d: unexpected error returned %v", i, err)
+		}
+
+		if !bytes.Equal(p, e) {
+			t.Errorf(`record %d: expected record to be "%s", but it is "%s"`, i, e, p)
+		}
+	}
+
+	if _, err := r.ReadRecord(); err != io.EOF {
+		t.Errorf(`expected error "%v" but got "%v"`, io.EOF, err)
+	}
+}
+
+func TestRecordWriterCloseTwice(t *testing.T) {
+	// Client endpoint sending the records.
+	b := &bytes.Buffer{}
+	c := newSocket(nil, bufio.NewReadWriter(nil, bufio.NewWriter(b)), false)
+
+	w := NewRecordWriter(c)
+
+	if err := w.WriteRecord([]byte("first")); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := w.Close(); err != nil {
+			t.Fatal("unexpected error returned", err)
+		}
+	}
+
+	// Server endpoint receiving the messages.
+	q := bufio.NewReaderSize(bytes.NewReader(b.Bytes()), b.Len()+16)
+	s := newSocket(nil, bufio.NewReadWriter(q, nil), true)
+
+	// The records are only sent with the first message.
+	for i, l := range []int{recordPrefixSize + 5, 0} {
+		m := &bytes.Buffer{}
+
+		if _, _, err := s.ReadInto(m); err != nil {
+			t.Fatalf("message %d: unexpected error returned %v", i, err)
+		}
+
+		if m.Len() != l {
+			t.Errorf("message %d: expected message to be '%d' bytes long, but it is '%d'", i, l, m.Len())
+		}
+	}
+}
+
+func TestRecordReaderTruncated(t *testing.T) {
+	r := NewRecordReader(bytes.NewReader([]byte{0, 0, 0, 5, 'a', 'b'}))
+
+	if _, err := r.ReadRecord(); err != io.ErrUnexpectedEOF {
+		t.Errorf(`expected error "%v" but got "%v"`, io.ErrUnexpectedEOF, err)
+	}
+}
+
+func TestRecordReaderTooLarge(t *testing.T) {
+	type testCase struct {
+		p []byte
+		m int
+		e error
+	}
+
+	testCases := []testCase{
+		// Length prefix claiming 4 GiB.
+		{p: []byte{255, 255, 255, 255, 'a'}, e: ErrRecordTooLarge},
+		{p: []byte{0, 0, 0, 5, 'a', 'b', 'c', 'd', 'e'}, m: 4, e: ErrRecordTooLarge},
+		{p: []byte{0, 0, 0, 5, 'a', 'b', 'c', 'd', 'e'}, m: 5},
+	}
+
+	for i, c := range testCases {
+		r := NewRecordReader(bytes.NewReader(c.p))
+		r.MaxRecordSize = c.m
+
+		if _, err := r.ReadRecord(); err != c.e {
+			t.Errorf(`test case %d: expected error "%v" but got "%v"`, i, c.e, err)
+		}
+	}
+}
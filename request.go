@@ -1,13 +1,115 @@
 package websocket
 
 import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
 	"net/http"
-	"sync"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // wsVersion is the websocket version this library supports.
 const wsVersion = "13"
 
+// UpgradeOutcome is the outcome of an attempt to upgrade a connection to use the
+// WS protocol.
+type UpgradeOutcome int
+
+// Outcomes of an attempt to upgrade a connection.
+const (
+	// UpgradeSuccess is used when the connection has been upgraded.
+	UpgradeSuccess UpgradeOutcome = iota
+
+	// UpgradeRejectedOrigin is used when the origin of the request is
+	// rejected.
+	UpgradeRejectedOrigin
+
+	// UpgradeBadVersion is used when the websocket version requested is not
+	// supported.
+	UpgradeBadVersion
+
+	// UpgradeBadRequest is used when the handshake request is not valid.
+	UpgradeBadRequest
+
+	// UpgradeBadSubProtocol is used when the sub protocol chosen by the server
+	// is not a valid HTTP token.
+	UpgradeBadSubProtocol
+
+	// UpgradeHijackFailure is used when the connection can't be taken over
+	// from the HTTP server.
+	UpgradeHijackFailure
+
+	// UpgradeResponseFailure is used when the handshake response can't be
+	// sent.
+	UpgradeResponseFailure
+
+	// UpgradeBadCompressionLevel is used when the compression level chosen
+	// by the server is not valid.
+	UpgradeBadCompressionLevel
+)
+
+// String returns the name of the outcome, which can be used as a metric label.
+func (o UpgradeOutcome) String() string {
+	switch o {
+	case UpgradeSuccess:
+		{
+			return "success"
+		}
+	case UpgradeRejectedOrigin:
+		{
+			return "rejected-origin"
+		}
+	case UpgradeBadVersion:
+		{
+			return "bad-version"
+		}
+	case UpgradeBadRequest:
+		{
+			return "bad-request"
+		}
+	case UpgradeBadSubProtocol:
+		{
+			return "bad-sub-protocol"
+		}
+	case UpgradeHijackFailure:
+		{
+			return "hijack-failure"
+		}
+	case UpgradeResponseFailure:
+		{
+			return "response-failure"
+		}
+	case UpgradeBadCompressionLevel:
+		{
+			return "bad-compression-level"
+		}
+	}
+	return "unknown"
+}
+
+// status returns the HTTP status code used to reject a handshake request with
+// the outcome provided.
+func (o UpgradeOutcome) status() int {
+	switch o {
+	case UpgradeRejectedOrigin:
+		{
+			return http.StatusForbidden
+		}
+	case UpgradeBadVersion:
+		{
+			return http.StatusUpgradeRequired
+		}
+	case UpgradeBadRequest:
+		{
+			return http.StatusBadRequest
+		}
+	}
+	return http.StatusInternalServerError
+}
+
 // Request represents the HTTP Request that will be upgraded to the WebSocket
 // protocol once it is validated.
 type Request struct {
@@ -33,93 +135,314 @@ type Request struct {
 		Sec-WebSocket-Protocol HTTP Response Header Field is not sent
 	*/
 	SubProtocol string
+
+	/*
+		SelectSubProtocol is invoked with the handshake request and the list of
+		sub protocols provided by the client, to choose the sub protocol the
+		server will use. When provided, the sub protocol it returns is stored
+		in SubProtocol, overriding its current value. An empty string means
+		that no sub protocol is agreed upon.
+	*/
+	SelectSubProtocol func(r *http.Request, offered []string) string
+
+	/*
+		EnableCompression agrees to use the permessage-deflate extension when
+		offered by the client, in which case the payload data of messages
+		sent using WriteMessage is compressed.
+	*/
+	EnableCompression bool
+
+	/*
+		ContextTakeover allows the endpoints to keep the compression context
+		between messages when the permessage-deflate extension is in use, so
+		that messages can refer to data sent in earlier ones. Unless the
+		client asks otherwise, both endpoints keep their context, which
+		improves the compression of similar messages at the cost of keeping a
+		compressor (a few hundred KB) and the last 32KB of decompressed data
+		in memory for the lifetime of each connection.
+
+		It is disabled by default, in which case the server and the client
+		are asked not to keep the compression context (i.e.
+		server_no_context_takeover and client_no_context_takeover) and every
+		message is compressed on its own, keeping the memory used by each
+		connection predictable.
+
+		Ref Spec: https://tools.ietf.org/html/rfc7692#section-7.1.1
+	*/
+	ContextTakeover bool
+
+	/*
+		CompressionLevel is the compress/flate compression level used to
+		compress messages when the permessage-deflate extension is in use,
+		ranging from flate.HuffmanOnly to flate.BestCompression. Higher levels
+		spend more CPU time to send less data, while lower levels (such as
+		flate.BestSpeed) trade bandwidth for CPU time. A zero value means
+		flate.DefaultCompression, which is a balance between the two.
+	*/
+	CompressionLevel int
+
+	/*
+		ReadBufferSize is the size (in bytes) of the buffer used to read from
+		the connection once it is upgraded. When it is greater than the size
+		of the buffer provided by the HTTP server (usually 4096 bytes), a
+		larger buffer is used, preserving any bytes already buffered. Larger
+		buffers reduce the number of reads done to receive large frames.
+	*/
+	ReadBufferSize int
+
+	/*
+		HandshakeTimeout is the maximum duration UpgradeConn waits for the
+		opening handshake to be received and answered. When zero,
+		DefaultHandshakeTimeout is used.
+	*/
+	HandshakeTimeout time.Duration
+
+	/*
+		OutcomeHandler is invoked with the outcome of every attempt to
+		upgrade a connection (using either Upgrade or UpgradeConn), so that
+		metrics can be collected. It is not invoked by Validate.
+	*/
+	OutcomeHandler func(UpgradeOutcome)
+
+	/*
+		ResumptionHeader is the name of the header field the client sends its
+		resumption token with. When empty, DefaultResumptionHeader is used.
+	*/
+	ResumptionHeader string
+
+	/*
+		ResponseHeader contains additional header fields (such as Set-Cookie)
+		to be included in the opening handshake response. The Upgrade,
+		Connection and Sec-WebSocket-Accept header fields required by the
+		opening handshake can't be overridden and are therefore ignored.
+	*/
+	ResponseHeader http.Header
 }
 
+// DefaultHandshakeTimeout is the maximum duration UpgradeConn waits for the
+// opening handshake when Request.HandshakeTimeout is not set.
+const DefaultHandshakeTimeout = time.Second * 10
+
 // Upgrade is used to upgrade the HTTP connection to use the WS protocol once
 // the client request is validated.
 func (q *Request) Upgrade(w http.ResponseWriter, r *http.Request) (*Socket, error) {
+	// Validate the handshake request, responding with the appropriate HTTP
+	// error if it is not valid.
+	if o, err := q.validate(r); err != nil {
+		q.callOutcomeHandler(o)
+
+		c := o.status()
+
+		// Inform the client of the websocket version supported.
+		// Ref spec: https://tools.ietf.org/html/rfc6455#section-4.4
+		if c == http.StatusUpgradeRequired {
+			w.Header().Set("Sec-WebSocket-Version", wsVersion)
+		}
+
+		http.Error(w, http.StatusText(c), c)
+		return nil, err
+	}
+
+	// At this point, the clients handshake request is valid and therefore the
+	// connection can be upgraded to use the ws protocol.
+	return q.upgrade(w)
+}
+
+// Validate runs the same validations Upgrade does on the handshake request
+// 'r' without writing a response or taking over the connection. This lets the
+// caller carry out additional checks (ex: authentication) before invoking
+// Upgrade, or reply with an HTTP error of its own.
+func (q *Request) Validate(r *http.Request) *OpenError {
+	_, err := q.validate(r)
+	return err
+}
+
+// validate validates the handshake request 'r'. When it is not valid, the
+// outcome describing why it should be rejected is returned with the error.
+func (q *Request) validate(r *http.Request) (UpgradeOutcome, *OpenError) {
 	// Store a reference to the HTTP Request.
 	q.request = r
 
 	// Check origin.
 	// Ref spec: https://tools.ietf.org/html/rfc6455#section-4.2.2
 	if err := q.handleOrigin(); err != nil {
-		http.Error(w, "Forbidden", http.StatusForbidden)
-		return nil, err
+		return UpgradeRejectedOrigin, err
 	}
 
 	// Check websocket version.
 	// Ref spec: https://tools.ietf.org/html/rfc6455#section-4.2.2
 	if err := validateWSVersionHeader(r); err != nil {
-		w.Header().Set("Sec-WebSocket-Version", wsVersion)
-		http.Error(w, "Upgrade Required", 426)
-		return nil, err
+		return UpgradeBadVersion, err
 	}
 
 	// Check handshake request.
 	// Ref spec: https://tools.ietf.org/html/rfc6455#section-4.2.2
 	if err := validateRequest(r); err != nil {
-		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return UpgradeBadRequest, err
+	}
+
+	// Choose the sub protocol to be used.
+	if q.SelectSubProtocol != nil {
+		q.SubProtocol = q.SelectSubProtocol(r, q.ClientSubProtocols())
+	}
+
+	// Check that the sub protocol the server has agreed to use (if any) is a
+	// valid HTTP token.
+	// Ref spec: https://tools.ietf.org/html/rfc6455#section-4.2.2
+	if q.SubProtocol != "" && !tokenValid(q.SubProtocol) {
+		return UpgradeBadSubProtocol, &OpenError{Reason: "invalid sub protocol: " + q.SubProtocol}
+	}
+
+	// Check the compression level the server will use.
+	if q.EnableCompression && !compressionLevelValid(q.CompressionLevel) {
+		return UpgradeBadCompressionLevel, &OpenError{Reason: "invalid compression level: " + strconv.Itoa(q.CompressionLevel)}
+	}
+
+	return UpgradeSuccess, nil
+}
+
+// UpgradeConn reads the clients opening handshake request from a connection
+// which has not been through an HTTP server (ex: a custom transport), and
+// upgrades it to use the WS protocol once it is validated. Since the request
+// is parsed from the connection directly, reading it and sending the response
+// must complete within HandshakeTimeout, so that slow or incomplete requests
+// don't hold on to the connection forever.
+//
+// On failure an HTTP error response is sent (if possible) and the connection
+// is closed.
+func (q *Request) UpgradeConn(conn net.Conn) (*Socket, error) {
+	t := q.HandshakeTimeout
+
+	if t <= 0 {
+		t = DefaultHandshakeTimeout
+	}
+
+	conn.SetDeadline(time.Now().Add(t))
+
+	buf := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+
+	r, err := http.ReadRequest(buf.Reader)
+
+	if err != nil {
+		q.callOutcomeHandler(UpgradeBadRequest)
+		conn.Close()
+		return nil, &OpenError{Reason: "failed to read handshake request: " + err.Error()}
+	}
+
+	if o, err := q.validate(r); err != nil {
+		q.callOutcomeHandler(o)
+
+		c := o.status()
+		resp := "HTTP/1.1 " + strconv.Itoa(c) + " " + http.StatusText(c) + "\r\n"
+
+		// Inform the client of the websocket version supported.
+		// Ref spec: https://tools.ietf.org/html/rfc6455#section-4.4
+		if c == http.StatusUpgradeRequired {
+			resp += "Sec-WebSocket-Version: " + wsVersion + "\r\n"
+		}
+
+		resp += "Connection: close\r\n\r\n"
+
+		buf.WriteString(resp)
+		buf.Flush()
+		conn.Close()
+
 		return nil, err
 	}
 
-	// At this point, the clients handshake request is valid and therefore the
-	// connection can be upgraded to use the ws protocol.
-	s, err := q.upgrade(w)
+	s, err := q.accept(conn, buf)
 
 	if err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return nil, err
 	}
 
+	// Remove the deadline used for the opening handshake.
+	conn.SetDeadline(time.Time{})
+
 	return s, nil
 }
 
+// upgrade takes control of the underlying connection and sends the servers
+// opening handshake response. Note that once the connection is taken over, no
+// HTTP error responses can be sent on failure.
 func (q *Request) upgrade(w http.ResponseWriter) (*Socket, error) {
 	// Take control of the net.Conn instance.
 	h, k := w.(http.Hijacker)
 
 	if !k {
+		q.callOutcomeHandler(UpgradeHijackFailure)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return nil, &OpenError{Reason: "assertion failed with current http.ResponseWriter instance"}
 	}
 
 	conn, buf, err := h.Hijack()
 	if err != nil {
+		q.callOutcomeHandler(UpgradeHijackFailure)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return nil, err
 	}
 
-	// Build the HTTP Header response code required for the ws opening
-	// handshake.
-	// From RFC2616: https://www.w3.org/Protocols/rfc2616/rfc2616-sec6.html
-	resp := "HTTP/1.1 101 Switching Protocols\n"
-	resp += "Upgrade: websocket\n"
-	resp += "Connection: upgrade\n"
-	resp += "Sec-WebSocket-Version: " + wsVersion + "\n"
+	return q.accept(conn, buf)
+}
+
+// accept sends the servers opening handshake response over the connection
+// provided and returns the socket instance representing it.
+func (q *Request) accept(conn net.Conn, buf *bufio.ReadWriter) (*Socket, error) {
+	// Use a larger read buffer if requested.
+	if q.ReadBufferSize > buf.Reader.Size() {
+		buf.Reader = resizeReader(buf.Reader, conn, q.ReadBufferSize)
+	}
 
 	// If server has agreed to use a sub-protocol, the chosen sub-protocol needs
 	// to be an option provided by the clients endpoint. If not, the
-	// Sec-WebSocket-Protocol HTTP Header field is not sent.
+	// Sec-WebSocket-Protocol HTTP Header field is not sent and no sub-protocol
+	// is agreed upon.
+	p := ""
+
 	if q.SubProtocol != "" && stringExists(q.ClientSubProtocols(), q.SubProtocol) != -1 {
-		resp += "Sec-WebSocket-Protocol: " + q.SubProtocol + "\n"
+		p = q.SubProtocol
 	}
 
-	// Generate the accept key based on the challenge key provided by the
-	// client and include it inside 'Sec-WebSocket-Accept' response header
-	// field.
-	acceptKey := makeAcceptKey(q.request.Header.Get("Sec-WebSocket-Key"))
-	resp += "Sec-WebSocket-Accept: " + acceptKey + "\n\n"
+	// Agree to use the permessage-deflate extension if offered.
+	var e []string
+	var z *deflateOptions
+
+	if q.EnableCompression {
+		z = acceptDeflate(q.ClientExtensions(), q.ContextTakeover)
+	}
+
+	if z != nil {
+		e = []string{z.response()}
+	}
+
+	// Send response. If it fails (ex: the client has already gone away) the
+	// connection is closed instead of returning a socket over a dead
+	// connection.
+	buf.Write(handshakeResponse(q.request, p, e, q.ResponseHeader))
+	if err := buf.Flush(); err != nil {
+		q.callOutcomeHandler(UpgradeResponseFailure)
+		conn.Close()
+		return nil, &OpenError{Reason: "failed to send handshake response: " + err.Error()}
+	}
 
-	// Send response
-	buf.WriteString(resp)
-	buf.Flush()
+	q.callOutcomeHandler(UpgradeSuccess)
 
 	// Create and return socket.
-	return &Socket{
-		conn:       conn,
-		buf:        buf,
-		server:     true,
-		writeMutex: &sync.Mutex{},
-	}, nil
+	s := newSocket(conn, buf, true)
+	s.subprotocol = p
+	s.setCompression(z)
+	s.compressionLevel = q.CompressionLevel
+	s.header = q.request.Header.Clone()
+
+	return s, nil
+}
+
+// callOutcomeHandler invokes the outcome handler (if any) with the outcome
+// provided.
+func (q *Request) callOutcomeHandler(o UpgradeOutcome) {
+	if q.OutcomeHandler != nil {
+		q.OutcomeHandler(o)
+	}
 }
 
 // handleOrigin is used to invoke either the CheckOrigin method provided by the
@@ -132,7 +455,12 @@ func (q *Request) handleOrigin() *OpenError {
 	}
 
 	if !fn(q.request) {
-		return &OpenError{Reason: `failure due to origin.`}
+		o := q.request.Header.Get("Origin")
+
+		return &OpenError{
+			Reason: fmt.Sprintf("failure due to origin %q.", o),
+			Origin: o,
+		}
 	}
 
 	return nil
@@ -153,3 +481,106 @@ func (q *Request) ClientSubProtocols() []string {
 func (q *Request) ClientExtensions() []string {
 	return headerToSlice(q.request.Header.Get("Sec-WebSocket-Extensions"))
 }
+
+// ClientVersions returns the list of websocket versions offered by the client
+// (through the Sec-WebSocket-Version HTTP Header Field).
+//
+// From spec: https://tools.ietf.org/html/rfc6455#section-4.4
+func (q *Request) ClientVersions() []string {
+	var l []string
+
+	for _, v := range q.request.Header["Sec-Websocket-Version"] {
+		l = append(l, headerToSlice(v)...)
+	}
+
+	return l
+}
+
+// ResumptionToken returns the opaque resumption token sent by the client with
+// the opening handshake request (see Dialer.ResumptionToken), or an empty
+// string if none was sent. It can be used by applications to resume a previous
+// session once the request has been validated.
+func (q *Request) ResumptionToken() string {
+	return q.request.Header.Get(resumptionHeader(q.ResumptionHeader))
+}
+
+// HandshakeResponse returns the raw bytes of the server response to the
+// websocket opening handshake request 'r', exactly as written by Upgrade when
+// no ResponseHeader is set. The sub protocol ('p') and extensions ('e') agreed
+// upon are included in the response unless empty. Note that 'r' is not
+// validated, use Validate for that.
+//
+// Ref Spec: https://tools.ietf.org/html/rfc6455#section-4.2.2
+func HandshakeResponse(r *http.Request, p string, e []string) []byte {
+	return handshakeResponse(r, p, e, nil)
+}
+
+// handshakeResponse returns the raw bytes of the server response to the
+// websocket opening handshake request 'r', including the additional header
+// fields provided ('h'). Header fields required by the opening handshake which
+// can't be overridden (i.e. Upgrade, Connection and Sec-WebSocket-Accept) are
+// left out from 'h'.
+func handshakeResponse(r *http.Request, p string, e []string, h http.Header) []byte {
+	b := &bytes.Buffer{}
+
+	// Build the HTTP Header response code required for the ws opening
+	// handshake. Header values are sent using their conventional casing since
+	// some strict intermediaries expect it.
+	// From RFC2616: https://www.w3.org/Protocols/rfc2616/rfc2616-sec6.html
+	b.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	writeHeaderField(b, "Upgrade", "websocket")
+	writeHeaderField(b, "Connection", "Upgrade")
+	writeHeaderField(b, "Sec-WebSocket-Version", wsVersion)
+
+	if p != "" {
+		writeHeaderField(b, "Sec-WebSocket-Protocol", p)
+	}
+
+	if len(e) > 0 {
+		writeHeaderField(b, "Sec-WebSocket-Extensions", strings.Join(e, ", "))
+	}
+
+	// Generate the accept key based on the challenge key provided by the
+	// client and include it inside 'Sec-WebSocket-Accept' response header
+	// field.
+	writeHeaderField(b, "Sec-WebSocket-Accept", makeAcceptKey(r.Header.Get("Sec-WebSocket-Key")))
+
+	// Include the additional header fields.
+	if len(h) > 0 {
+		c := http.Header{}
+
+		for k, v := range h {
+			if !reservedResponseHeader(k) {
+				c[k] = v
+			}
+		}
+
+		c.Write(b)
+	}
+
+	// The header fields are terminated by an empty line.
+	b.WriteString("\r\n")
+
+	return b.Bytes()
+}
+
+// writeHeaderField writes a header field with the name ('k') and value ('v')
+// provided to 'b', formatted as 'Key: Value' and terminated by CRLF.
+func writeHeaderField(b *bytes.Buffer, k string, v string) {
+	b.WriteString(k)
+	b.WriteString(": ")
+	b.WriteString(v)
+	b.WriteString("\r\n")
+}
+
+// reservedResponseHeader returns whether the header field name provided ('k')
+// is one of the header fields of the opening handshake response which can't
+// be overridden.
+func reservedResponseHeader(k string) bool {
+	for _, v := range []string{"Upgrade", "Connection", "Sec-WebSocket-Accept"} {
+		if strings.EqualFold(k, v) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,10 +1,14 @@
 package websocket
 
 import (
+	"bufio"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
+	"time"
 )
 
 func makeRequestValid(r *http.Request) {
@@ -50,6 +54,39 @@ func TestUpgradeResponseWhenInvalidOrigin(t *testing.T) {
 	}
 }
 
+func TestUpgradeErrorWhenInvalidOrigin(t *testing.T) {
+	r, err := http.NewRequest("GET", "example.com", nil)
+
+	if err != nil {
+		t.Fatal("error occured while creating request:", err)
+	}
+
+	makeRequestValid(r)
+	r.Header.Set("Origin", "http://evil.example.com")
+
+	q := &Request{
+		CheckOrigin: func(r *http.Request) bool {
+			return false
+		},
+	}
+
+	_, err = q.Upgrade(httptest.NewRecorder(), r)
+
+	e, k := err.(*OpenError)
+
+	if !k {
+		t.Fatalf("expected error instance to be of type *OpenError, but got '%v'", err)
+	}
+
+	if e.Origin != "http://evil.example.com" {
+		t.Errorf(`expected origin to be "http://evil.example.com", but it is "%s"`, e.Origin)
+	}
+
+	if !strings.Contains(e.Error(), "http://evil.example.com") {
+		t.Errorf(`expected error message to contain the rejected origin, but it is "%s"`, e.Error())
+	}
+}
+
 func TestUpgradeResponseWhenInvalidWSVersion(t *testing.T) {
 	r, err := http.NewRequest("GET", "example.com", nil)
 
@@ -165,8 +202,8 @@ func TestUpgradeGoodRequest(t *testing.T) {
 		t.Errorf(`expected "Upgrade" HTTP Header value to be "websocket" but it is "%s"`, w.Header.Get("Upgrade"))
 	}
 
-	if w.Header.Get("Connection") != "upgrade" {
-		t.Errorf(`expected "Connection" HTTP Header value to be "upgrade" but it is "%s"`, w.Header.Get("Connection"))
+	if w.Header.Get("Connection") != "Upgrade" {
+		t.Errorf(`expected "Connection" HTTP Header value to be "Upgrade" but it is "%s"`, w.Header.Get("Connection"))
 	}
 
 	if w.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
@@ -306,3 +343,985 @@ func TestClientExtensions(t *testing.T) {
 		}
 	}
 }
+
+func TestClientVersions(t *testing.T) {
+	r := &http.Request{}
+
+	r.Header = make(http.Header)
+	r.Header.Add("Sec-WebSocket-Version", "13, 8")
+	r.Header.Add("Sec-WebSocket-Version", "7")
+
+	q := &Request{
+		request: r,
+	}
+
+	l := []string{"13", "8", "7"}
+	p := q.ClientVersions()
+
+	if len(l) != len(p) {
+		t.Fatalf("The length of the list of versions is not the same. '%d' != '%d'", len(l), len(p))
+	}
+
+	for i, v := range l {
+		if p[i] != v {
+			t.Errorf(`expected version %d to be "%s", but it is "%s"`, i, v, p[i])
+		}
+	}
+}
+
+func TestUpgradeResponseHeaderCasing(t *testing.T) {
+	h := func(w http.ResponseWriter, r *http.Request) {
+		q := &Request{}
+		if _, err := q.Upgrade(w, r); err != nil {
+			t.Error("unexpected error from Upgrade():", err)
+		}
+	}
+
+	s := httptest.NewServer(http.HandlerFunc(h))
+	defer s.Close()
+
+	l, err := url.Parse(adaptURL(s.URL))
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	conn, err := net.Dial("tcp", l.Host)
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	defer conn.Close()
+
+	d := &Dialer{}
+	q, err := d.createRequest(l)
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	if err := q.Write(conn); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	b := bufio.NewReader(conn)
+
+	// Read raw header lines of the handshake response.
+	var lines []string
+
+	for {
+		v, err := b.ReadString('\n')
+
+		if err != nil {
+			t.Fatal("unexpected error returned", err)
+		}
+
+		v = strings.TrimRight(v, "\r\n")
+
+		if v == "" {
+			break
+		}
+
+		lines = append(lines, v)
+	}
+
+	for _, e := range []string{"Upgrade: websocket", "Connection: Upgrade"} {
+		if stringExists(lines, e) == -1 {
+			t.Errorf(`expected handshake response to contain "%s" but it is "%v"`, e, lines)
+		}
+	}
+}
+
+func TestUpgradeResponseRoundTrip(t *testing.T) {
+	h := func(w http.ResponseWriter, r *http.Request) {
+		q := &Request{}
+		if _, err := q.Upgrade(w, r); err != nil {
+			t.Error("unexpected error from Upgrade():", err)
+		}
+	}
+
+	s := httptest.NewServer(http.HandlerFunc(h))
+	defer s.Close()
+
+	l, err := url.Parse(adaptURL(s.URL))
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	conn, err := net.Dial("tcp", l.Host)
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	defer conn.Close()
+
+	d := &Dialer{}
+	q, err := d.createRequest(l)
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	if err := q.Write(conn); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	w, err := http.ReadResponse(bufio.NewReader(conn), q)
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	// Our own client must still accept the response.
+	if err := validateResponse(w); err != nil {
+		t.Error("unexpected error returned", err)
+	}
+}
+
+func TestUpgradeInvalidSubProtocol(t *testing.T) {
+	r, err := http.NewRequest("GET", "example.com", nil)
+
+	if err != nil {
+		t.Fatal("error occured while creating request:", err)
+	}
+
+	makeRequestValid(r)
+	r.Header.Set("Sec-WebSocket-Protocol", "chat")
+
+	w := httptest.NewRecorder()
+
+	q := &Request{
+		CheckOrigin: func(r *http.Request) bool {
+			return true
+		},
+		SubProtocol: "chat, v1",
+	}
+
+	s, err := q.Upgrade(w, r)
+
+	if err == nil {
+		t.Error("expected Upgrade() to return a OpenError")
+	}
+
+	if s != nil {
+		t.Error("expected Upgrade() to return a nil Socket instance")
+	}
+
+	if w.Code != 500 {
+		t.Errorf(`expected HTTP Status '500'. '%d' was returned.`, w.Code)
+	}
+}
+
+// hijackerMock is an http.ResponseWriter which hijacks to the connection
+// provided.
+type hijackerMock struct {
+	*httptest.ResponseRecorder
+	conn net.Conn
+}
+
+func (h *hijackerMock) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return h.conn, bufio.NewReadWriter(bufio.NewReader(h.conn), bufio.NewWriter(h.conn)), nil
+}
+
+func TestUpgradeResponseWriteError(t *testing.T) {
+	r, err := http.NewRequest("GET", "example.com", nil)
+
+	if err != nil {
+		t.Fatal("error occured while creating request:", err)
+	}
+
+	makeRequestValid(r)
+
+	// Client disconnects before the handshake response is written.
+	c, p := net.Pipe()
+	p.Close()
+
+	w := &hijackerMock{
+		ResponseRecorder: httptest.NewRecorder(),
+		conn:             c,
+	}
+
+	q := &Request{
+		CheckOrigin: func(r *http.Request) bool {
+			return true
+		},
+	}
+
+	s, err := q.Upgrade(w, r)
+
+	if _, k := err.(*OpenError); !k {
+		t.Errorf("expected Upgrade() to return an OpenError but got '%v'", err)
+	}
+
+	if s != nil {
+		t.Error("expected Upgrade() to return a nil Socket instance")
+	}
+
+	// No HTTP response should be written once the connection is hijacked.
+	if w.Body.Len() != 0 {
+		t.Errorf(`expected no HTTP response to be written but got "%s"`, w.Body.String())
+	}
+}
+
+// countingConn is a net.Conn which counts the number of reads done.
+type countingConn struct {
+	net.Conn
+	reads int
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	c.reads++
+	return c.Conn.Read(p)
+}
+
+func TestUpgradeReadBufferSize(t *testing.T) {
+	r, err := http.NewRequest("GET", "example.com", nil)
+
+	if err != nil {
+		t.Fatal("error occured while creating request:", err)
+	}
+
+	makeRequestValid(r)
+
+	c, p := net.Pipe()
+	defer c.Close()
+	defer p.Close()
+
+	n := &countingConn{Conn: c}
+
+	w := &hijackerMock{
+		ResponseRecorder: httptest.NewRecorder(),
+		conn:             n,
+	}
+
+	f := &frame{
+		fin:     true,
+		opcode:  OpcodeBinary,
+		key:     []byte{1, 1, 1, 1},
+		payload: make([]byte, 60000),
+	}
+
+	b, err := f.toBytes()
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	// Client endpoint which reads the handshake response and sends a single
+	// large frame.
+	go func() {
+		if _, err := http.ReadResponse(bufio.NewReader(p), r); err != nil {
+			t.Error("unexpected error returned", err)
+			return
+		}
+
+		p.Write(b)
+	}()
+
+	q := &Request{
+		CheckOrigin: func(r *http.Request) bool {
+			return true
+		},
+		ReadBufferSize: 65536,
+	}
+
+	s, err := q.Upgrade(w, r)
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	n.reads = 0
+
+	f, err = newFrame(s.buf.Reader)
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	if len(f.payload) != 60000 {
+		t.Errorf("expected payload data to be '60000' bytes long, but it is '%d'", len(f.payload))
+	}
+
+	if n.reads != 1 {
+		t.Errorf("expected frame to be received in '1' read, but it took '%d'", n.reads)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	r, err := http.NewRequest("GET", "example.com", nil)
+
+	if err != nil {
+		t.Fatal("error occured while creating request:", err)
+	}
+
+	q := &Request{
+		CheckOrigin: func(r *http.Request) bool {
+			return true
+		},
+	}
+
+	makeRequestValid(r)
+
+	if err := q.Validate(r); err != nil {
+		t.Error("unexpected error returned", err)
+	}
+
+	r.Header.Set("Sec-WebSocket-Version", "14")
+
+	if err := q.Validate(r); err == nil {
+		t.Error("expected Validate() to return a OpenError")
+	}
+}
+
+func TestValidateDoesNotWriteResponse(t *testing.T) {
+	h := func(w http.ResponseWriter, r *http.Request) {
+		q := &Request{
+			CheckOrigin: func(r *http.Request) bool {
+				return true
+			},
+		}
+
+		makeRequestValid(r)
+		r.Header.Set("Sec-WebSocket-Version", "14")
+
+		if err := q.Validate(r); err == nil {
+			t.Error("expected Validate() to return a OpenError")
+		}
+
+		// The caller is still in control of the response.
+		w.WriteHeader(http.StatusTeapot)
+	}
+
+	s := httptest.NewServer(http.HandlerFunc(h))
+	defer s.Close()
+
+	w, err := http.Get(s.URL)
+
+	if err != nil {
+		t.Fatal("unexpected error when requesting the test server:", err)
+	}
+
+	if w.StatusCode != http.StatusTeapot {
+		t.Errorf("expected HTTP Status to be '%d' but it is '%d'", http.StatusTeapot, w.StatusCode)
+	}
+
+	if v := w.Header.Get("Sec-WebSocket-Version"); v != "" {
+		t.Errorf(`expected no "Sec-WebSocket-Version" HTTP Header but it is "%s"`, v)
+	}
+}
+
+func TestUpgradeSubProtocolAgreed(t *testing.T) {
+	type testCase struct {
+		s string
+		p string
+		v string
+	}
+
+	testCases := []testCase{
+		// Client offers sub protocols but the server supports none.
+		{s: "", p: "one, two", v: ""},
+		// Server chose a sub protocol the client didn't offer.
+		{s: "three", p: "one, two", v: ""},
+		// Server chose a sub protocol the client offered.
+		{s: "two", p: "one, two", v: "two"},
+	}
+
+	for i, c := range testCases {
+		r, err := http.NewRequest("GET", "example.com", nil)
+
+		if err != nil {
+			t.Fatal("error occured while creating request:", err)
+		}
+
+		makeRequestValid(r)
+		r.Header.Set("Sec-WebSocket-Protocol", c.p)
+
+		conn, p := net.Pipe()
+
+		w := &hijackerMock{
+			ResponseRecorder: httptest.NewRecorder(),
+			conn:             conn,
+		}
+
+		h := make(chan string, 1)
+
+		go func() {
+			g, err := http.ReadResponse(bufio.NewReader(p), r)
+
+			if err != nil {
+				t.Error("unexpected error returned", err)
+				h <- ""
+				return
+			}
+
+			h <- g.Header.Get("Sec-WebSocket-Protocol")
+		}()
+
+		q := &Request{
+			CheckOrigin: func(r *http.Request) bool {
+				return true
+			},
+			SubProtocol: c.s,
+		}
+
+		s, err := q.Upgrade(w, r)
+
+		if err != nil {
+			t.Fatalf("test case %d: unexpected error returned %v", i, err)
+		}
+
+		if s.subprotocol != c.v {
+			t.Errorf(`test case %d: expected sub protocol to be "%s", but it is "%s"`, i, c.v, s.subprotocol)
+		}
+
+		if v := <-h; v != c.v {
+			t.Errorf(`test case %d: expected "Sec-WebSocket-Protocol" HTTP Header value to be "%s", but it is "%s"`, i, c.v, v)
+		}
+
+		conn.Close()
+		p.Close()
+	}
+}
+
+func TestUpgradeSelectSubProtocol(t *testing.T) {
+	r, err := http.NewRequest("GET", "example.com", nil)
+
+	if err != nil {
+		t.Fatal("error occured while creating request:", err)
+	}
+
+	makeRequestValid(r)
+	r.Header.Set("Sec-WebSocket-Protocol", "one, two")
+
+	conn, p := net.Pipe()
+	defer conn.Close()
+	defer p.Close()
+
+	w := &hijackerMock{
+		ResponseRecorder: httptest.NewRecorder(),
+		conn:             conn,
+	}
+
+	h := make(chan string, 1)
+
+	go func() {
+		g, err := http.ReadResponse(bufio.NewReader(p), r)
+
+		if err != nil {
+			t.Error("unexpected error returned", err)
+			h <- ""
+			return
+		}
+
+		h <- g.Header.Get("Sec-WebSocket-Protocol")
+	}()
+
+	q := &Request{
+		CheckOrigin: func(r *http.Request) bool {
+			return true
+		},
+		SelectSubProtocol: func(r *http.Request, l []string) string {
+			return l[len(l)-1]
+		},
+	}
+
+	s, err := q.Upgrade(w, r)
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	if v := s.Subprotocol(); v != "two" {
+		t.Errorf(`expected sub protocol to be "two", but it is "%s"`, v)
+	}
+
+	if v := <-h; v != "two" {
+		t.Errorf(`expected "Sec-WebSocket-Protocol" HTTP Header value to be "two", but it is "%s"`, v)
+	}
+}
+
+func TestUpgradeConn(t *testing.T) {
+	c, p := net.Pipe()
+	defer c.Close()
+	defer p.Close()
+
+	r, err := http.NewRequest("GET", "http://example.com/", nil)
+
+	if err != nil {
+		t.Fatal("error occured while creating request:", err)
+	}
+
+	makeRequestValid(r)
+
+	w := make(chan *http.Response, 1)
+
+	// Client endpoint which sends the handshake request.
+	go func() {
+		r.Write(p)
+
+		g, err := http.ReadResponse(bufio.NewReader(p), r)
+
+		if err != nil {
+			t.Error("unexpected error returned", err)
+		}
+
+		w <- g
+	}()
+
+	q := &Request{
+		CheckOrigin: func(r *http.Request) bool {
+			return true
+		},
+	}
+
+	s, err := q.UpgradeConn(c)
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	if !s.server {
+		t.Error("expected socket to have 'server' property set to 'true'")
+	}
+
+	if g := <-w; g == nil || g.StatusCode != 101 {
+		t.Error("expected HTTP Status to be '101'")
+	}
+}
+
+func TestUpgradeConnTimeout(t *testing.T) {
+	c, p := net.Pipe()
+	defer p.Close()
+
+	// Client endpoint which sends an incomplete handshake request.
+	go func() {
+		p.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n"))
+	}()
+
+	q := &Request{
+		HandshakeTimeout: time.Millisecond * 50,
+	}
+
+	n := time.Now()
+
+	s, err := q.UpgradeConn(c)
+
+	if _, k := err.(*OpenError); !k {
+		t.Errorf("expected UpgradeConn() to return an OpenError but got '%v'", err)
+	}
+
+	if s != nil {
+		t.Error("expected UpgradeConn() to return a nil Socket instance")
+	}
+
+	if d := time.Since(n); d > time.Second {
+		t.Errorf("expected UpgradeConn() to time out, but it took '%v'", d)
+	}
+}
+
+func TestUpgradeOutcomeHandler(t *testing.T) {
+	type testCase struct {
+		o bool
+		v UpgradeOutcome
+	}
+
+	testCases := []testCase{
+		{o: false, v: UpgradeRejectedOrigin},
+		{o: true, v: UpgradeSuccess},
+	}
+
+	for i, c := range testCases {
+		// Outcomes are reported from the goroutine handling the request.
+		l := make(chan UpgradeOutcome, 2)
+
+		h := func(w http.ResponseWriter, r *http.Request) {
+			q := &Request{
+				CheckOrigin: func(r *http.Request) bool {
+					return c.o
+				},
+				OutcomeHandler: func(o UpgradeOutcome) {
+					l <- o
+				},
+			}
+
+			makeRequestValid(r)
+
+			// Close the hijacked connection.
+			if k, err := q.Upgrade(w, r); err == nil {
+				k.TCPClose()
+			}
+		}
+
+		s := httptest.NewServer(http.HandlerFunc(h))
+
+		if _, err := http.Get(s.URL); err != nil {
+			t.Errorf("test case %d: unexpected error when requesting the test server: %v", i, err)
+		}
+
+		select {
+		case o := <-l:
+			{
+				if o != c.v {
+					t.Errorf(`test case %d: expected outcome to be "%s", but it is "%s"`, i, c.v, o)
+				}
+			}
+		case <-time.After(time.Second * 2):
+			{
+				t.Errorf("test case %d: timed out waiting for the outcome", i)
+			}
+		}
+
+		s.Close()
+
+		select {
+		case o := <-l:
+			{
+				t.Errorf(`test case %d: expected outcome handler to be invoked once, but it was also invoked with "%s"`, i, o)
+			}
+		default:
+		}
+	}
+}
+
+func TestResumptionToken(t *testing.T) {
+	type testCase struct {
+		h string
+	}
+
+	testCases := []testCase{
+		{h: ""},
+		{h: "Session-Token"},
+	}
+
+	for i, c := range testCases {
+		d := &Dialer{
+			ResumptionToken:  "opaque token",
+			ResumptionHeader: c.h,
+		}
+
+		r, err := d.Request("ws://localhost:8080")
+
+		if err != nil {
+			t.Fatal("unexpected error returned", err)
+		}
+
+		q := &Request{
+			request:          r,
+			ResumptionHeader: c.h,
+		}
+
+		if v := q.ResumptionToken(); v != "opaque token" {
+			t.Errorf(`test case %d: expected resumption token to be "opaque token", but it is "%s"`, i, v)
+		}
+	}
+}
+
+func TestResumptionTokenDialerReused(t *testing.T) {
+	r := make(chan string, 2)
+
+	h := func(w http.ResponseWriter, q *http.Request) {
+		u := Request{EnableCompression: true}
+		s, err := u.Upgrade(w, q)
+
+		if err != nil {
+			t.Error("unexpected error returned", err)
+			return
+		}
+
+		r <- u.ResumptionToken()
+		s.TCPClose()
+	}
+
+	l := httptest.NewServer(http.HandlerFunc(h))
+	defer l.Close()
+
+	d := &Dialer{
+		ResumptionToken:   "secret",
+		EnableCompression: true,
+	}
+
+	c, _, err := d.Dial(adaptURL(l.URL))
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	c.TCPClose()
+
+	if v := <-r; v != "secret" {
+		t.Errorf(`expected resumption token to be "secret", but it is "%s"`, v)
+	}
+
+	// Neither the resumption token nor the extension offer must be sent once
+	// they are removed from the dialer.
+	d.ResumptionToken = ""
+	d.EnableCompression = false
+
+	c, _, err = d.Dial(adaptURL(l.URL))
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	c.TCPClose()
+
+	if v := <-r; v != "" {
+		t.Errorf(`expected no resumption token to be sent, but got "%s"`, v)
+	}
+}
+
+func TestUpgradeSocketHeader(t *testing.T) {
+	r, err := http.NewRequest("GET", "example.com", nil)
+
+	if err != nil {
+		t.Fatal("error occured while creating request:", err)
+	}
+
+	makeRequestValid(r)
+	r.Header.Set("Authorization", "Bearer token")
+
+	c, p := net.Pipe()
+	defer c.Close()
+	defer p.Close()
+
+	w := &hijackerMock{
+		ResponseRecorder: httptest.NewRecorder(),
+		conn:             c,
+	}
+
+	go http.ReadResponse(bufio.NewReader(p), r)
+
+	q := &Request{
+		CheckOrigin: func(r *http.Request) bool {
+			return true
+		},
+	}
+
+	s, err := q.Upgrade(w, r)
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	// Changes to the original request don't affect the socket instance.
+	r.Header.Set("Authorization", "changed")
+
+	if v := s.Header().Get("Authorization"); v != "Bearer token" {
+		t.Errorf(`expected "Authorization" HTTP Header value to be "Bearer token", but it is "%s"`, v)
+	}
+}
+
+func TestHandshakeResponse(t *testing.T) {
+	r, err := http.NewRequest("GET", "example.com", nil)
+
+	if err != nil {
+		t.Fatal("error occured while creating request:", err)
+	}
+
+	// Sample challenge key provided by the RFC.
+	// Ref Spec: https://tools.ietf.org/html/rfc6455#section-1.3
+	r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+
+	type testCase struct {
+		p string
+		e []string
+		v []string
+	}
+
+	testCases := []testCase{
+		{
+			v: []string{
+				"HTTP/1.1 101 Switching Protocols",
+				"Upgrade: websocket",
+				"Connection: Upgrade",
+				"Sec-WebSocket-Version: 13",
+				"Sec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=",
+			},
+		},
+		{
+			p: "chat",
+			e: []string{"first", "second"},
+			v: []string{
+				"HTTP/1.1 101 Switching Protocols",
+				"Upgrade: websocket",
+				"Connection: Upgrade",
+				"Sec-WebSocket-Version: 13",
+				"Sec-WebSocket-Protocol: chat",
+				"Sec-WebSocket-Extensions: first, second",
+				"Sec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=",
+			},
+		},
+	}
+
+	for i, c := range testCases {
+		e := strings.Join(c.v, "\r\n") + "\r\n\r\n"
+
+		if b := HandshakeResponse(r, c.p, c.e); string(b) != e {
+			t.Errorf("test case %d: expected response to be %q, but it is %q", i, e, b)
+		}
+	}
+}
+
+func TestUpgradeResponseHeader(t *testing.T) {
+	r, err := http.NewRequest("GET", "example.com", nil)
+
+	if err != nil {
+		t.Fatal("error occured while creating request:", err)
+	}
+
+	makeRequestValid(r)
+
+	c, p := net.Pipe()
+	defer c.Close()
+	defer p.Close()
+
+	w := &hijackerMock{
+		ResponseRecorder: httptest.NewRecorder(),
+		conn:             c,
+	}
+
+	v := make(chan *http.Response, 1)
+
+	go func() {
+		s, _ := http.ReadResponse(bufio.NewReader(p), r)
+		v <- s
+	}()
+
+	q := &Request{
+		CheckOrigin: func(r *http.Request) bool {
+			return true
+		},
+		ResponseHeader: http.Header{
+			"Set-Cookie":           {"session=1", "theme=dark"},
+			"X-Custom":             {"value"},
+			"upgrade":              {"h2c"},
+			"Connection":           {"close"},
+			"Sec-Websocket-Accept": {"invalid"},
+		},
+	}
+
+	if _, err := q.Upgrade(w, r); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	var s *http.Response
+
+	select {
+	case s = <-v:
+		{
+
+		}
+	case <-time.After(time.Second * 2):
+		{
+			t.Fatal("timed out")
+		}
+	}
+
+	if s == nil {
+		t.Fatal("expected handshake response to be valid")
+	}
+
+	type testCase struct {
+		k string
+		v []string
+	}
+
+	testCases := []testCase{
+		// Additional header fields are included.
+		{k: "Set-Cookie", v: []string{"session=1", "theme=dark"}},
+		{k: "X-Custom", v: []string{"value"}},
+		// Header fields required by the opening handshake can't be
+		// overridden.
+		{k: "Upgrade", v: []string{"websocket"}},
+		{k: "Connection", v: []string{"Upgrade"}},
+		{k: "Sec-Websocket-Accept", v: []string{makeAcceptKey(r.Header.Get("Sec-WebSocket-Key"))}},
+	}
+
+	for i, c := range testCases {
+		if l := s.Header.Values(c.k); strings.Join(l, ",") != strings.Join(c.v, ",") {
+			t.Errorf(`test case %d: expected "%s" HTTP Header values to be %q, but they are %q`, i, c.k, c.v, l)
+		}
+	}
+}
+
+func TestUpgradeResponseCRLF(t *testing.T) {
+	r, err := http.NewRequest("GET", "example.com", nil)
+
+	if err != nil {
+		t.Fatal("error occured while creating request:", err)
+	}
+
+	makeRequestValid(r)
+
+	c, p := net.Pipe()
+	defer c.Close()
+	defer p.Close()
+
+	w := &hijackerMock{
+		ResponseRecorder: httptest.NewRecorder(),
+		conn:             c,
+	}
+
+	// Raw lines written to the hijacked connection, up to the blank line
+	// terminating the handshake response.
+	v := make(chan []string, 1)
+
+	go func() {
+		var l []string
+
+		b := bufio.NewReader(p)
+
+		for {
+			s, err := b.ReadString('\n')
+
+			if err != nil {
+				break
+			}
+
+			l = append(l, s)
+
+			if s == "\r\n" || s == "\n" {
+				break
+			}
+		}
+
+		v <- l
+	}()
+
+	q := &Request{
+		CheckOrigin: func(r *http.Request) bool {
+			return true
+		},
+	}
+
+	if _, err := q.Upgrade(w, r); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	var l []string
+
+	select {
+	case l = <-v:
+		{
+
+		}
+	case <-time.After(time.Second * 2):
+		{
+			t.Fatal("timed out")
+		}
+	}
+
+	if len(l) < 2 || l[len(l)-1] != "\r\n" {
+		t.Fatalf("expected handshake response to be terminated by a blank CRLF line, but it is %q", l)
+	}
+
+	for _, s := range l {
+		if !strings.HasSuffix(s, "\r\n") || strings.Count(s, "\n") != 1 || strings.Count(s, "\r") != 1 {
+			t.Errorf("expected line %q to be terminated by CRLF", s)
+		}
+	}
+}
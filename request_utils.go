@@ -3,6 +3,7 @@ package websocket
 import (
 	"encoding/base64"
 	"net/http"
+	"net/url"
 	"strings"
 )
 
@@ -141,3 +142,44 @@ func checkOrigin(r *http.Request) bool {
 
 	return h == "" || h == r.Host
 }
+
+// AllowedOrigins returns a function, to be used as Request.CheckOrigin, which
+// allows requests coming from one of the origins provided ('l'). Origins are
+// made of a scheme and a host (ex: "https://example.com:8080") and are matched
+// case insensitively, while "*" allows requests from any origin. Just like the
+// default CheckOrigin, requests coming from non-browser clients (Origin HTTP
+// Header field omitted) are allowed as well.
+//
+// Ref spec: https://tools.ietf.org/html/rfc6455#section-10.2
+func AllowedOrigins(l ...string) func(r *http.Request) bool {
+	o := make(map[string]bool)
+
+	for _, v := range l {
+		o[normalizeOrigin(v)] = true
+	}
+
+	return func(r *http.Request) bool {
+		h := r.Header.Get("Origin")
+
+		if h == "" || o["*"] {
+			return true
+		}
+
+		return o[normalizeOrigin(h)]
+	}
+}
+
+// normalizeOrigin returns the origin provided ('o') made of its scheme and host
+// only, in lower case, so that origins can be compared. If it can't be parsed
+// it is returned in lower case as is.
+func normalizeOrigin(o string) string {
+	o = strings.ToLower(strings.TrimSpace(o))
+
+	u, err := url.Parse(o)
+
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return o
+	}
+
+	return u.Scheme + "://" + u.Host
+}
@@ -232,3 +232,42 @@ func TestCheckOrigin(t *testing.T) {
 		}
 	}
 }
+
+func TestAllowedOrigins(t *testing.T) {
+	type testCase struct {
+		l []string
+		v string
+		r bool
+	}
+
+	testCases := []testCase{
+		// Valid when origin is omitted (non-browser client).
+		{l: []string{"https://example.com"}, v: "", r: true},
+		// Valid when origin is in the list.
+		{l: []string{"https://example.com"}, v: "https://example.com", r: true},
+		{l: []string{"https://other.com", "https://example.com:8080"}, v: "https://example.com:8080", r: true},
+		// Origins are matched case insensitively.
+		{l: []string{"https://Example.com"}, v: "HTTPS://EXAMPLE.COM", r: true},
+		// Only the scheme and host are matched.
+		{l: []string{"https://example.com/"}, v: "https://example.com", r: true},
+		// Invalid when origin is not in the list.
+		{l: []string{"https://example.com"}, v: "http://example.com", r: false},
+		{l: []string{"https://example.com"}, v: "https://example.com:8080", r: false},
+		{l: []string{"https://example.com"}, v: "https://evil.com", r: false},
+		{l: []string{}, v: "https://example.com", r: false},
+		// Any origin is valid when "*" is in the list.
+		{l: []string{"*"}, v: "https://evil.com", r: true},
+	}
+
+	for i, c := range testCases {
+		r := &http.Request{
+			Header: make(http.Header),
+		}
+
+		r.Header.Set("Origin", c.v)
+
+		if v := AllowedOrigins(c.l...)(r); v != c.r {
+			t.Errorf(`test case %d: expected '%t' for "%s" with allowed origins %q`, i, c.r, c.v, c.l)
+		}
+	}
+}
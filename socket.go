@@ -2,17 +2,41 @@ package websocket
 
 import (
 	"bufio"
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"errors"
+	"hash"
 	"io"
+	"io/ioutil"
+	"log"
 	"net"
+	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 )
 
 // ErrSocketClosed is the error returned when a user tries to send a frame with
 // a closed socket.
 var ErrSocketClosed = errors.New("socket has been closed")
 
+// ErrSocketClosing is the error returned when a user tries to send a data frame
+// once the closing handshake has started.
+var ErrSocketClosing = errors.New("socket is closing")
+
+// ErrNotTCPConn is the error returned when a user tries to configure tcp
+// specific options on a socket which is not backed by a tcp connection.
+var ErrNotTCPConn = errors.New("underlying connection is not a tcp connection")
+
+// ErrWriterOpen is the error returned when a user tries to send a data frame
+// while a message is being sent using a writer returned by NextWriter.
+var ErrWriterOpen = errors.New("a message is being written")
+
 // WebSocket Error codes.
 // Ref Spec: https://tools.ietf.org/html/rfc6455#section-7.4.1
 const (
@@ -27,26 +51,86 @@ const (
 	CloseMessageTooBig           int = 1009
 	CloseMandatoryExtension      int = 1010
 	CloseInternalServerErr       int = 1011
+	CloseServiceRestart          int = 1012
+	CloseTryAgainLater           int = 1013
+	CloseBadGateway              int = 1014
 	CloseTLSHandshake            int = 1015
 )
 
+// Range of close codes reserved for use by libraries, frameworks and
+// applications.
+// Ref Spec: https://tools.ietf.org/html/rfc6455#section-7.4.2
+const (
+	CloseApplicationMin int = 3000
+	CloseApplicationMax int = 4999
+)
+
+// closeLinger is the maximum duration TCPClose will wait for the connected
+// endpoint to close its side of the tcp connection before closing it.
+const closeLinger = time.Millisecond * 100
+
+// maxReadRateDelay is the maximum duration the socket instance waits for a
+// frame to be within MaxReadRate. Since the length of a frame is declared by
+// the connected endpoint, frames which would take longer are rejected.
+const maxReadRateDelay = time.Minute
+
+// writeFromChunkSize is the maximum payload size of the fragments sent by
+// WriteFrom.
+const writeFromChunkSize = 4096
+
+// writeFromMaxEmptyReads is the maximum number of consecutive reads returning
+// no data and no error WriteFrom tolerates before giving up.
+const writeFromMaxEmptyReads = 100
+
+// Stats contains the number of frames and bytes read and written by a socket
+// instance. Apart from the payload data, the bytes taken by the frame headers
+// and the masking keys are reported separately, so that the framing and
+// masking overhead can be computed.
+type Stats struct {
+	FramesRead       int64
+	PayloadBytesRead int64
+	HeaderBytesRead  int64
+	KeyBytesRead     int64
+
+	FramesWritten       int64
+	PayloadBytesWritten int64
+	HeaderBytesWritten  int64
+	KeyBytesWritten     int64
+}
+
+// MissingHandlerAction specifies what a socket instance does with data frames
+// received while no ReadHandler is set.
+type MissingHandlerAction int
+
+const (
+	// MissingHandlerDrop silently drops the data frames.
+	MissingHandlerDrop MissingHandlerAction = iota
+
+	// MissingHandlerWarn drops the data frames and logs a warning using
+	// ErrorLog.
+	MissingHandlerWarn
+
+	// MissingHandlerClose closes the connection with an internal error (1011).
+	MissingHandlerClose
+)
+
 // Represents the state of the Socket instance
 const (
 	/*
 		stateOpened will be the state when the socket instance is open.
 	*/
-	stateOpened int = 0
+	stateOpened int32 = 0
 
 	/*
 		stateClosing will be the state when the socket instance is in the middle
 		of the closing handshake.
 	*/
-	stateClosing int = 1
+	stateClosing int32 = 1
 
 	/*
 		stateClosed will be the state when the socket instance is closed.
 	*/
-	stateClosed int = 2
+	stateClosed int32 = 2
 )
 
 // Socket represents a socket endpoint.
@@ -68,9 +152,11 @@ type Socket struct {
 	server bool
 
 	/*
-		state is the current state of the socket instance.
+		state is the current state of the socket instance. Since the socket
+		instance can be closed from any goroutine, it is accessed atomically
+		using loadState and storeState.
 	*/
-	state int
+	state int32
 
 	/*
 		closeDelay is the duration the socket instance will wait until it closes
@@ -95,6 +181,179 @@ type Socket struct {
 	*/
 	ReadHandler func(int, []byte)
 
+	/*
+		MissingReadHandler specifies what happens to data frames received
+		while ReadHandler is nil. By default they are silently dropped.
+	*/
+	MissingReadHandler MissingHandlerAction
+
+	/*
+		CopyPayload indicates whether the read handler is provided with a copy
+		of the payload data received rather than the slice used internally by
+		the socket instance. When disabled, read handlers must not retain or
+		modify the slice provided once they return. Enabled by default.
+	*/
+	CopyPayload bool
+
+	/*
+		ReadHandlerTimeout is the maximum duration an invocation of the read
+		handler is expected to take. When it is exceeded the read handler
+		timeout handler is invoked, which helps detecting read handlers which
+		are stuck (thus blocking the socket instance from reading further
+		frames). A zero value disables this check.
+	*/
+	ReadHandlerTimeout time.Duration
+
+	/*
+		ReadHandlerTimeoutHandler is invoked (from a separate goroutine)
+		whenever an invocation of the read handler exceeds ReadHandlerTimeout.
+		The opcode and payload data provided to the read handler are provided
+		as args respectively. If not provided, the read handler is invoked
+		from a separate goroutine and, once ReadHandlerTimeout is exceeded, the
+		connection is closed with an internal server error (1011) without
+		waiting for the read handler to return.
+	*/
+	ReadHandlerTimeoutHandler func(int, []byte)
+
+	/*
+		MaxReadRate is the maximum number of payload data bytes per second
+		the socket instance reads from the connected endpoint, averaged using
+		a token bucket which allows bursts of up to MaxReadRate bytes. Each
+		frame is accounted once its header is received, before its payload
+		data is read, irrespective of how frames are read (ex: Listen,
+		NextReader or Call). When exceeded, reading of the payload data is
+		delayed until the rate is back within the limit. Frames which would be
+		delayed for more than a minute fail the connection with a policy
+		violation error (1008). A zero value disables this limit.
+
+		Note that this limits the rate at which data is read, not the memory
+		used to read it (see MaxMessageSize).
+	*/
+	MaxReadRate int
+
+	/*
+		ReadRateClose makes the socket instance close the connection with a
+		policy violation error (1008) instead of delaying reads when
+		MaxReadRate is exceeded.
+	*/
+	ReadRateClose bool
+
+	/*
+		MessageHash creates the hash.Hash instance used to compute the digest
+		of each message read, which is then made available through Digest.
+		The digest is computed as the payload data is read, without a second
+		pass over it. When nil no digest is computed.
+	*/
+	MessageHash func() hash.Hash
+
+	/*
+		digest is the digest of the last message read.
+	*/
+	digest []byte
+
+	/*
+		StrictRSV makes the socket instance fail the connection with a
+		protocol error (1002) when a frame with RSV bits set is received,
+		since no extensions defining their meaning are negotiated. It is
+		enabled by default.
+
+		Disabling it makes the socket instance log and ignore these bits
+		instead. This is only meant as an escape hatch while debugging interop
+		issues with buggy endpoints, since it violates the websocket rfc.
+		Ref Spec: https://tools.ietf.org/html/rfc6455#section-5.2
+	*/
+	StrictRSV bool
+
+	/*
+		ErrorLog is used to log warnings (such as ignored RSV bits). If nil,
+		the standard logger of the log package is used.
+	*/
+	ErrorLog *log.Logger
+
+	/*
+		FramePayloadTimeout is the maximum duration the payload data of a
+		frame can take to arrive once its header is received. This protects
+		against endpoints which send frame headers and then stall (slow loris)
+		and is independent from the read deadline between frames (see
+		SetReadDeadline). When exceeded the connection is closed with an
+		abnormal closure error (1006). A zero value disables this timeout.
+	*/
+	FramePayloadTimeout time.Duration
+
+	/*
+		MessageTimeout is the maximum duration a fragmented message can take
+		to be received in its entirety, from the time its first fragment is
+		received until its final fragment is received. This protects against
+		endpoints which trickle the fragments of a message and is independent
+		from the read deadline used to wait for a message to start (see
+		SetReadDeadline and ReadMessageTimeout). When exceeded the read fails
+		and the connection is closed straight away with a policy violation
+		error (1008). A zero value disables this timeout.
+	*/
+	MessageTimeout time.Duration
+
+	/*
+		IdleTimeout is the maximum duration the socket instance waits for each
+		frame to be received in its entirety, refreshed once a frame is
+		received. This bounds how long reading can stall, either in between
+		frames or in the middle of a frame (such as when an endpoint dribbles
+		the bytes of a frame), and is independent from keepalive pings. When
+		exceeded the connection is closed with an abnormal closure error
+		(1006). A zero value disables this timeout.
+	*/
+	IdleTimeout time.Duration
+
+	/*
+		readDeadline is the read deadline set using SetReadDeadline, which is
+		restored once the payload data of a frame is read within
+		FramePayloadTimeout.
+	*/
+	readDeadline time.Time
+
+	/*
+		writeDeadline is the write deadline set using SetWriteDeadline, which
+		is restored once a frame is sent using WriteMessageWithDeadline.
+	*/
+	writeDeadline time.Time
+
+	/*
+		messageDeadline is the time by which the fragmented message being
+		received must be completed, as set by MessageTimeout.
+	*/
+	messageDeadline time.Time
+
+	/*
+		idleDeadline is the time by which the frame being received must be
+		received, as set by IdleTimeout.
+	*/
+	idleDeadline time.Time
+
+	/*
+		MaxMessageSize is the maximum number of bytes the payload data of a
+		message received can have. For fragmented messages, it applies to the
+		payload data of the whole message. Frames which would exceed it are
+		rejected as soon as their header is read, before their payload data
+		is read, and the connection is closed with a message too big error
+		(1009). A zero value means no limit.
+	*/
+	MaxMessageSize int64
+
+	/*
+		fragmentsSize is the number of payload data bytes received so far for
+		the fragmented message being reassembled.
+	*/
+	fragmentsSize int64
+
+	/*
+		readLimiter is the token bucket used to enforce MaxReadRate.
+	*/
+	readLimiter *rateLimiter
+
+	/*
+		stats holds the counters returned by Stats.
+	*/
+	stats Stats
+
 	/*
 		pingHandler is invoked whenever a ping frame is received. The payload
 		data is provided as arg.
@@ -107,12 +366,49 @@ type Socket struct {
 	*/
 	PongHandler func([]byte)
 
+	/*
+		MaxOutstandingPings is the maximum number of ping frames sent using
+		WriteMessage which can be left unanswered. A pong frame received
+		answers all the ping frames sent before it. Once exceeded, the
+		connected endpoint is considered to be dead and the connection is
+		closed with a going away error (1001). A zero value means no limit.
+	*/
+	MaxOutstandingPings int
+
+	/*
+		outstandingPings is the number of ping frames sent which have not been
+		answered yet. It is accessed atomically.
+	*/
+	outstandingPings int64
+
+	/*
+		reading is set to 1 while a frame is being read from the underlying
+		tcp connection. It is accessed atomically.
+	*/
+	reading int32
+
+	/*
+		lastPong is the time (in nanoseconds since the unix epoch) the last
+		pong frame was received while keepalive is enabled. It is accessed
+		atomically.
+	*/
+	lastPong int64
+
 	/*
 		closeHandler is invoked whenever the websocket connection is closed. The
 		reason for the closure is provided as an arg.
 	*/
 	CloseHandler func(error)
 
+	/*
+		CloseReplyCode is invoked with the status code of a close frame received
+		from the connected endpoint, and returns the status code to be used in
+		the acknowledgement close frame. When nil, or when the status code
+		returned can't be sent in a close frame (ex: 1005 or 1006), the status
+		code received is echoed back.
+	*/
+	CloseReplyCode func(peerCode int) int
+
 	/*
 		closeError contains the error which caused the websocket connection to
 		terminate. This is then provided as an arg when invoking the close
@@ -124,26 +420,177 @@ type Socket struct {
 		writeMutex is used to queue the write functionality of a socket
 		instance.
 	*/
-	writeMutex *sync.Mutex
+	writeMutex sync.Mutex
+
+	/*
+		writerOpen indicates that a message is being sent using a writer
+		returned by NextWriter. It is guarded by writeMutex.
+	*/
+	writerOpen bool
+
+	/*
+		batching indicates that a write transaction started by BeginWrite is
+		in progress, during which frames written are not flushed. It is
+		guarded by writeMutex.
+	*/
+	batching bool
+
+	/*
+		done is closed once the underlying tcp connection is terminated.
+	*/
+	done chan struct{}
+
+	/*
+		compression indicates that the permessage-deflate extension has been
+		agreed upon during the opening handshake.
+	*/
+	compression bool
+
+	/*
+		clientWindowBits and serverWindowBits are the LZ77 sliding window
+		sizes agreed upon with the permessage-deflate extension.
+	*/
+	clientWindowBits int
+	serverWindowBits int
+
+	/*
+		writeContextTakeover indicates that the socket instance keeps the
+		compression context between the messages it sends, while
+		readContextTakeover indicates that the connected endpoint does so.
+	*/
+	writeContextTakeover bool
+	readContextTakeover  bool
+
+	/*
+		compressionLevel is the compress/flate compression level used to
+		compress messages, where a zero value means flate.DefaultCompression.
+	*/
+	compressionLevel int
+
+	/*
+		deflater is the compressor used for every message sent (writing to
+		deflateBuf) when the compression context is kept between messages. It
+		is guarded by writeMutex.
+	*/
+	deflater   *flate.Writer
+	deflateBuf *bytes.Buffer
+
+	/*
+		inflated is the decompressed data of the last messages received (up to
+		the size of the largest LZ77 sliding window), which the next message
+		may refer to when the connected endpoint keeps the compression context
+		between messages.
+	*/
+	inflated []byte
+
+	/*
+		subprotocol is the sub protocol agreed upon during the opening
+		handshake. It is empty when no sub protocol has been agreed upon.
+	*/
+	subprotocol string
+
+	/*
+		header contains a copy of the header fields of the opening handshake
+		request (server endpoints only).
+	*/
+	header http.Header
+
+	/*
+		closeOnce makes sure that the underlying tcp connection is terminated
+		only once, even when closed from multiple goroutines.
+	*/
+	closeOnce sync.Once
+}
+
+// newSocket is a constructor function to create a new Socket instance over an
+// already established connection. 'server' indicates whether the socket
+// instance represents a server or a client endpoint.
+func newSocket(conn net.Conn, buf *bufio.ReadWriter, server bool) *Socket {
+	return &Socket{
+		conn:        conn,
+		buf:         buf,
+		server:      server,
+		CopyPayload: true,
+		StrictRSV:   true,
+		done:        make(chan struct{}),
+	}
+}
+
+// loadState returns the current state of the socket instance.
+func (s *Socket) loadState() int32 {
+	return atomic.LoadInt32(&s.state)
+}
+
+// storeState changes the state of the socket instance to 'v'.
+func (s *Socket) storeState(v int32) {
+	atomic.StoreInt32(&s.state, v)
 }
 
 // Listen is used to start listening for new frames sent by the connected
-// endpoint.
-func (s *Socket) Listen() {
-	s.read()
+// endpoint. It blocks until the connection is closed and returns the error
+// which caused the closure (i.e. the same error provided to the close
+// handler), or nil if the connection was closed normally (1000).
+func (s *Socket) Listen() error {
+	s.read(false)
+	return s.listenError()
+}
+
+// ListenControlOnly is used to start listening for new frames sent by the
+// connected endpoint, just like Listen, but only control frames are processed.
+// Data frames (i.e. text and binary frames) are read and silently discarded
+// without invoking the read handler. This is meant for endpoints which only
+// push data to the connected endpoint, but still need to reply to pings and
+// to the closing handshake to keep the connection healthy.
+//
+// Just like Listen, it returns the error which caused the closure.
+func (s *Socket) ListenControlOnly() error {
+	s.read(true)
+	return s.listenError()
+}
+
+// listenError returns the error which caused the connection to be closed, or
+// nil if it was closed normally.
+func (s *Socket) listenError() error {
+	if c, k := s.closeError.(*CloseError); k && c.Code == CloseNormalClosure {
+		return nil
+	}
+	return s.closeError
 }
 
-func (s *Socket) read() {
+// read reads frames from the connected endpoint until the connection is
+// closed. 'c' indicates whether data frames should be discarded instead of
+// being dispatched to the read handler.
+func (s *Socket) read(c bool) {
+	// Opcode and payload data of the message being reassembled.
+	o := 0
+	var m []byte
+
+	// Validates the payload data of text messages as it is received.
+	var u utf8Validator
+
+	// Indicates that the message being reassembled is compressed.
+	z := false
+
+	// Computes the digest of the message as it is received.
+	var h hash.Hash
+
 Read:
 	for {
 		// Read frame
-		f, err := newFrame(s.buf.Reader)
+		f, err := s.readFrame()
 
-		if s.state == stateClosed {
+		if s.loadState() == stateClosed {
 			break Read
 		}
 
 		if err != nil {
+			// If the closing handshake has already been initiated there is no
+			// need to initiate it again, the connection is simply closed.
+			if s.loadState() == stateClosing {
+				s.TCPClose()
+				break Read
+			}
+
 			// If an error occurred due to something which doesn't conform with
 			// the websocket rfc, use the error itself as a reason.
 			if c, k := err.(*CloseError); k {
@@ -153,8 +600,9 @@ Read:
 
 			// When EOF returns it means that the other endpoint isn't reachable
 			// and thus there won't be the need to initate the closing
-			// handshake.
-			if err == io.EOF {
+			// handshake. The connection may also be terminated in the middle
+			// of a frame.
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
 				s.closeError = &CloseError{
 					Code:   CloseAbnormalClosure,
 					Reason: "abnormal closure",
@@ -184,32 +632,93 @@ Read:
 			return
 		}
 
-		// If Socket instance represents a server endpoint, payload data must be
-		// masked.
-		// Ref Spec: https://tools.ietf.org/html/rfc6455#section-5.1
-		if s.server && !f.masked {
-			s.CloseWithError(&CloseError{
-				Code:   CloseProtocolError,
-				Reason: "expected payload to be masked",
-			})
-			return
-		}
-
-		// If Socket instance represents a client endpoint, payload data must
-		// not be masked.
-		// Ref Spec: https://tools.ietf.org/html/rfc6455#section-5.1
-		if !s.server && f.masked {
-			s.CloseWithError(&CloseError{
-				Code:   CloseProtocolError,
-				Reason: "expected payload to not be masked",
-			})
-			return
+		// While waiting for the acknowledgement close frame, frames other than
+		// close frames are discarded without any validation, since the
+		// closing handshake is already in progress and there is no point in
+		// initiating it again.
+		if s.loadState() == stateClosing && f.opcode != OpcodeClose {
+			continue
 		}
 
 		switch f.opcode {
-		case OpcodeText, OpcodeBinary:
+		case OpcodeText, OpcodeBinary, OpcodeContinuation:
 			{
-				s.callReadHandler(f.opcode, f.payload)
+				if c {
+					continue
+				}
+
+				// A message must start with either a text or binary frame,
+				// followed by continuation frames.
+				// Ref Spec: https://tools.ietf.org/html/rfc6455#section-5.4
+				if (o == 0) == (f.opcode == OpcodeContinuation) {
+					s.CloseWithError(&CloseError{
+						Code:   CloseProtocolError,
+						Reason: "unexpected fragment",
+					})
+					return
+				}
+
+				// Reassemble fragmented messages.
+				if o == 0 {
+					o = f.opcode
+					m = f.payload
+					u = utf8Validator{}
+					z = f.compressed
+
+					if s.MessageHash != nil {
+						h = s.MessageHash()
+					}
+				} else {
+					m = append(m, f.payload...)
+				}
+
+				s.fragmentsSize = int64(len(m))
+
+				// The payload data of text messages must be valid UTF-8. The
+				// payload data of compressed messages is validated once it is
+				// decompressed.
+				// Ref Spec: https://tools.ietf.org/html/rfc6455#section-8.1
+				if o == OpcodeText && !z && (!u.write(f.payload) || f.fin && !u.done()) {
+					s.CloseWithError(&CloseError{
+						Code:   CloseInvalidFramePayloadData,
+						Reason: "invalid utf-8",
+					})
+					return
+				}
+
+				// The payload data of compressed messages is hashed once it
+				// is decompressed.
+				if h != nil && !z {
+					h.Write(f.payload)
+				}
+
+				if !f.fin {
+					continue
+				}
+
+				if z {
+					var e *CloseError
+
+					if m, e = s.inflate(m, h); e == nil && o == OpcodeText && !utf8.Valid(m) {
+						e = &CloseError{
+							Code:   CloseInvalidFramePayloadData,
+							Reason: "invalid utf-8",
+						}
+					}
+
+					if e != nil {
+						s.CloseWithError(e)
+						return
+					}
+				}
+
+				if h != nil {
+					s.digest = h.Sum(nil)
+				}
+
+				s.callReadHandler(o, m)
+
+				o, m, z, h, s.fragmentsSize = 0, nil, false, nil, 0
 			}
 		case OpcodePing:
 			{
@@ -221,51 +730,11 @@ Read:
 			}
 		case OpcodeClose:
 			{
-				// Create a new CloseError using the payload data
-				c, cerr := NewCloseError(f.payload)
-
-				// Store close error for close handler.
-				s.closeError = c
-
-				// If the state of the socket instance is CLOSING, it means that
-				// the closing handshake has been initiated from this socket
-				// instance and the retrieved frame was the acknowledge close
-				// frame. At this point the closing handshake has been completed
-				// and therefore the underlying tcp connection can be closed,
-				// since the connected endpoint won't be waiting for furthur
-				// frames.
-				if s.state == stateClosing {
-					// closing handshake has been finalized therefore close tcp
-					// connection.
-					s.tcpClose()
-					// Stop reading from connection.
-					break Read
-				}
+				// A close frame may be received in the middle of a fragmented
+				// message, in which case the partial message is discarded.
+				o, m, z, h, s.fragmentsSize = 0, nil, false, nil, 0
 
-				// If the state of the socket instance is not CLOSING, it means
-				// that the closing handshake has been initiated by the
-				// connected endpoint and therefore it is still waiting for the
-				// acknowledgement close frame.
-				s.state = stateClosing
-
-				// The acknowledgment close frame to be sent will echo the
-				// status code of the close frame just received.
-				// Ref Spec: https://tools.ietf.org/html/rfc6455#section-5.5.1
-				var b []byte
-
-				// If the status code of the close frame received is valid, echo
-				// it. Else leave the payload data of the acknowledgement close
-				// frame empty.
-				if cerr == nil {
-					b = c.toBytesCode()
-				}
-
-				// Send acknowledgement close frame.
-				s.WriteMessage(OpcodeClose, b)
-
-				// At this point the closing handshake would have been finalized
-				// therefore the tcp connection can be closed.
-				s.tcpClose()
+				s.handleClose(f)
 
 				// Stop reading from connection.
 				break Read
@@ -274,94 +743,1064 @@ Read:
 	}
 }
 
-// WriteMessage is used to send frames to the connected endpoint. It accepts
-// two arguments 'o' opcode, 'p' payload data.
-func (s *Socket) WriteMessage(o int, p []byte) error {
-	s.writeMutex.Lock()
-	defer s.writeMutex.Unlock()
-
-	// Before writing make sure that the socket instance is still in an open
-	// state.
-	if s.state == stateClosed {
-		return ErrSocketClosed
+// handleClose handles a close frame ('f') received from the connected
+// endpoint. If the closing handshake has been initiated by the socket instance
+// the tcp connection is closed, else the close frame is acknowledged first.
+func (s *Socket) handleClose(f *frame) {
+	// Create a new CloseError using the payload data
+	c, cerr := NewCloseError(f.payload)
+
+	// Once a close frame is received, the closing handshake is completed either
+	// by the acknowledgement close frame sent below or by the one just
+	// received.
+	c.Completed = true
+
+	// If the state of the socket instance is not CLOSING, the closure has been
+	// initiated by the connected endpoint.
+	if s.loadState() != stateClosing {
+		c.Source = CloseSourcePeer
 	}
 
-	// Create a frame instance which will represent the frame to be sent.
-	f := &frame{
-		fin:     true,
-		opcode:  o,
-		payload: p,
+	// Store close error for close handler.
+	s.closeError = c
+
+	// If the state of the socket instance is CLOSING, it means that the
+	// closing handshake has been initiated from this socket instance and the
+	// retrieved frame was the acknowledge close frame. At this point the
+	// closing handshake has been completed and therefore the underlying tcp
+	// connection can be closed, since the connected endpoint won't be waiting
+	// for furthur frames.
+	if s.loadState() == stateClosing {
+		// closing handshake has been finalized therefore close tcp
+		// connection.
+		s.tcpClose()
+		return
 	}
 
-	// If the socket instance represents a client endpoint, the payload data
-	// must be masked.
-	if !s.server {
-		// Generate random mask key
-		f.key = randomByteSlice(1)
+	// If the state of the socket instance is not CLOSING, it means that the
+	// closing handshake has been initiated by the connected endpoint and
+	// therefore it is still waiting for the acknowledgement close frame.
+	s.storeState(stateClosing)
+
+	// The acknowledgment close frame to be sent will echo the status code of
+	// the close frame just received, unless CloseReplyCode says otherwise.
+	// Ref Spec: https://tools.ietf.org/html/rfc6455#section-5.5.1
+	var b []byte
+
+	// If the status code of the close frame received is valid, echo it. If
+	// the status code is one which must never be sent (i.e. 1005, 1006 and
+	// 1015) fail the connection with a protocol error (1002) instead, while if
+	// the reason is not valid UTF-8 fail it with an invalid frame payload data
+	// error (1007). Else leave the payload data of the acknowledgement close
+	// frame empty.
+	//
+	// Note that the close error stored for the close handler still contains
+	// the status code sent by the connected endpoint.
+	// Ref Spec: https://tools.ietf.org/html/rfc6455#section-7.4.1
+	// Ref Spec: https://tools.ietf.org/html/rfc6455#section-8.1
+	switch cerr {
+	case nil:
+		{
+			b = c.toBytesCode()
+
+			if !closeCodeSendable(c.Code) {
+				e := &CloseError{Code: CloseProtocolError}
+				b = e.toBytesCode()
+				break
+			}
+
+			// A status code returned by CloseReplyCode which can't be sent
+			// is ignored, echoing the status code received instead.
+			if s.CloseReplyCode == nil {
+				break
+			}
+
+			if r := s.CloseReplyCode(c.Code); closeCodeSendable(r) {
+				e := &CloseError{Code: r}
+				b = e.toBytesCode()
+			}
+		}
+	case errInvalidCloseReason:
+		{
+			e := &CloseError{Code: CloseInvalidFramePayloadData}
+			b = e.toBytesCode()
+		}
 	}
 
-	// Get a []byte representation of the frame instance.
-	b, err := f.toBytes()
+	// Send acknowledgement close frame.
+	s.WriteMessage(OpcodeClose, b)
+
+	// At this point the closing handshake would have been finalized therefore
+	// the tcp connection can be closed.
+	s.tcpClose()
+}
+
+// nextMessage reads the next text or binary message sent by the connected
+// endpoint and writes its payload data to 'w', reassembling it if it is
+// fragmented. Control frames received in the meantime are handled just like
+// while listening. It returns the opcode and the length of the message.
+//
+// If the connection is closed while reading, the close error is returned.
+func (s *Socket) nextMessage(w io.Writer) (int, int64, error) {
+	o, r, err := s.NextReader()
 
-	// If an error is not nil, since the error doesn't relate with the socket
-	// connection itself, the error is returned.
 	if err != nil {
-		return err
+		return o, 0, err
 	}
 
-	// Send frame
-	s.buf.Write(b)
-	if err := s.buf.Flush(); err != nil {
-		// Store error.
-		s.closeError = err
+	// Compute the digest of the message as it is read.
+	var h hash.Hash
 
-		// Close TCP Connection.
-		s.TCPClose()
+	if s.MessageHash != nil {
+		h = s.MessageHash()
+		w = io.MultiWriter(w, h)
+	}
 
-		// Since the error is related with the socket connection the error is
-		// not returned but passed to the close handler.
-		return nil
+	n, err := io.Copy(w, r)
+
+	if err != nil {
+		return o, n, err
 	}
 
-	// If frame sent is a close frame, change state to closing.
-	if f.opcode == OpcodeClose {
-		s.state = stateClosing
+	if h != nil {
+		s.digest = h.Sum(nil)
 	}
 
-	return nil
+	return o, n, nil
 }
 
-// SetReadDeadline sets the deadline for future Read calls. A zero value for t
-// means Read will not time out.
-func (s *Socket) SetReadDeadline(t time.Time) {
-	s.conn.SetReadDeadline(t)
-}
+// readFrame reads the next frame sent by the connected endpoint and accounts it
+// in the stats of the socket instance.
+func (s *Socket) readFrame() (*frame, error) {
+	// The frame must be received within IdleTimeout.
+	if s.IdleTimeout > 0 {
+		s.idleDeadline = time.Now().Add(s.IdleTimeout)
+		s.conn.SetReadDeadline(s.nextReadDeadline())
+	}
 
-// SetWriteDeadline sets the deadline for future Write calls. Even if write
-// times out, it may return n > 0, indicating that some of the data was
-// successfully written. A zero value for t means Write will not time out.
-func (s *Socket) SetWriteDeadline(t time.Time) {
-	s.conn.SetWriteDeadline(t)
-}
+	atomic.StoreInt32(&s.reading, 1)
+	f, err := parseFrame(s.buf.Reader, !s.StrictRSV || s.compression, s.validateHeader)
+	atomic.StoreInt32(&s.reading, 0)
 
-// callReadHandler invokes the read handler provided by the user (if any).
-func (s *Socket) callReadHandler(o int, p []byte) {
-	if s.ReadHandler != nil {
-		s.ReadHandler(o, p)
+	// A fragmented message must be completed within MessageTimeout.
+	if err == nil && s.MessageTimeout > 0 && f.opcode < OpcodeClose {
+		if f.fin {
+			s.messageDeadline = time.Time{}
+		} else if f.opcode != OpcodeContinuation {
+			s.messageDeadline = time.Now().Add(s.MessageTimeout)
+		}
 	}
-}
 
-// callPingHandler first tries to invoke the ping handler provided by the
-// user. If the user hasn't provided one it invokes the default functionality.
-func (s *Socket) callPingHandler(p []byte) {
-	if s.PingHandler != nil {
-		s.PingHandler(p)
-		return
+	// Restore the read deadline changed while reading the payload data.
+	if s.FramePayloadTimeout > 0 || s.MessageTimeout > 0 || s.IdleTimeout > 0 {
+		s.conn.SetReadDeadline(s.nextReadDeadline())
 	}
-	s.defaultPingHandler(p)
-}
 
-// defaultPingHandler sends a pong frame with the same payload data of the ping
+	// When the read times out because a fragmented message wasn't completed
+	// within MessageTimeout, the connection is closed straight away rather
+	// than waiting for the connected endpoint to complete the closing
+	// handshake.
+	if n, k := err.(net.Error); k && n.Timeout() && s.loadState() == stateOpened && s.messageExpired() {
+		s.messageDeadline = time.Time{}
+		s.CloseImmediately(ClosePolicyViolation, "message timeout")
+	}
+
+	// When the permessage-deflate extension is in use, RSV1 indicates that
+	// the payload data of the message started by the frame is compressed.
+	// Ref Spec: https://tools.ietf.org/html/rfc7692#section-6
+	if err == nil && s.compression && f.rsv == 4 && (f.opcode == OpcodeText || f.opcode == OpcodeBinary) {
+		f.compressed = true
+		f.rsv = 0
+	}
+
+	// Un-negotiated RSV bits are only accepted when StrictRSV is disabled, in
+	// which case they are logged and ignored.
+	if err == nil && f.rsv != 0 {
+		s.logf("websocket: ignoring un-negotiated RSV bits %03b", f.rsv)
+		f.rsv = 0
+	}
+
+	if err == nil {
+		h, k := frameOverhead(f)
+		atomic.AddInt64(&s.stats.FramesRead, 1)
+		atomic.AddInt64(&s.stats.PayloadBytesRead, int64(len(f.payload)))
+		atomic.AddInt64(&s.stats.HeaderBytesRead, int64(h))
+		atomic.AddInt64(&s.stats.KeyBytesRead, int64(k))
+	}
+
+	return f, err
+}
+
+// nextReadDeadline returns the read deadline of the next frame, which is the
+// earliest of the read deadline set using SetReadDeadline, the deadline of the
+// fragmented message being received and the deadline set by IdleTimeout (if
+// any).
+func (s *Socket) nextReadDeadline() time.Time {
+	d := s.readDeadline
+
+	for _, t := range []time.Time{s.messageDeadline, s.idleDeadline} {
+		if !t.IsZero() && (d.IsZero() || t.Before(d)) {
+			d = t
+		}
+	}
+
+	return d
+}
+
+// messageExpired returns true when the fragmented message being received
+// wasn't completed within MessageTimeout.
+func (s *Socket) messageExpired() bool {
+	return !s.messageDeadline.IsZero() && !time.Now().Before(s.messageDeadline)
+}
+
+// limitReadRate accounts the payload data of the frame provided ('f'), whose
+// header has just been read, against MaxReadRate. When the rate is exceeded it
+// either waits until it is back within the limit or, if ReadRateClose is set or
+// the wait would exceed maxReadRateDelay, returns the close error the
+// connection should be failed with. The wait ends early if the tcp connection
+// is closed in the meantime.
+func (s *Socket) limitReadRate(f *frame) *CloseError {
+	if s.MaxReadRate <= 0 {
+		return nil
+	}
+
+	if s.readLimiter == nil {
+		s.readLimiter = newRateLimiter(s.MaxReadRate, time.Now())
+	}
+
+	d := s.readLimiter.take(int(f.length), time.Now())
+
+	if d <= 0 {
+		return nil
+	}
+
+	if s.ReadRateClose || d > maxReadRateDelay {
+		return &CloseError{
+			Code:   ClosePolicyViolation,
+			Reason: "read rate exceeded",
+		}
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+	case <-s.done:
+		{
+			return nil
+		}
+	}
+
+	// The time spent waiting doesn't count against IdleTimeout.
+	if s.IdleTimeout > 0 {
+		s.idleDeadline = time.Now().Add(s.IdleTimeout)
+		s.conn.SetReadDeadline(s.nextReadDeadline())
+	}
+
+	return nil
+}
+
+// validateHeader validates the header of a frame received before its payload
+// data is read, enforces MaxReadRate and starts the FramePayloadTimeout (if
+// any). Since frames received while closing are discarded, they are not
+// validated.
+func (s *Socket) validateHeader(f *frame) error {
+	// The payload data of messages must not exceed MaxMessageSize.
+	if s.MaxMessageSize > 0 && f.opcode < OpcodeClose {
+		n := uint64(f.length)
+
+		if f.opcode == OpcodeContinuation {
+			n += uint64(s.fragmentsSize)
+		}
+
+		if f.length > uint64(s.MaxMessageSize) || n > uint64(s.MaxMessageSize) {
+			return &CloseError{
+				Code:   CloseMessageTooBig,
+				Reason: "message too big",
+			}
+		}
+	}
+
+	// Enforce the read rate limit (if any) before the payload data is read.
+	if s.loadState() != stateClosing {
+		if e := s.limitReadRate(f); e != nil {
+			return e
+		}
+	}
+
+	// The payload data must be received within FramePayloadTimeout, unless
+	// the read deadline expires earlier.
+	if s.FramePayloadTimeout > 0 {
+		d := time.Now().Add(s.FramePayloadTimeout)
+
+		if r := s.nextReadDeadline(); r.IsZero() || d.Before(r) {
+			s.conn.SetReadDeadline(d)
+		}
+	}
+
+	// When the permessage-deflate extension is in use frames are read even if
+	// they have RSV bits set, so the ones which are not allowed are rejected
+	// here.
+	if s.compression && s.StrictRSV && f.rsv != 0 && (f.rsv != 4 || (f.opcode != OpcodeText && f.opcode != OpcodeBinary)) {
+		return &CloseError{
+			Code:   CloseProtocolError,
+			Reason: "no support for extensions",
+		}
+	}
+
+	if s.loadState() == stateClosing {
+		return nil
+	}
+
+	// Payload data must be masked according to the endpoint the socket
+	// instance represents.
+	if e := s.validateMask(f); e != nil {
+		return e
+	}
+
+	return nil
+}
+
+// validateMask verifies that the payload data of a frame received is masked
+// according to the endpoint the socket instance represents.
+func (s *Socket) validateMask(f *frame) *CloseError {
+	// If Socket instance represents a server endpoint, payload data must be
+	// masked.
+	// Ref Spec: https://tools.ietf.org/html/rfc6455#section-5.1
+	if s.server && !f.masked {
+		return &CloseError{
+			Code:   CloseProtocolError,
+			Reason: "expected payload to be masked",
+		}
+	}
+
+	// If Socket instance represents a client endpoint, payload data must
+	// not be masked.
+	// Ref Spec: https://tools.ietf.org/html/rfc6455#section-5.1
+	if !s.server && f.masked {
+		return &CloseError{
+			Code:   CloseProtocolError,
+			Reason: "expected payload to not be masked",
+		}
+	}
+
+	return nil
+}
+
+// ReadHello reads the first message sent by the connected endpoint and parses
+// it as JSON into the value pointed to by 'v'. This is meant for protocols in
+// which the connected endpoint starts by sending a message carrying metadata
+// about the connection. The message is read just like using ReadInto, so it
+// may be fragmented or compressed, while control frames received beforehand
+// are handled just like while listening.
+//
+// Note that ReadHello must be invoked before Listen, since it reads from the
+// connection directly.
+func (s *Socket) ReadHello(v interface{}) error {
+	b := &bytes.Buffer{}
+
+	if _, _, err := s.nextMessage(b); err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b.Bytes(), v)
+}
+
+// Call sends a message with opcode 'o' and payload data 'p' to the connected
+// endpoint and waits for the next text or binary message it sends, which is
+// returned as the reply. Control frames received while waiting are handled
+// just like while listening.
+//
+// If 'ctx' is canceled or its deadline expires before the reply is received,
+// ctx.Err() is returned. Since the reply may have been partially read by then,
+// the socket instance should be closed afterwards.
+//
+// Note that Call reads from the connection directly, therefore it is not safe
+// to be used concurrently with Listen or with other invocations of Call.
+func (s *Socket) Call(ctx context.Context, o int, p []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := s.WriteMessage(o, p); err != nil {
+		return nil, err
+	}
+
+	// Restore the read deadline set using SetReadDeadline (if any) once the
+	// call ends.
+	r := s.readDeadline
+	d, k := ctx.Deadline()
+
+	if k {
+		s.SetReadDeadline(d)
+	} else {
+		d = r
+	}
+
+	defer s.restoreReadDeadline(r, d)
+
+	// Unblock the read when the context is canceled.
+	c := make(chan struct{})
+	w := make(chan struct{})
+
+	go func() {
+		defer close(w)
+
+		select {
+		case <-ctx.Done():
+			{
+				s.conn.SetReadDeadline(time.Now())
+			}
+		case <-c:
+		}
+	}()
+
+	b := &bytes.Buffer{}
+	_, _, err := s.nextMessage(b)
+
+	close(c)
+	<-w
+
+	if err != nil {
+		if e := contextErr(ctx); e != nil {
+			return nil, e
+		}
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+// ReadInto reads the next text or binary message sent by the connected
+// endpoint and copies its payload data into 'w' as each fragment is received,
+// so that large messages don't need to be held in memory. It returns the
+// opcode of the message and the number of bytes copied. Control frames
+// received in the meantime are handled just like while listening.
+//
+// Note that ReadInto reads from the connection directly, therefore it is not
+// safe to be used concurrently with Listen or Call.
+func (s *Socket) ReadInto(w io.Writer) (int, int64, error) {
+	return s.nextMessage(w)
+}
+
+// ReadMessageTimeout reads the next text or binary message sent by the
+// connected endpoint, waiting for it for at most 'd'. It returns the opcode and
+// the payload data of the message. If nothing arrives in time a timeout error
+// (net.Error) is returned without closing the connection, and since the read
+// deadline set using SetReadDeadline (if any) is restored afterwards, later
+// reads are not affected by it.
+//
+// Note that a message which only partially arrives in time can't be read
+// anymore, in which case the socket instance should be closed.
+//
+// ReadMessageTimeout reads from the connection directly, therefore it is not
+// safe to be used concurrently with Listen or Call.
+func (s *Socket) ReadMessageTimeout(d time.Duration) (int, []byte, error) {
+	r, t := s.readDeadline, time.Now().Add(d)
+
+	s.SetReadDeadline(t)
+	defer s.restoreReadDeadline(r, t)
+
+	b := &bytes.Buffer{}
+
+	o, _, err := s.nextMessage(b)
+
+	if err != nil {
+		return o, nil, err
+	}
+
+	return o, b.Bytes(), nil
+}
+
+// restoreReadDeadline restores the read deadline ('r') which was replaced by
+// 'd' for the duration of a single read, unless it has been changed again in
+// the meantime (ex: when a pong frame is received while keepalive is enabled).
+func (s *Socket) restoreReadDeadline(r, d time.Time) {
+	if s.readDeadline.Equal(d) {
+		s.readDeadline = r
+	}
+
+	s.conn.SetReadDeadline(s.nextReadDeadline())
+}
+
+// WriteMessage is used to send frames to the connected endpoint. It accepts
+// two arguments 'o' opcode, 'p' payload data.
+//
+// WriteMessage is the API used to send text and binary messages, with their
+// payload data sent in a single frame. Control frames (i.e. close, ping and
+// pong frames) can be sent using WriteMessage as well, in which case the
+// payload data must not exceed MaxControlFramePayload bytes. Note that closing
+// the connection should be done using Close or CloseWithError instead of
+// sending a close frame directly.
+//
+// WriteMessage is safe to be used concurrently. Writes are serialized using
+// s.writeMutex, which is held until a frame is written and flushed in its
+// entirety, therefore frames sent from different goroutines (including the
+// pong and close frames sent automatically while listening) never interleave
+// on the wire. Frames are sent in the order the lock is acquired.
+func (s *Socket) WriteMessage(o int, p []byte) error {
+	if err := s.trackPing(o); err != nil {
+		return err
+	}
+
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	if err := s.checkWriter(o); err != nil {
+		return err
+	}
+
+	return s.writeFrame(s.messageFrame(o, p))
+}
+
+// WriteMessageWithDeadline sends a frame just like WriteMessage, but the write
+// must complete by the deadline provided ('d'). The deadline only applies to
+// this write, after which the write deadline set using SetWriteDeadline (if
+// any) is restored, and is set and restored while holding s.writeMutex so
+// that it never affects other writes.
+//
+// Unlike WriteMessage, the error which occurs while sending the frame (such as
+// when the deadline is exceeded) is returned, apart from being passed to the
+// close handler once the connection is closed.
+func (s *Socket) WriteMessageWithDeadline(o int, p []byte, d time.Time) error {
+	if err := s.trackPing(o); err != nil {
+		return err
+	}
+
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	if err := s.checkWriter(o); err != nil {
+		return err
+	}
+
+	s.conn.SetWriteDeadline(d)
+	defer s.conn.SetWriteDeadline(s.writeDeadline)
+
+	// The frame is flushed here so that the error can be returned.
+	s.batching = true
+	err := s.writeFrame(s.messageFrame(o, p))
+	s.batching = false
+
+	if err != nil {
+		return err
+	}
+
+	return s.flush()
+}
+
+// trackPing keeps track of the ping frames which have not been answered. When
+// a ping frame ('o') would exceed MaxOutstandingPings the connection is closed
+// and the close error is returned.
+func (s *Socket) trackPing(o int) error {
+	if o != OpcodePing {
+		return nil
+	}
+
+	n := atomic.AddInt64(&s.outstandingPings, 1)
+
+	if s.MaxOutstandingPings > 0 && n > int64(s.MaxOutstandingPings) {
+		e := &CloseError{
+			Code:   CloseGoingAway,
+			Reason: "too many outstanding pings",
+		}
+		s.CloseWithError(e)
+		return e
+	}
+
+	return nil
+}
+
+// messageFrame creates the frame used to send a message with opcode 'o' and
+// payload data 'p' using WriteMessage.
+func (s *Socket) messageFrame(o int, p []byte) *frame {
+	// Create a frame instance which will represent the frame to be sent.
+	f := &frame{
+		fin:     true,
+		opcode:  o,
+		payload: p,
+	}
+
+	// When the permessage-deflate extension is in use, the payload data of
+	// messages is compressed.
+	// Ref Spec: https://tools.ietf.org/html/rfc7692#section-6.1
+	if s.compression && (o == OpcodeText || o == OpcodeBinary) {
+		f.payload = s.deflate(p)
+		f.rsv = 4
+	}
+
+	// If the socket instance represents a client endpoint, the payload data
+	// must be masked.
+	if !s.server {
+		// Generate random mask key
+		f.key = randomByteSlice(1)
+	}
+
+	return f
+}
+
+// Forward returns a read handler which forwards every message received to the
+// socket instance provided ('d'), keeping its opcode. This is meant for proxies
+// relaying messages between endpoints. Since the destination masks the payload
+// data based on the endpoint it represents, messages received by a server
+// socket (unmasked on the way in) can be forwarded to a client socket (masked
+// on the way out) and vice versa.
+//
+// Errors returned while forwarding are ignored. When they need to be handled,
+// a read handler invoking d.WriteMessage should be used instead.
+func Forward(d *Socket) func(int, []byte) {
+	return func(o int, p []byte) {
+		d.WriteMessage(o, p)
+	}
+}
+
+// WriteMessageMasked is used by client endpoints to send frames masked with
+// the masking key provided ('k') instead of a randomly generated one. Apart
+// from this it behaves just like WriteMessage.
+//
+// This method is intended for conformance and interop testing, where
+// deterministic wire bytes are required. Since a predictable masking key
+// defeats the purpose of masking, it should not be used otherwise.
+//
+// Ref Spec: https://tools.ietf.org/html/rfc6455#section-5.3
+func (s *Socket) WriteMessageMasked(o int, p []byte, k [4]byte) error {
+	// Only client endpoints are allowed to mask the payload data.
+	// Ref Spec: https://tools.ietf.org/html/rfc6455#section-5.1
+	if s.server {
+		return errors.New("only client endpoints can send masked frames")
+	}
+
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	if err := s.checkWriter(o); err != nil {
+		return err
+	}
+
+	return s.writeFrame(&frame{
+		fin:     true,
+		opcode:  o,
+		key:     k[:],
+		payload: p,
+	})
+}
+
+// WriteFrom sends the data read from 'r' until EOF as a single message with
+// opcode 'o' (i.e. OpcodeText or OpcodeBinary), fragmenting it as it is read. This is meant for data of unknown
+// length, such as a file or an upstream response being piped onto the socket.
+// It returns the number of bytes sent.
+//
+// The message is finalized with a frame with the FIN bit set once EOF is
+// reached. If reading from 'r' fails after some of the message has already
+// been sent, the message can't be finished and therefore the connection is
+// failed with an internal server error (1011). The same happens when 'r' keeps
+// on returning no data without an error, in which case io.ErrNoProgress is
+// returned.
+//
+// Just like a writer returned by NextWriter, other messages can't be sent until
+// WriteFrom returns (ErrWriterOpen is returned instead), since fragments of
+// different messages must not be interleaved. Control frames can still be sent
+// in between the fragments, since reading from 'r' is done without holding
+// the lock used to send frames.
+// Ref Spec: https://tools.ietf.org/html/rfc6455#section-5.4
+func (s *Socket) WriteFrom(o int, r io.Reader) (int64, error) {
+	// Control frames must not be fragmented.
+	// Ref Spec: https://tools.ietf.org/html/rfc6455#section-5.5
+	if o != OpcodeText && o != OpcodeBinary {
+		return 0, errors.New("messages must either be text or binary")
+	}
+
+	n, k, err := s.writeFrom(o, r)
+
+	if k {
+		s.CloseWithError(&CloseError{
+			Code:   CloseInternalServerErr,
+			Reason: "message aborted",
+		})
+	}
+
+	return n, err
+}
+
+// writeFrom sends the data read from 'r' as fragments of a message with opcode
+// 'o' using a message writer. Apart from the number of bytes sent, it reports
+// whether the message was aborted half way through.
+func (s *Socket) writeFrom(o int, r io.Reader) (int64, bool, error) {
+	w, err := s.nextWriter(o)
+
+	if err != nil {
+		return 0, false, err
+	}
+
+	var n int64
+
+	// Number of consecutive empty reads.
+	e := 0
+
+	b := make([]byte, writeFromChunkSize)
+
+	for {
+		i, rerr := r.Read(b)
+
+		if rerr != nil && rerr != io.EOF {
+			return n, w.abort(), rerr
+		}
+
+		// Skip empty reads unless the message is to be finalized, giving up
+		// on readers which never make progress.
+		if i == 0 && rerr == nil {
+			if e++; e >= writeFromMaxEmptyReads {
+				return n, w.abort(), io.ErrNoProgress
+			}
+			continue
+		}
+
+		e = 0
+
+		if err := w.writeFrame(b[:i], rerr == io.EOF); err != nil {
+			return n, false, err
+		}
+
+		n += int64(i)
+
+		if rerr == io.EOF {
+			return n, false, nil
+		}
+	}
+}
+
+// checkWriter returns ErrWriterOpen when a data frame with opcode 'o' can't be
+// sent because a message is being sent using a writer returned by NextWriter.
+// Control frames can still be sent in the middle of such a message. Note that
+// the caller is expected to hold s.writeMutex.
+func (s *Socket) checkWriter(o int) error {
+	if s.writerOpen && o < OpcodeClose {
+		return ErrWriterOpen
+	}
+	return nil
+}
+
+// writeFrame sends the frame instance provided to the connected endpoint. Note
+// that the caller is expected to hold s.writeMutex.
+func (s *Socket) writeFrame(f *frame) error {
+	// Before writing make sure that the socket instance is still in an open
+	// state.
+	if s.loadState() == stateClosed {
+		return ErrSocketClosed
+	}
+
+	// Once a close frame has been sent or received, no more data frames can
+	// be sent.
+	// Ref Spec: https://tools.ietf.org/html/rfc6455#section-5.5.1
+	if s.loadState() == stateClosing && (f.opcode == OpcodeText || f.opcode == OpcodeBinary || f.opcode == OpcodeContinuation) {
+		return ErrSocketClosing
+	}
+
+	// Get a []byte representation of the frame instance.
+	b, err := f.toBytes()
+
+	// If an error is not nil, since the error doesn't relate with the socket
+	// connection itself, the error is returned.
+	if err != nil {
+		return err
+	}
+
+	// Send frame
+	s.buf.Write(b)
+
+	h, k := frameOverhead(f)
+	atomic.AddInt64(&s.stats.FramesWritten, 1)
+	atomic.AddInt64(&s.stats.PayloadBytesWritten, int64(len(f.payload)))
+	atomic.AddInt64(&s.stats.HeaderBytesWritten, int64(h))
+	atomic.AddInt64(&s.stats.KeyBytesWritten, int64(k))
+
+	// If frame sent is a close frame, change state to closing.
+	if f.opcode == OpcodeClose {
+		s.storeState(stateClosing)
+	}
+
+	// Frames written during a write transaction are flushed once it ends.
+	if s.batching {
+		return nil
+	}
+
+	// Since errors related with the socket connection are passed to the close
+	// handler, they are not returned.
+	s.flush()
+
+	return nil
+}
+
+// flush sends the buffered frames to the connected endpoint. If it fails the
+// tcp connection is closed and the error is returned. Note that the caller is
+// expected to hold s.writeMutex.
+func (s *Socket) flush() error {
+	err := s.buf.Flush()
+
+	if err != nil {
+		// Store error.
+		s.closeError = err
+
+		// Close TCP Connection.
+		s.tcpCloseLocked()
+	}
+
+	return err
+}
+
+// logf logs a warning using ErrorLog or the standard logger if not set.
+func (s *Socket) logf(f string, v ...interface{}) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(f, v...)
+		return
+	}
+	log.Printf(f, v...)
+}
+
+// CompressionWindowBits returns the base-2 logarithm of the LZ77 sliding window
+// sizes the client and the server use to compress messages, as agreed upon
+// with the permessage-deflate extension. Zeros are returned when compression
+// is not in use.
+func (s *Socket) CompressionWindowBits() (int, int) {
+	return s.clientWindowBits, s.serverWindowBits
+}
+
+// setCompression enables compression using the parameters of the
+// permessage-deflate extension agreed upon ('o'), if any.
+func (s *Socket) setCompression(o *deflateOptions) {
+	if o == nil {
+		return
+	}
+
+	s.compression = true
+	s.clientWindowBits = o.clientWindowBits
+	s.serverWindowBits = o.serverWindowBits
+
+	if s.server {
+		s.writeContextTakeover = !o.serverNoContextTakeover
+		s.readContextTakeover = !o.clientNoContextTakeover
+	} else {
+		s.writeContextTakeover = !o.clientNoContextTakeover
+		s.readContextTakeover = !o.serverNoContextTakeover
+	}
+}
+
+// Subprotocol returns the sub protocol agreed upon during the opening
+// handshake, or an empty string when no sub protocol has been agreed upon.
+func (s *Socket) Subprotocol() string {
+	return s.subprotocol
+}
+
+// Header returns the header fields of the clients opening handshake request
+// (ex: Authorization or custom header fields) for server endpoints, and nil for
+// client endpoints. A copy is kept for the lifetime of the socket instance, so
+// it is not affected by the HTTP server reusing the original request.
+func (s *Socket) Header() http.Header {
+	return s.header
+}
+
+// Digest returns the digest of the last message read, computed using
+// MessageHash. It is meant to be invoked from within the read handler (or after
+// ReadInto, Call or ReadMessageTimeout return) to retrieve the digest of the
+// message just read.
+func (s *Socket) Digest() []byte {
+	return s.digest
+}
+
+// Stats returns a snapshot of the number of frames and bytes read and written
+// by the socket instance so far. It is safe to be used concurrently.
+func (s *Socket) Stats() Stats {
+	return Stats{
+		FramesRead:          atomic.LoadInt64(&s.stats.FramesRead),
+		PayloadBytesRead:    atomic.LoadInt64(&s.stats.PayloadBytesRead),
+		HeaderBytesRead:     atomic.LoadInt64(&s.stats.HeaderBytesRead),
+		KeyBytesRead:        atomic.LoadInt64(&s.stats.KeyBytesRead),
+		FramesWritten:       atomic.LoadInt64(&s.stats.FramesWritten),
+		PayloadBytesWritten: atomic.LoadInt64(&s.stats.PayloadBytesWritten),
+		HeaderBytesWritten:  atomic.LoadInt64(&s.stats.HeaderBytesWritten),
+		KeyBytesWritten:     atomic.LoadInt64(&s.stats.KeyBytesWritten),
+	}
+}
+
+// Done returns a channel which is closed once the underlying tcp connection is
+// terminated, irrespective of whether this happened through the closing
+// handshake or due to a connection failure. It is meant to be used by
+// goroutines (such as keepalive pingers) which need to stop once the socket
+// is closed.
+func (s *Socket) Done() <-chan struct{} {
+	return s.done
+}
+
+// Buffered returns the number of bytes which have already been read from the
+// underlying tcp connection but have not yet been consumed by the frame parser.
+func (s *Socket) Buffered() int {
+	return s.buf.Reader.Buffered()
+}
+
+// UnderlyingBuffer returns the buffered version of the underlying tcp
+// connection used by the socket instance. This is meant for advanced use cases
+// such as running a different protocol over the same connection.
+//
+// Warning: reading from or writing to the returned buffer bypasses the framing
+// done by the socket instance and therefore invalidates its guarantees. It
+// should not be used while the socket instance is listening or writing.
+func (s *Socket) UnderlyingBuffer() *bufio.ReadWriter {
+	return s.buf
+}
+
+// NetConn returns the underlying connection used by the socket instance (i.e.
+// a *tls.Conn for secure connections). This is meant for advanced use cases
+// such as setting socket options or inspecting the TLS connection state.
+//
+// Warning: reading from or writing to the returned connection directly
+// bypasses the framing done by the socket instance and therefore is unsafe
+// while the socket instance is listening or writing.
+func (s *Socket) NetConn() net.Conn {
+	return s.conn
+}
+
+// RemoteAddr returns the network address of the connected endpoint.
+func (s *Socket) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+// LocalAddr returns the local network address of the socket instance.
+func (s *Socket) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// SetLinger sets the behavior of the underlying tcp connection when it is
+// closed with unsent data (SO_LINGER). Refer to net.TCPConn.SetLinger for the
+// meaning of 'sec'. ErrNotTCPConn is returned if the socket is not backed by a
+// tcp connection (either directly or through TLS).
+func (s *Socket) SetLinger(sec int) error {
+	c := s.conn
+
+	// Unwrap TLS connections.
+	if t, k := c.(*tls.Conn); k {
+		c = t.NetConn()
+	}
+
+	t, k := c.(*net.TCPConn)
+
+	if !k {
+		return ErrNotTCPConn
+	}
+
+	return t.SetLinger(sec)
+}
+
+// PeerCertificates returns the certificate chain presented by the connected
+// endpoint when the socket is backed by a TLS connection, and nil otherwise.
+// When the TLS configuration requires the certificates to be verified (ex:
+// tls.RequireAndVerifyClientCert for mutual TLS), the chain returned has been
+// verified. This is meant for certificate based authorization once the
+// connection is upgraded.
+func (s *Socket) PeerCertificates() []*x509.Certificate {
+	t, k := s.conn.(*tls.Conn)
+
+	if !k {
+		return nil
+	}
+
+	return t.ConnectionState().PeerCertificates
+}
+
+// SetReadDeadline sets the deadline for future Read calls. A zero value for t
+// means Read will not time out.
+func (s *Socket) SetReadDeadline(t time.Time) {
+	s.readDeadline = t
+	s.conn.SetReadDeadline(s.nextReadDeadline())
+}
+
+// SetWriteDeadline sets the deadline for future Write calls. Even if write
+// times out, it may return n > 0, indicating that some of the data was
+// successfully written. A zero value for t means Write will not time out.
+func (s *Socket) SetWriteDeadline(t time.Time) {
+	s.writeDeadline = t
+	s.conn.SetWriteDeadline(t)
+}
+
+// callReadHandler invokes the read handler provided by the user (if any). If
+// s.CopyPayload is set, the read handler is provided with a copy of the
+// payload data. If s.ReadHandlerTimeout is set, the read handler timeout
+// handler is invoked (or the connection is closed if there isn't one) if the
+// read handler doesn't return in time.
+func (s *Socket) callReadHandler(o int, p []byte) {
+	if s.ReadHandler == nil {
+		switch s.MissingReadHandler {
+		case MissingHandlerWarn:
+			{
+				s.logf("websocket: dropped message of %d bytes since no read handler is set", len(p))
+			}
+		case MissingHandlerClose:
+			{
+				s.CloseWithError(&CloseError{
+					Code:   CloseInternalServerErr,
+					Reason: "no read handler",
+				})
+			}
+		}
+		return
+	}
+
+	// Provide the read handler with its own copy of the payload data.
+	if s.CopyPayload {
+		p = append([]byte{}, p...)
+	}
+
+	if s.ReadHandlerTimeout <= 0 {
+		s.ReadHandler(o, p)
+		return
+	}
+
+	if s.ReadHandlerTimeoutHandler != nil {
+		t := time.AfterFunc(s.ReadHandlerTimeout, func() {
+			s.ReadHandlerTimeoutHandler(o, p)
+		})
+		defer t.Stop()
+
+		s.ReadHandler(o, p)
+		return
+	}
+
+	// The read handler is invoked from a separate goroutine, so that the
+	// connection can be closed from the reading goroutine (which owns the
+	// state of the socket instance) while the read handler is stuck.
+	d := make(chan struct{})
+
+	go func() {
+		defer close(d)
+		s.ReadHandler(o, p)
+	}()
+
+	t := time.NewTimer(s.ReadHandlerTimeout)
+	defer t.Stop()
+
+	select {
+	case <-d:
+	case <-t.C:
+		{
+			s.CloseWithError(&CloseError{
+				Code:   CloseInternalServerErr,
+				Reason: "read handler timed out",
+			})
+		}
+	}
+}
+
+// callPingHandler first tries to invoke the ping handler provided by the
+// user. If the user hasn't provided one it invokes the default functionality.
+func (s *Socket) callPingHandler(p []byte) {
+	if s.PingHandler != nil {
+		s.PingHandler(p)
+		return
+	}
+	s.defaultPingHandler(p)
+}
+
+// defaultPingHandler sends a pong frame with the same payload data of the ping
 // frame just received.
 //
 // Ref Spec: https://tools.ietf.org/html/rfc6455#section-5.5.3
@@ -371,6 +1810,10 @@ func (s *Socket) defaultPingHandler(p []byte) {
 
 // callPongHandler invokes the pong handler provided by the user (if any).
 func (s *Socket) callPongHandler(p []byte) {
+	// A pong frame answers all the ping frames sent before it.
+	// Ref Spec: https://tools.ietf.org/html/rfc6455#section-5.5.3
+	atomic.StoreInt64(&s.outstandingPings, 0)
+
 	if s.PongHandler != nil {
 		s.PongHandler(p)
 		return
@@ -388,17 +1831,90 @@ func (s *Socket) callCloseHandler(e error) {
 // TCPClose closes the underlying tcp connection if it hasn't already been
 // closed.
 func (s *Socket) TCPClose() {
+	// A write blocked on a connected endpoint which isn't reading would hold
+	// s.writeMutex indefinitely, therefore pending writes are only given a
+	// short while to complete.
+	s.conn.SetWriteDeadline(time.Now().Add(closeLinger))
+
+	// Make sure that any buffered frames (such as the close frame) are sent
+	// before closing the tcp connection. The lock is not held while waiting
+	// for closeOnce, since a write which fails closes the tcp connection
+	// through it while holding the lock.
+	s.writeMutex.Lock()
+	s.buf.Flush()
+	s.storeState(stateClosed)
+	s.writeMutex.Unlock()
+
+	// The tcp connection is only closed once.
+	s.closeOnce.Do(func() {
+		s.closeTCP(true)
+	})
+}
+
+// tcpCloseLocked closes the underlying tcp connection just like TCPClose. Note
+// that the caller is expected to hold s.writeMutex.
+func (s *Socket) tcpCloseLocked() {
+	s.closeOnce.Do(func() {
+		s.buf.Flush()
+		s.storeState(stateClosed)
+		s.closeTCP(true)
+	})
+}
+
+// Abort terminates the underlying tcp connection straight away, without the
+// closing handshake and without sending any frames which are still buffered.
+// The close handler is invoked with an abnormal closure error (1006). Unlike
+// Close, which politely asks the connected endpoint to close the connection,
+// this is meant to kill connections (ex: when an attack is detected or
+// resources are running low).
+func (s *Socket) Abort() {
 	// If socket has already been closed, don't reclose the tcp connection
-	if s.state == stateClosed {
+	if s.loadState() == stateClosed {
 		return
 	}
 
-	// Change state of socket instance to closed.
-	s.state = stateClosed
+	s.closeOnce.Do(func() {
+		s.closeError = &CloseError{
+			Code:   CloseAbnormalClosure,
+			Reason: "connection aborted",
+		}
+
+		// Change state of socket instance to closed.
+		s.storeState(stateClosed)
+
+		s.closeTCP(false)
+	})
+}
+
+// closeTCP terminates the underlying tcp connection. It is only invoked once
+// through either TCPClose or Abort. When 'g' is true the connection is closed
+// gracefully, making sure that the frames sent (which are expected to have
+// been flushed already) reach the connected endpoint. Note that the caller is
+// expected to change the state of the socket instance to closed beforehand.
+func (s *Socket) closeTCP(g bool) {
+	// Shut down the writing side of the tcp connection first and drain what
+	// is left to read for a short while, so that closing the connection won't
+	// discard unread data and reset the connection before the connected
+	// endpoint receives the frames sent. Draining is skipped while frames are
+	// being read by another goroutine, since it would compete with it for the
+	// data received.
+	if g && atomic.LoadInt32(&s.reading) == 0 {
+		if c, k := s.conn.(interface {
+			CloseWrite() error
+		}); k && c.CloseWrite() == nil {
+			s.conn.SetReadDeadline(time.Now().Add(closeLinger))
+			io.Copy(ioutil.Discard, s.conn)
+		}
+	}
 
 	// Close tcp connection
 	s.conn.Close()
 
+	// Notify goroutines waiting on the socket to be closed.
+	if s.done != nil {
+		close(s.done)
+	}
+
 	// Invoke close handler.
 	s.callCloseHandler(s.closeError)
 }
@@ -408,7 +1924,7 @@ func (s *Socket) TCPClose() {
 // in s.CloseDelay.
 func (s *Socket) tcpClose() {
 	// If socket has already been closed, don't reclose the tcp connection
-	if s.state == stateClosed {
+	if s.loadState() == stateClosed {
 		return
 	}
 
@@ -438,3 +1954,113 @@ func (s *Socket) CloseWithError(e *CloseError) {
 	b, _ := e.ToBytes()
 	s.WriteMessage(OpcodeClose, b)
 }
+
+// CloseWithCode initiates the closing handshake with the status code ('c') and
+// reason ('r') provided, such as a going away error (1001) when draining
+// connections during a graceful shutdown. Unlike CloseWithError, an error is
+// returned without initiating the closing handshake if the status code can't be
+// sent in a close frame or if the reason is longer than MaxCloseReason bytes or
+// is not valid UTF-8.
+//
+// Ref Spec: https://tools.ietf.org/html/rfc6455#section-5.5.1
+func (s *Socket) CloseWithCode(c int, r string) error {
+	if err := validateClose(c, r); err != nil {
+		return err
+	}
+
+	e := &CloseError{
+		Code:   c,
+		Reason: r,
+	}
+
+	// Store error.
+	s.closeError = e
+
+	// Start the closing handshake
+	b, _ := e.ToBytes()
+	return s.WriteMessage(OpcodeClose, b)
+}
+
+// validateClose returns an error if the status code ('c') can't be sent in a
+// close frame or if the reason ('r') is longer than MaxCloseReason bytes or is
+// not valid UTF-8.
+func validateClose(c int, r string) error {
+	if !closeCodeSendable(c) {
+		return errInvalidCloseCode
+	}
+
+	if len(r) > MaxCloseReason {
+		return errCloseReasonTooLong
+	}
+
+	if !utf8.ValidString(r) {
+		return errInvalidCloseReason
+	}
+	return nil
+}
+
+// WriteAndClose sends a final message with opcode 'o' and payload data 'p' and
+// initiates the closing handshake with the status code ('c') and reason ('r')
+// provided. No other frames are sent in between the message and the close
+// frame, which are flushed together. If the message can't be sent, the error
+// is returned without initiating the closing handshake. Like CloseWithCode, an
+// error is returned without writing anything if the status code can't be sent
+// or the reason is too long or isn't valid UTF-8.
+func (s *Socket) WriteAndClose(o int, p []byte, c int, r string) error {
+	if err := validateClose(c, r); err != nil {
+		return err
+	}
+
+	e := &CloseError{
+		Code:   c,
+		Reason: r,
+	}
+
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	if err := s.checkWriter(o); err != nil {
+		return err
+	}
+
+	s.batching = true
+
+	if err := s.writeFrame(s.messageFrame(o, p)); err != nil {
+		s.batching = false
+		return err
+	}
+
+	// Store error.
+	s.closeError = e
+
+	// Start the closing handshake
+	b, _ := e.ToBytes()
+	s.writeFrame(s.messageFrame(OpcodeClose, b))
+
+	s.batching = false
+	s.flush()
+
+	return nil
+}
+
+// CloseImmediately sends a close frame with the status code ('c') and reason
+// ('r') provided and closes the underlying tcp connection straight away,
+// without waiting for the connected endpoint to acknowledge it. This is meant
+// for endpoints which only write (i.e. are not listening for frames) and
+// therefore would never complete the closing handshake initiated by Close.
+func (s *Socket) CloseImmediately(c int, r string) {
+	e := &CloseError{
+		Code:   c,
+		Reason: r,
+	}
+
+	// Store error.
+	s.closeError = e
+
+	// Send close frame.
+	b, _ := e.ToBytes()
+	s.WriteMessage(OpcodeClose, b)
+
+	// Close tcp connection.
+	s.TCPClose()
+}
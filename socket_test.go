@@ -1,6 +1,22 @@
 package websocket
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -908,16 +924,3274 @@ func TestSocketWriteFromServer(t *testing.T) {
 }
 
 func TestSocketWriteWhenClosed(t *testing.T) {
-	s := &Socket{
-		writeMutex: &sync.Mutex{},
-	}
-	s.state = stateClosed
+	s := &Socket{}
+	s.storeState(stateClosed)
 
 	if err := s.WriteMessage(1, []byte("test")); err != ErrSocketClosed {
 		t.Errorf(`expected error "%s", but got "%v"`, ErrSocketClosed, err)
 	}
 }
 
+func TestSocketWriteWithoutConstructor(t *testing.T) {
+	b := &bytes.Buffer{}
+
+	s := &Socket{
+		buf:    bufio.NewReadWriter(nil, bufio.NewWriter(b)),
+		server: true,
+	}
+
+	if err := s.WriteMessage(OpcodeText, []byte("test")); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	if b.Len() != FrameSize(OpcodeText, 4, false) {
+		t.Errorf("expected frame to be written, but '%d' bytes were written", b.Len())
+	}
+}
+
 func adaptURL(u string) string {
 	return strings.Replace(u, "http://", "ws://", 1)
 }
+
+// newSocketPair creates a server and a client Socket instance connected with
+// each other over a loopback tcp connection.
+func newSocketPair(t *testing.T) (*Socket, *Socket) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	defer l.Close()
+
+	cc, err := net.Dial("tcp", l.Addr().String())
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	sc, err := l.Accept()
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	ss := newSocket(sc, bufio.NewReadWriter(bufio.NewReader(sc), bufio.NewWriter(sc)), true)
+	cs := newSocket(cc, bufio.NewReadWriter(bufio.NewReader(cc), bufio.NewWriter(cc)), false)
+
+	return ss, cs
+}
+
+func TestSocketDone(t *testing.T) {
+	done := make(chan bool)
+	timeout := time.NewTicker(time.Second * 2)
+
+	s, c := newSocketPair(t)
+	defer c.TCPClose()
+
+	// Background pinger which should stop once the socket is closed.
+	go func() {
+		p := time.NewTicker(time.Millisecond * 10)
+		defer p.Stop()
+
+		for {
+			select {
+			case <-p.C:
+				{
+					s.WriteMessage(OpcodePing, nil)
+				}
+			case <-s.Done():
+				{
+					done <- true
+					return
+				}
+			}
+		}
+	}()
+
+	// Close the underlying tcp connection without a write error being
+	// reported to the pinger.
+	s.TCPClose()
+
+	select {
+	case <-done:
+		{
+
+		}
+	case <-timeout.C:
+		{
+			t.Error("test case timed out")
+		}
+	}
+}
+
+func TestSocketWriteMessageMasked(t *testing.T) {
+	s, c := newSocketPair(t)
+	defer s.TCPClose()
+	defer c.TCPClose()
+
+	k := [4]byte{1, 2, 3, 4}
+
+	if err := c.WriteMessageMasked(OpcodeText, []byte("abc"), k); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	// Expected wire bytes: FIN + TEXT, MASK + LENGTH, MASKING KEY, MASKED
+	// PAYLOAD DATA.
+	e := []byte{129, 131, 1, 2, 3, 4, 'a' ^ 1, 'b' ^ 2, 'c' ^ 3}
+
+	b, err := readFromBuffer(s.buf.Reader, uint64(len(e)))
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	for i, v := range e {
+		if b[i] != v {
+			t.Fatalf("expected wire bytes to be '%v' but they are '%v'", e, b)
+		}
+	}
+
+	if err := s.WriteMessageMasked(OpcodeText, []byte("abc"), k); err == nil {
+		t.Error("expected an error when a server endpoint sends masked frames")
+	}
+}
+
+func TestSocketWriteMessageControl(t *testing.T) {
+	type testCase struct {
+		o int
+		l int
+		v bool
+	}
+
+	testCases := []testCase{
+		{o: OpcodeText, l: MaxControlFramePayload + 1, v: true},
+		{o: OpcodePing, l: MaxControlFramePayload, v: true},
+		{o: OpcodePing, l: MaxControlFramePayload + 1, v: false},
+		{o: OpcodePong, l: MaxControlFramePayload + 1, v: false},
+		{o: OpcodeClose, l: MaxControlFramePayload + 1, v: false},
+	}
+
+	for i, c := range testCases {
+		b := &bytes.Buffer{}
+		s := newSocket(nil, bufio.NewReadWriter(nil, bufio.NewWriter(b)), true)
+
+		err := s.WriteMessage(c.o, make([]byte, c.l))
+
+		if c.v && err != nil {
+			t.Errorf("test case %d: unexpected error returned %v", i, err)
+		}
+
+		if !c.v && err == nil {
+			t.Errorf("test case %d: expected an error to be returned", i)
+		}
+
+		if !c.v && b.Len() != 0 {
+			t.Errorf("test case %d: expected frame not to be sent", i)
+		}
+	}
+}
+
+func TestSocketReadEOFAtFrameBoundary(t *testing.T) {
+	done := make(chan bool)
+	timeout := time.NewTicker(time.Second * 2)
+
+	s, c := newSocketPair(t)
+
+	n := 0
+
+	s.ReadHandler = func(o int, p []byte) {
+		n++
+	}
+
+	s.CloseHandler = func(err error) {
+		if n != 1 {
+			t.Errorf("expected read handler to be invoked '1' time but it was invoked '%d' times", n)
+		}
+
+		if e, k := err.(*CloseError); k {
+			if e.Code != CloseAbnormalClosure {
+				t.Errorf("expected Close Error Code to be '%d', but it is '%d'", CloseAbnormalClosure, e.Code)
+			}
+		} else {
+			t.Errorf("expected error instance to be of type *CloseError")
+		}
+
+		done <- true
+	}
+
+	go s.Listen()
+
+	if err := c.WriteMessage(OpcodeText, []byte("expected payload")); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	// Terminate the tcp connection right after the frame, without initiating
+	// the closing handshake.
+	c.conn.Close()
+
+	select {
+	case <-done:
+		{
+
+		}
+	case <-timeout.C:
+		{
+			t.Error("test case timed out")
+		}
+	}
+}
+
+func TestSocketReadEOFWithinFrame(t *testing.T) {
+	done := make(chan bool)
+	timeout := time.NewTicker(time.Second * 2)
+
+	s, c := newSocketPair(t)
+
+	s.ReadHandler = func(o int, p []byte) {
+		t.Error("expected read handler not to be invoked for a partial frame")
+	}
+
+	s.CloseHandler = func(err error) {
+		if e, k := err.(*CloseError); !k || e.Code != CloseAbnormalClosure {
+			t.Errorf("expected abnormal closure but got '%v'", err)
+		}
+
+		done <- true
+	}
+
+	go s.Listen()
+
+	f := &frame{
+		fin:     true,
+		opcode:  OpcodeText,
+		key:     []byte{1, 1, 1, 1},
+		payload: []byte("expected payload"),
+	}
+
+	b, err := f.toBytes()
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	// Send only part of the frame before terminating the tcp connection.
+	c.conn.Write(b[:len(b)-4])
+	c.conn.Close()
+
+	select {
+	case <-done:
+		{
+
+		}
+	case <-timeout.C:
+		{
+			t.Error("test case timed out")
+		}
+	}
+}
+
+func TestSocketBuffered(t *testing.T) {
+	s, c := newSocketPair(t)
+	defer s.TCPClose()
+	defer c.TCPClose()
+
+	if n := s.Buffered(); n != 0 {
+		t.Errorf("expected '0' buffered bytes but there are '%d'", n)
+	}
+
+	// Send two frames at once so that the second one is left buffered once
+	// the first one is parsed.
+	f := &frame{
+		fin:     true,
+		opcode:  OpcodeText,
+		key:     []byte{1, 1, 1, 1},
+		payload: []byte("expected payload"),
+	}
+
+	b, err := f.toBytes()
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	c.buf.Write(append(b, b...))
+	if err := c.buf.Flush(); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	if _, err := newFrame(s.buf.Reader); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	// Wait for the second frame to be available in case it was not received
+	// together with the first one.
+	if _, err := s.buf.Reader.Peek(len(b)); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	if n := s.Buffered(); n != len(b) {
+		t.Errorf("expected '%d' buffered bytes but there are '%d'", len(b), n)
+	}
+}
+
+func TestSocketCloseImmediately(t *testing.T) {
+	s, c := newSocketPair(t)
+	defer c.TCPClose()
+
+	// Note that the server socket is not listening for frames.
+	s.CloseImmediately(CloseGoingAway, "going away")
+
+	select {
+	case <-s.Done():
+		{
+
+		}
+	default:
+		{
+			t.Fatal("expected tcp connection to be closed")
+		}
+	}
+
+	f, err := newFrame(c.buf.Reader)
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	if f.opcode != OpcodeClose {
+		t.Fatalf("expected opcode to be '%d' but it is '%d'", OpcodeClose, f.opcode)
+	}
+
+	e, err := NewCloseError(f.payload)
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	if e.Code != CloseGoingAway {
+		t.Errorf("expected Close Error Code to be '%d', but it is '%d'", CloseGoingAway, e.Code)
+	}
+
+	// No further data should be received since the connection is closed.
+	if _, err := newFrame(c.buf.Reader); err != io.EOF {
+		t.Errorf("expected error to be '%v' but it is '%v'", io.EOF, err)
+	}
+}
+
+func TestSocketReadCloseFrameInvalidReason(t *testing.T) {
+	type testCase struct {
+		r []byte
+	}
+
+	testCases := []testCase{
+		// Structurally invalid bytes.
+		{r: []byte{0xff, 0xfe}},
+		// Overlong encoding of '/'.
+		{r: []byte{0xc0, 0xaf}},
+		// CESU-8 style encoding of the surrogate code point U+D800.
+		{r: []byte{0xed, 0xa0, 0x80}},
+	}
+
+	for i, tc := range testCases {
+		done := make(chan bool)
+		timeout := time.NewTicker(time.Second * 2)
+
+		s, c := newSocketPair(t)
+
+		s.CloseHandler = func(err error) {
+			if e, k := err.(*CloseError); k {
+				if e.Code != CloseGoingAway {
+					t.Errorf("test case %d: expected Close Error Code to be '%d', but it is '%d'", i, CloseGoingAway, e.Code)
+				}
+			} else {
+				t.Errorf("test case %d: expected error instance to be of type *CloseError", i)
+			}
+
+			done <- true
+		}
+
+		go s.Listen()
+
+		// Close frame with a valid status code but an invalid UTF-8 reason.
+		if err := c.WriteMessage(OpcodeClose, append([]byte{3, 233}, tc.r...)); err != nil {
+			t.Fatal("unexpected error returned", err)
+		}
+
+		f, err := newFrame(c.buf.Reader)
+
+		if err != nil {
+			t.Fatal("unexpected error returned", err)
+		}
+
+		e, err := NewCloseError(f.payload)
+
+		if err != nil {
+			t.Fatal("unexpected error returned", err)
+		}
+
+		if e.Code != CloseInvalidFramePayloadData {
+			t.Errorf("test case %d: expected acknowledgement Close Error Code to be '%d', but it is '%d'", i, CloseInvalidFramePayloadData, e.Code)
+		}
+
+		select {
+		case <-done:
+			{
+
+			}
+		case <-timeout.C:
+			{
+				t.Errorf("test case %d: timed out", i)
+			}
+		}
+
+		timeout.Stop()
+		c.TCPClose()
+	}
+}
+
+func TestSocketTCPCloseDeliversCloseFrame(t *testing.T) {
+	s, c := newSocketPair(t)
+	defer c.TCPClose()
+
+	// Fill the receiving side of the server endpoint with data it won't read,
+	// which would otherwise cause closing the connection to reset it.
+	f := &frame{
+		fin:     true,
+		opcode:  OpcodeBinary,
+		key:     []byte{1, 1, 1, 1},
+		payload: make([]byte, 1<<18),
+	}
+
+	b, err := f.toBytes()
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	if _, err := c.conn.Write(b); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	// Queue a close frame without flushing it and close promptly.
+	e := &CloseError{Code: CloseGoingAway, Reason: "going away"}
+	p, _ := e.ToBytes()
+
+	b, err = (&frame{fin: true, opcode: OpcodeClose, payload: p}).toBytes()
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	s.buf.Write(b)
+	s.TCPClose()
+
+	f, err = newFrame(c.buf.Reader)
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	e, err = NewCloseError(f.payload)
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	if e.Code != CloseGoingAway {
+		t.Errorf("expected Close Error Code to be '%d', but it is '%d'", CloseGoingAway, e.Code)
+	}
+}
+
+func TestSocketTCPCloseConcurrentWrites(t *testing.T) {
+	s, c := newSocketPair(t)
+
+	// The client endpoint is closed once the server endpoint closes the
+	// connection.
+	l := make(chan bool)
+
+	go func() {
+		c.ListenControlOnly()
+		close(l)
+	}()
+
+	var wg sync.WaitGroup
+
+	// Keep on writing until the socket is closed, so that the buffered frames
+	// flushed by TCPClose race with the ones being written.
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for {
+				if err := s.WriteMessage(OpcodeBinary, make([]byte, 512)); err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	time.Sleep(time.Millisecond * 20)
+
+	s.TCPClose()
+	wg.Wait()
+
+	select {
+	case <-l:
+	case <-time.After(time.Second * 2):
+		t.Error("expected client endpoint to be closed")
+	}
+}
+
+func TestSocketTCPCloseStuckWriter(t *testing.T) {
+	s, c := newSocketPair(t)
+	defer c.TCPClose()
+
+	s.IdleTimeout = time.Millisecond * 200
+
+	// The client endpoint never reads, so the writer eventually blocks.
+	go func() {
+		for {
+			if err := s.WriteMessage(OpcodeBinary, make([]byte, 65536)); err != nil {
+				return
+			}
+		}
+	}()
+
+	l := make(chan bool)
+
+	go func() {
+		s.Listen()
+		close(l)
+	}()
+
+	// The idle timeout must close the connection even though a write is
+	// blocked.
+	select {
+	case <-l:
+	case <-time.After(time.Second * 2):
+		t.Error("expected server endpoint to stop listening")
+	}
+}
+
+func TestSocketListenControlOnly(t *testing.T) {
+	payload := "expected payload"
+
+	done := make(chan bool)
+	timeout := time.NewTicker(time.Second * 2)
+
+	s, c := newSocketPair(t)
+	defer s.TCPClose()
+	defer c.TCPClose()
+
+	s.ReadHandler = func(o int, p []byte) {
+		t.Error("expected read handler not to be invoked")
+	}
+
+	go s.ListenControlOnly()
+
+	c.PongHandler = func(p []byte) {
+		if string(p) != payload {
+			t.Errorf(`expected payload to be "%s" but it is "%s"`, payload, p)
+		}
+
+		done <- true
+	}
+
+	go c.Listen()
+
+	// Data frames should be discarded while pings replied to.
+	if err := c.WriteMessage(OpcodeText, []byte("discarded")); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	if err := c.WriteMessage(OpcodePing, []byte(payload)); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	select {
+	case <-done:
+		{
+
+		}
+	case <-timeout.C:
+		{
+			t.Error("test case timed out")
+		}
+	}
+}
+
+func TestSocketReadInvalidFrameWhileClosing(t *testing.T) {
+	done := make(chan bool)
+	timeout := time.NewTicker(time.Second * 2)
+
+	s, c := newSocketPair(t)
+	defer c.TCPClose()
+
+	n := 0
+
+	s.ReadHandler = func(o int, p []byte) {
+		t.Error("expected read handler not to be invoked")
+	}
+
+	s.CloseHandler = func(err error) {
+		n++
+
+		if e, k := err.(*CloseError); !k || e.Code != CloseNormalClosure {
+			t.Errorf("expected normal closure but got '%v'", err)
+		}
+
+		done <- true
+	}
+
+	go s.Listen()
+
+	s.Close()
+
+	// Send an unmasked data frame to the server endpoint, violating the
+	// masking rules, after the closing handshake has been initiated.
+	b, err := (&frame{fin: true, opcode: OpcodeText, payload: []byte("invalid")}).toBytes()
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	if _, err := c.conn.Write(b); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	// Only the close frame initiating the closing handshake is expected.
+	f, err := newFrame(c.buf.Reader)
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	if f.opcode != OpcodeClose {
+		t.Fatalf("expected opcode to be '%d' but it is '%d'", OpcodeClose, f.opcode)
+	}
+
+	// Acknowledge the close frame.
+	if err := c.WriteMessage(OpcodeClose, f.payload[:2]); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	select {
+	case <-done:
+		{
+
+		}
+	case <-timeout.C:
+		{
+			t.Fatal("test case timed out")
+		}
+	}
+
+	if _, err := newFrame(c.buf.Reader); err != io.EOF {
+		t.Errorf("expected error to be '%v' but it is '%v'", io.EOF, err)
+	}
+
+	if n != 1 {
+		t.Errorf("expected close handler to be invoked '1' time but it was invoked '%d' times", n)
+	}
+}
+
+func TestSocketSetLinger(t *testing.T) {
+	s, c := newSocketPair(t)
+	defer s.TCPClose()
+	defer c.TCPClose()
+
+	if err := s.SetLinger(1); err != nil {
+		t.Error("unexpected error returned", err)
+	}
+
+	// Sockets which are not backed by a tcp connection.
+	p, q := net.Pipe()
+	defer p.Close()
+	defer q.Close()
+
+	n := newSocket(p, bufio.NewReadWriter(bufio.NewReader(p), bufio.NewWriter(p)), true)
+
+	if err := n.SetLinger(1); err != ErrNotTCPConn {
+		t.Errorf(`expected error "%v", but got "%v"`, ErrNotTCPConn, err)
+	}
+}
+
+func TestSocketReadHandlerTimeout(t *testing.T) {
+	done := make(chan bool)
+	timeout := time.NewTicker(time.Second * 2)
+
+	s, c := newSocketPair(t)
+	defer s.TCPClose()
+	defer c.TCPClose()
+
+	release := make(chan bool)
+
+	s.ReadHandlerTimeout = time.Millisecond * 50
+
+	s.ReadHandler = func(o int, p []byte) {
+		<-release
+	}
+
+	s.ReadHandlerTimeoutHandler = func(o int, p []byte) {
+		if o != OpcodeText {
+			t.Errorf("expected opcode to be '%d' but it is '%d'", OpcodeText, o)
+		}
+
+		close(release)
+		done <- true
+	}
+
+	go s.Listen()
+
+	if err := c.WriteMessage(OpcodeText, []byte("expected payload")); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	select {
+	case <-done:
+		{
+
+		}
+	case <-timeout.C:
+		{
+			t.Error("test case timed out")
+		}
+	}
+}
+
+func TestSocketReadHandlerTimeoutDefault(t *testing.T) {
+	s, c := newSocketPair(t)
+	defer s.TCPClose()
+	defer c.TCPClose()
+
+	release := make(chan bool)
+	defer close(release)
+
+	s.ReadHandlerTimeout = time.Millisecond * 50
+
+	s.ReadHandler = func(o int, p []byte) {
+		<-release
+	}
+
+	go s.Listen()
+
+	if err := c.WriteMessage(OpcodeText, []byte("expected payload")); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	c.SetReadDeadline(time.Now().Add(time.Second * 2))
+
+	f, err := newFrame(c.buf.Reader)
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	e, err := NewCloseError(f.payload)
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	if e.Code != CloseInternalServerErr {
+		t.Errorf("expected Close Error Code to be '%d', but it is '%d'", CloseInternalServerErr, e.Code)
+	}
+}
+
+func TestSocketUnderlyingBuffer(t *testing.T) {
+	s, c := newSocketPair(t)
+	defer s.TCPClose()
+	defer c.TCPClose()
+
+	if b := s.UnderlyingBuffer(); b != s.buf {
+		t.Error("expected underlying buffer to be the buffer of the socket instance")
+	}
+}
+
+func TestSocketNetConn(t *testing.T) {
+	s, c := newSocketPair(t)
+	defer s.TCPClose()
+	defer c.TCPClose()
+
+	if n := s.NetConn(); n != s.conn {
+		t.Error("expected connection to be the underlying connection of the socket instance")
+	}
+
+	// The address of each endpoint is the remote address of the other.
+	if s.RemoteAddr().String() != c.LocalAddr().String() {
+		t.Errorf(`expected remote address to be "%s", but it is "%s"`, c.LocalAddr(), s.RemoteAddr())
+	}
+
+	if s.LocalAddr().String() != c.RemoteAddr().String() {
+		t.Errorf(`expected local address to be "%s", but it is "%s"`, c.RemoteAddr(), s.LocalAddr())
+	}
+}
+
+func TestSocketReadHello(t *testing.T) {
+	payload := "expected payload"
+
+	done := make(chan bool)
+	timeout := time.NewTicker(time.Second * 2)
+
+	s, c := newSocketPair(t)
+	defer s.TCPClose()
+	defer c.TCPClose()
+
+	if err := c.WriteMessage(OpcodeBinary, []byte(`{"user":"one"}`)); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	if err := c.WriteMessage(OpcodeText, []byte(payload)); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	var v struct {
+		User string `json:"user"`
+	}
+
+	if err := s.ReadHello(&v); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	if v.User != "one" {
+		t.Errorf(`expected user to be "one" but it is "%s"`, v.User)
+	}
+
+	// Switch to the read handler for the following messages.
+	s.ReadHandler = func(o int, p []byte) {
+		if string(p) != payload {
+			t.Errorf(`expected payload to be "%s" but it is "%s"`, payload, p)
+		}
+
+		done <- true
+	}
+
+	go s.Listen()
+
+	select {
+	case <-done:
+		{
+
+		}
+	case <-timeout.C:
+		{
+			t.Error("test case timed out")
+		}
+	}
+}
+
+func TestSocketReadHelloFragmented(t *testing.T) {
+	s, c := newSocketPair(t)
+	defer s.TCPClose()
+	defer c.TCPClose()
+
+	// Control frames received beforehand are handled.
+	if err := c.WriteMessage(OpcodePing, []byte("ping")); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	r := io.MultiReader(strings.NewReader(`{"user":`), strings.NewReader(`"one"}`))
+
+	if _, err := c.WriteFrom(OpcodeText, r); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	var v struct {
+		User string `json:"user"`
+	}
+
+	if err := s.ReadHello(&v); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	if v.User != "one" {
+		t.Errorf(`expected user to be "one" but it is "%s"`, v.User)
+	}
+
+	c.SetReadDeadline(time.Now().Add(time.Second * 2))
+
+	if f, err := newFrame(c.buf.Reader); err != nil || f.opcode != OpcodePong {
+		t.Error("expected ping frame to be replied to", err)
+	}
+}
+
+func TestSocketConcurrentWrites(t *testing.T) {
+	s, c := newSocketPair(t)
+	defer s.TCPClose()
+	defer c.TCPClose()
+
+	// Server endpoint replies to pings automatically while listening.
+	go s.Listen()
+
+	pings := 50
+	writers := 5
+	messages := 10
+
+	go func() {
+		for i := 0; i < pings; i++ {
+			c.WriteMessage(OpcodePing, []byte("ping"))
+		}
+	}()
+
+	for w := 0; w < writers; w++ {
+		go func(w int) {
+			p := []byte(strings.Repeat(string(rune('a'+w)), 20000))
+
+			for i := 0; i < messages; i++ {
+				s.WriteMessage(OpcodeBinary, p)
+			}
+		}(w)
+	}
+
+	c.SetReadDeadline(time.Now().Add(time.Second * 4))
+
+	// Read all the frames expected from the wire before parsing them.
+	l := pings*FrameSize(OpcodePong, 4, false) + writers*messages*FrameSize(OpcodeBinary, 20000, false)
+	b := make([]byte, l)
+
+	if _, err := io.ReadFull(c.buf.Reader, b); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	r := bufio.NewReaderSize(bytes.NewReader(b), l)
+	n := map[int]int{}
+
+	for i := 0; i < pings+writers*messages; i++ {
+		f, err := newFrame(r)
+
+		if err != nil {
+			t.Fatal("unexpected error returned", err)
+		}
+
+		n[f.opcode]++
+
+		switch f.opcode {
+		case OpcodePong:
+			{
+				if string(f.payload) != "ping" {
+					t.Fatalf(`expected pong payload to be "ping" but it is "%s"`, f.payload)
+				}
+			}
+		case OpcodeBinary:
+			{
+				if len(f.payload) != 20000 || strings.Trim(string(f.payload), string(f.payload[:1])) != "" {
+					t.Fatal("expected payload data not to be interleaved with other frames")
+				}
+			}
+		default:
+			{
+				t.Fatalf("unexpected opcode '%d'", f.opcode)
+			}
+		}
+	}
+
+	if n[OpcodePong] != pings || n[OpcodeBinary] != writers*messages {
+		t.Errorf("unexpected number of frames received '%v'", n)
+	}
+}
+
+func TestSocketCloseRightAfterUpgrade(t *testing.T) {
+	done := make(chan bool)
+	timeout := time.NewTicker(time.Second * 2)
+
+	h := func(w http.ResponseWriter, r *http.Request) {
+		q := Request{}
+		s, err := q.Upgrade(w, r)
+
+		if err != nil {
+			t.Error("unexpected error was returned", err)
+			return
+		}
+
+		// Close straight away, before the client starts listening.
+		s.CloseWithError(&CloseError{
+			Code:   CloseGoingAway,
+			Reason: "capacity exceeded",
+		})
+
+		s.Listen()
+	}
+
+	s := httptest.NewServer(http.HandlerFunc(h))
+	defer s.Close()
+
+	d := &Dialer{}
+	c, _, err := d.Dial(adaptURL(s.URL))
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	defer c.TCPClose()
+
+	c.ReadHandler = func(o int, p []byte) {
+		t.Error("expected read handler not to be invoked")
+	}
+
+	c.CloseHandler = func(err error) {
+		if e, k := err.(*CloseError); k {
+			if e.Code != CloseGoingAway {
+				t.Errorf("expected Close Error Code to be '%d', but it is '%d'", CloseGoingAway, e.Code)
+			}
+
+			if e.Reason != "capacity exceeded" {
+				t.Errorf(`expected Close Error Reason to be "capacity exceeded", but it is "%s"`, e.Reason)
+			}
+		} else {
+			t.Errorf("expected error instance to be of type *CloseError")
+		}
+		done <- true
+	}
+
+	// Give the server endpoint the chance to send the close frame before the
+	// client endpoint starts listening.
+	time.Sleep(time.Millisecond * 50)
+
+	go c.Listen()
+
+	select {
+	case <-done:
+		{
+
+		}
+	case <-timeout.C:
+		{
+			t.Error("test case timed out")
+		}
+	}
+}
+
+func TestSocketCopyPayload(t *testing.T) {
+	type testCase struct {
+		c bool
+		e string
+	}
+
+	testCases := []testCase{
+		{c: true, e: "expected payload"},
+		{c: false, e: "clobberedpayload"},
+	}
+
+	for i, c := range testCases {
+		s, n := newSocketPair(t)
+
+		var r []byte
+
+		s.CopyPayload = c.c
+		s.ReadHandler = func(o int, p []byte) {
+			// Retain payload data.
+			r = p
+		}
+
+		p := []byte("expected payload")
+		s.callReadHandler(OpcodeText, p)
+
+		// Reuse the slice provided to the read handler.
+		copy(p, "clobbered")
+
+		if string(r) != c.e {
+			t.Errorf(`test case %d: expected retained payload to be "%s", but it is "%s"`, i, c.e, r)
+		}
+
+		s.TCPClose()
+		n.TCPClose()
+	}
+
+	if s := newSocket(nil, nil, true); !s.CopyPayload {
+		t.Error("expected payload data to be copied by default")
+	}
+}
+
+func TestSocketCall(t *testing.T) {
+	s, c := newSocketPair(t)
+	defer s.TCPClose()
+	defer c.TCPClose()
+
+	// Echo server.
+	s.ReadHandler = func(o int, p []byte) {
+		s.WriteMessage(o, p)
+	}
+
+	go s.Listen()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+
+	for _, e := range []string{"first", "second"} {
+		p, err := c.Call(ctx, OpcodeText, []byte(e))
+
+		if err != nil {
+			t.Fatal("unexpected error returned", err)
+		}
+
+		if string(p) != e {
+			t.Errorf(`expected reply to be "%s", but it is "%s"`, e, p)
+		}
+	}
+}
+
+func TestSocketCallTimeout(t *testing.T) {
+	s, c := newSocketPair(t)
+	defer s.TCPClose()
+	defer c.TCPClose()
+
+	// Server which never replies.
+	go s.Listen()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+
+	if _, err := c.Call(ctx, OpcodeText, []byte("hello")); err != context.DeadlineExceeded {
+		t.Errorf(`expected error "%v" but got "%v"`, context.DeadlineExceeded, err)
+	}
+}
+
+func TestSocketCallReadDeadline(t *testing.T) {
+	s, c := newSocketPair(t)
+	defer s.TCPClose()
+	defer c.TCPClose()
+
+	// Echo server.
+	s.ReadHandler = func(o int, p []byte) {
+		s.WriteMessage(o, p)
+	}
+
+	go s.Listen()
+
+	d := time.Now().Add(time.Minute)
+	c.SetReadDeadline(d)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+
+	if _, err := c.Call(ctx, OpcodeText, []byte("hello")); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	if !c.readDeadline.Equal(d) {
+		t.Errorf("expected read deadline to be restored to '%v', but it is '%v'", d, c.readDeadline)
+	}
+
+	if _, _, err := c.ReadMessageTimeout(time.Millisecond * 50); err == nil {
+		t.Fatal("expected an error to be returned")
+	}
+
+	if !c.readDeadline.Equal(d) {
+		t.Errorf("expected read deadline to be restored to '%v', but it is '%v'", d, c.readDeadline)
+	}
+}
+
+func TestSocketWriteFrom(t *testing.T) {
+	type testCase struct {
+		r io.Reader
+		p string
+		l int
+	}
+
+	testCases := []testCase{
+		// Data read in multiple reads.
+		{r: io.MultiReader(strings.NewReader("hello "), strings.NewReader("world")), p: "hello world", l: 3},
+		// Data larger than a single fragment.
+		{r: strings.NewReader(strings.Repeat("a", writeFromChunkSize+10)), p: strings.Repeat("a", writeFromChunkSize+10), l: 3},
+		// No data at all.
+		{r: strings.NewReader(""), p: "", l: 1},
+	}
+
+	for i, c := range testCases {
+		b := &bytes.Buffer{}
+		s := newSocket(nil, bufio.NewReadWriter(nil, bufio.NewWriter(b)), true)
+
+		n, err := s.WriteFrom(OpcodeText, c.r)
+
+		if err != nil {
+			t.Fatalf("test case %d: unexpected error returned %v", i, err)
+		}
+
+		if n != int64(len(c.p)) {
+			t.Errorf("test case %d: expected '%d' bytes to be sent, but '%d' were sent", i, len(c.p), n)
+		}
+
+		r := bufio.NewReaderSize(bytes.NewReader(b.Bytes()), b.Len()+16)
+
+		var p []byte
+
+		for l := 0; l < c.l; l++ {
+			f, err := newFrame(r)
+
+			if err != nil {
+				t.Fatalf("test case %d: unexpected error returned %v", i, err)
+			}
+
+			o := OpcodeContinuation
+			if l == 0 {
+				o = OpcodeText
+			}
+
+			if f.opcode != o {
+				t.Errorf("test case %d: expected frame %d opcode to be '%d', but it is '%d'", i, l, o, f.opcode)
+			}
+
+			if f.fin != (l == c.l-1) {
+				t.Errorf("test case %d: unexpected FIN bit on frame %d", i, l)
+			}
+
+			p = append(p, f.payload...)
+		}
+
+		if string(p) != c.p {
+			t.Errorf("test case %d: unexpected message payload data", i)
+		}
+
+		if r.Buffered() != 0 {
+			t.Errorf("test case %d: expected no more frames to be sent", i)
+		}
+	}
+}
+
+func TestSocketWriteFromReadError(t *testing.T) {
+	e := errors.New("read failure")
+
+	b := &bytes.Buffer{}
+	s := newSocket(nil, bufio.NewReadWriter(nil, bufio.NewWriter(b)), true)
+
+	r := io.MultiReader(strings.NewReader("partial"), &errorReader{err: e})
+
+	if _, err := s.WriteFrom(OpcodeText, r); err != e {
+		t.Errorf(`expected error "%v" but got "%v"`, e, err)
+	}
+
+	q := bufio.NewReaderSize(bytes.NewReader(b.Bytes()), b.Len()+16)
+
+	if f, err := newFrame(q); err != nil || f.fin {
+		t.Fatal("expected first fragment of the message to be sent", err)
+	}
+
+	// The message is aborted by failing the connection.
+	f, err := newFrame(q)
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	if f.opcode != OpcodeClose {
+		t.Fatalf("expected a close frame to be sent, but got opcode '%d'", f.opcode)
+	}
+
+	c, _ := NewCloseError(f.payload)
+
+	if c.Code != CloseInternalServerErr {
+		t.Errorf("expected Close Error Code to be '%d', but it is '%d'", CloseInternalServerErr, c.Code)
+	}
+}
+
+func TestSocketWriteFromInvalid(t *testing.T) {
+	type testCase struct {
+		o int
+		r io.Reader
+		e error
+		c bool
+	}
+
+	testCases := []testCase{
+		// Control frames can't be fragmented.
+		{o: OpcodePing, r: strings.NewReader("hello")},
+		{o: OpcodeContinuation, r: strings.NewReader("hello")},
+		// Readers which never make progress.
+		{o: OpcodeText, r: &errorReader{}, e: io.ErrNoProgress},
+		{o: OpcodeText, r: io.MultiReader(strings.NewReader("partial"), &errorReader{}), e: io.ErrNoProgress, c: true},
+	}
+
+	for i, c := range testCases {
+		b := &bytes.Buffer{}
+		s := newSocket(nil, bufio.NewReadWriter(nil, bufio.NewWriter(b)), true)
+
+		_, err := s.WriteFrom(c.o, c.r)
+
+		if err == nil || c.e != nil && err != c.e {
+			t.Errorf(`test case %d: expected error "%v" but got "%v"`, i, c.e, err)
+		}
+
+		q := bufio.NewReaderSize(bytes.NewReader(b.Bytes()), b.Len()+16)
+
+		if !c.c {
+			if b.Len() != 0 {
+				t.Errorf("test case %d: expected no frames to be sent", i)
+			}
+			continue
+		}
+
+		// A message which has already been started is aborted by failing the
+		// connection.
+		if f, err := newFrame(q); err != nil || f.fin {
+			t.Fatalf("test case %d: expected first fragment of the message to be sent %v", i, err)
+		}
+
+		if f, err := newFrame(q); err != nil || f.opcode != OpcodeClose {
+			t.Errorf("test case %d: expected a close frame to be sent %v", i, err)
+		}
+	}
+}
+
+func TestSocketWriteFromSlowReader(t *testing.T) {
+	b := &bytes.Buffer{}
+	s := newSocket(nil, bufio.NewReadWriter(nil, bufio.NewWriter(b)), true)
+
+	r, w := io.Pipe()
+
+	done := make(chan error, 1)
+
+	go func() {
+		_, err := s.WriteFrom(OpcodeText, r)
+		done <- err
+	}()
+
+	// The first fragment has been sent once the second one is read, after
+	// which WriteFrom waits for more data.
+	w.Write([]byte("hello "))
+	w.Write([]byte("world"))
+
+	// Control frames can be sent while waiting, unlike data frames.
+	c := make(chan error, 1)
+
+	go func() {
+		c <- s.WriteMessage(OpcodePing, nil)
+	}()
+
+	select {
+	case err := <-c:
+		if err != nil {
+			t.Fatal("unexpected error returned", err)
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatal("expected ping frame to be sent while waiting for the reader")
+	}
+
+	if err := s.WriteMessage(OpcodeText, []byte("other")); err != ErrWriterOpen {
+		t.Errorf(`expected error "%v" but got "%v"`, ErrWriterOpen, err)
+	}
+
+	w.Close()
+
+	if err := <-done; err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	q := bufio.NewReaderSize(bytes.NewReader(b.Bytes()), b.Len()+16)
+
+	// The ping frame is sent in between the fragments of the message.
+	var p []byte
+	k := false
+
+	for l := 0; ; l++ {
+		f, err := newFrame(q)
+
+		if err != nil {
+			t.Fatal("unexpected error returned", err)
+		}
+
+		if f.opcode == OpcodePing {
+			k = l > 0
+			continue
+		}
+
+		p = append(p, f.payload...)
+
+		if f.fin {
+			break
+		}
+	}
+
+	if !k {
+		t.Error("expected ping frame to be sent in between the fragments")
+	}
+
+	if string(p) != "hello world" {
+		t.Errorf(`expected message "hello world", but got "%s"`, p)
+	}
+}
+
+// errorReader is an io.Reader which always fails with the error provided (or
+// returns no data at all if there isn't one).
+type errorReader struct {
+	err error
+}
+
+func (r *errorReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+func TestSocketReadInto(t *testing.T) {
+	p := make([]byte, writeFromChunkSize*3+100)
+
+	for i := range p {
+		p[i] = byte(i)
+	}
+
+	// Large fragmented binary message sent by a client endpoint.
+	b := &bytes.Buffer{}
+	c := newSocket(nil, bufio.NewReadWriter(nil, bufio.NewWriter(b)), false)
+
+	if _, err := c.WriteFrom(OpcodeBinary, bytes.NewReader(p)); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	r := bufio.NewReaderSize(bytes.NewReader(b.Bytes()), b.Len()+16)
+	s := newSocket(nil, bufio.NewReadWriter(r, nil), true)
+
+	w := &bytes.Buffer{}
+
+	o, n, err := s.ReadInto(w)
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	if o != OpcodeBinary {
+		t.Errorf("expected opcode to be '%d', but it is '%d'", OpcodeBinary, o)
+	}
+
+	if n != int64(len(p)) {
+		t.Errorf("expected '%d' bytes to be read, but '%d' were read", len(p), n)
+	}
+
+	if !bytes.Equal(w.Bytes(), p) {
+		t.Error("unexpected message payload data")
+	}
+}
+
+func TestSocketCloseCompleted(t *testing.T) {
+	type testCase struct {
+		a bool
+		v bool
+	}
+
+	testCases := []testCase{
+		// Connected endpoint acknowledges the closure.
+		{a: true, v: true},
+		// Connection is lost while waiting for the acknowledgement.
+		{a: false, v: false},
+	}
+
+	for i, tc := range testCases {
+		done := make(chan bool)
+		timeout := time.NewTicker(time.Second * 2)
+
+		s, c := newSocketPair(t)
+
+		s.CloseHandler = func(err error) {
+			if e, k := err.(*CloseError); !k {
+				t.Errorf("test case %d: expected error instance to be of type *CloseError", i)
+			} else if e.Completed != tc.v {
+				t.Errorf("test case %d: expected Completed to be '%t'", i, tc.v)
+			}
+
+			done <- true
+		}
+
+		go s.Listen()
+
+		if tc.a {
+			go c.Listen()
+		} else {
+			// Discard the close frame and close the connection.
+			go func() {
+				newFrame(c.buf.Reader)
+				c.TCPClose()
+			}()
+		}
+
+		s.Close()
+
+		select {
+		case <-done:
+			{
+
+			}
+		case <-timeout.C:
+			{
+				t.Errorf("test case %d: timed out", i)
+			}
+		}
+
+		timeout.Stop()
+		c.TCPClose()
+	}
+}
+
+func TestSocketCloseSource(t *testing.T) {
+	type testCase struct {
+		p bool
+		s CloseSource
+	}
+
+	testCases := []testCase{
+		// Closure initiated by the connected endpoint.
+		{p: true, s: CloseSourcePeer},
+		// Closure initiated locally.
+		{p: false, s: CloseSourceLocal},
+	}
+
+	for i, tc := range testCases {
+		done := make(chan bool)
+		timeout := time.NewTicker(time.Second * 2)
+
+		s, c := newSocketPair(t)
+
+		s.CloseHandler = func(err error) {
+			if e, k := err.(*CloseError); !k {
+				t.Errorf("test case %d: expected error instance to be of type *CloseError", i)
+			} else if e.Source != tc.s {
+				t.Errorf(`test case %d: expected source to be "%s", but it is "%s"`, i, tc.s, e.Source)
+			}
+
+			done <- true
+		}
+
+		go s.Listen()
+		go c.Listen()
+
+		if tc.p {
+			c.Close()
+		} else {
+			s.Close()
+		}
+
+		select {
+		case <-done:
+			{
+
+			}
+		case <-timeout.C:
+			{
+				t.Errorf("test case %d: timed out", i)
+			}
+		}
+
+		timeout.Stop()
+		c.TCPClose()
+	}
+}
+
+func TestSocketCloseReplyCode(t *testing.T) {
+	done := make(chan bool)
+
+	s, c := newSocketPair(t)
+	defer s.TCPClose()
+
+	s.CloseReplyCode = func(p int) int {
+		if p != CloseNormalClosure {
+			t.Errorf("expected peer code to be '%d', but it is '%d'", CloseNormalClosure, p)
+		}
+
+		return CloseGoingAway
+	}
+
+	c.CloseHandler = func(err error) {
+		if e, k := err.(*CloseError); !k {
+			t.Error("expected error instance to be of type *CloseError")
+		} else if e.Code != CloseGoingAway {
+			t.Errorf("expected Close Error Code to be '%d', but it is '%d'", CloseGoingAway, e.Code)
+		}
+
+		done <- true
+	}
+
+	go s.Listen()
+	go c.Listen()
+
+	c.CloseWithError(&CloseError{Code: CloseNormalClosure})
+
+	select {
+	case <-done:
+		{
+
+		}
+	case <-time.After(time.Second * 2):
+		{
+			t.Error("timed out")
+		}
+	}
+}
+
+func TestSocketCloseReplyCodeInvalid(t *testing.T) {
+	// Status codes which can't be sent in a close frame.
+	for i, r := range []int{0, CloseNoStatusReceived, CloseAbnormalClosure, CloseTLSHandshake} {
+		done := make(chan bool)
+
+		s, c := newSocketPair(t)
+
+		s.CloseReplyCode = func(p int) int {
+			return r
+		}
+
+		// The status code received is echoed back instead.
+		c.CloseHandler = func(err error) {
+			if e, k := err.(*CloseError); !k {
+				t.Errorf("test case %d: expected error instance to be of type *CloseError", i)
+			} else if e.Code != CloseGoingAway {
+				t.Errorf("test case %d: expected Close Error Code to be '%d', but it is '%d'", i, CloseGoingAway, e.Code)
+			}
+
+			done <- true
+		}
+
+		go s.Listen()
+		go c.Listen()
+
+		c.CloseWithError(&CloseError{Code: CloseGoingAway})
+
+		select {
+		case <-done:
+			{
+
+			}
+		case <-time.After(time.Second * 2):
+			{
+				t.Errorf("test case %d: timed out", i)
+			}
+		}
+
+		s.TCPClose()
+	}
+}
+
+func TestSocketMaxReadRate(t *testing.T) {
+	s, c := newSocketPair(t)
+	defer s.TCPClose()
+	defer c.TCPClose()
+
+	s.MaxReadRate = 1000
+
+	r := make(chan time.Time, 2)
+
+	s.ReadHandler = func(o int, p []byte) {
+		r <- time.Now()
+	}
+
+	go s.Listen()
+
+	// The first message empties the bucket, therefore reading the second one
+	// must be delayed for the bucket to be refilled (200ms).
+	for _, l := range []int{1000, 200} {
+		if err := c.WriteMessage(OpcodeBinary, make([]byte, l)); err != nil {
+			t.Fatal("unexpected error returned", err)
+		}
+	}
+
+	a := <-r
+	b := <-r
+
+	if d := b.Sub(a); d < time.Millisecond*150 {
+		t.Errorf("expected reading of second message to be delayed, but it took '%v'", d)
+	}
+}
+
+func TestSocketMaxReadRateReadInto(t *testing.T) {
+	// Client endpoint sending the messages.
+	b := &bytes.Buffer{}
+	c := newSocket(nil, bufio.NewReadWriter(nil, bufio.NewWriter(b)), false)
+
+	for _, l := range []int{1000, 200} {
+		if err := c.WriteMessage(OpcodeBinary, make([]byte, l)); err != nil {
+			t.Fatal("unexpected error returned", err)
+		}
+	}
+
+	// Server endpoint reading the messages without listening.
+	r := bufio.NewReaderSize(bytes.NewReader(b.Bytes()), b.Len()+16)
+	s := newSocket(nil, bufio.NewReadWriter(r, nil), true)
+	s.MaxReadRate = 1000
+
+	a := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := s.ReadInto(&bytes.Buffer{}); err != nil {
+			t.Fatal("unexpected error returned", err)
+		}
+	}
+
+	if d := time.Since(a); d < time.Millisecond*150 {
+		t.Errorf("expected reading of second message to be delayed, but it took '%v'", d)
+	}
+}
+
+func TestSocketMaxReadRateClose(t *testing.T) {
+	s, c := newSocketPair(t)
+	defer s.TCPClose()
+	defer c.TCPClose()
+
+	s.MaxReadRate = 10
+	s.ReadRateClose = true
+
+	go s.Listen()
+
+	if err := c.WriteMessage(OpcodeBinary, make([]byte, 100)); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	c.SetReadDeadline(time.Now().Add(time.Second * 2))
+
+	f, err := newFrame(c.buf.Reader)
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	e, _ := NewCloseError(f.payload)
+
+	if e.Code != ClosePolicyViolation {
+		t.Errorf("expected Close Error Code to be '%d', but it is '%d'", ClosePolicyViolation, e.Code)
+	}
+}
+
+func TestSocketMaxReadRateDelay(t *testing.T) {
+	type testCase struct {
+		l int
+		c bool
+	}
+
+	testCases := []testCase{
+		// Frame which takes too long to be within the rate.
+		{l: 1000, c: true},
+		// Frame being waited for when the connection is aborted.
+		{l: 500, c: false},
+	}
+
+	for i, tc := range testCases {
+		s, c := newSocketPair(t)
+
+		s.MaxReadRate = 10
+
+		l := make(chan bool)
+
+		go func() {
+			s.Listen()
+			close(l)
+		}()
+
+		// Only the header of the frame is sent.
+		h := []byte{130 /* 10000010 */, 254 /* 11111110 */, byte(tc.l >> 8), byte(tc.l), 1, 2, 3, 4}
+
+		if _, err := c.conn.Write(h); err != nil {
+			t.Fatalf("test case %d: unexpected error returned %v", i, err)
+		}
+
+		if tc.c {
+			c.SetReadDeadline(time.Now().Add(time.Second * 2))
+
+			f, err := newFrame(c.buf.Reader)
+
+			if err != nil {
+				t.Fatalf("test case %d: unexpected error returned %v", i, err)
+			}
+
+			if e, _ := NewCloseError(f.payload); e.Code != ClosePolicyViolation {
+				t.Errorf("test case %d: expected Close Error Code to be '%d', but it is '%d'", i, ClosePolicyViolation, e.Code)
+			}
+		} else {
+			time.Sleep(time.Millisecond * 100)
+			s.Abort()
+		}
+
+		select {
+		case <-l:
+		case <-time.After(time.Second * 2):
+			t.Errorf("test case %d: expected server endpoint to stop listening", i)
+		}
+
+		s.TCPClose()
+		c.TCPClose()
+	}
+}
+
+func TestSocketStats(t *testing.T) {
+	// Client endpoint sending a masked frame.
+	b := &bytes.Buffer{}
+	c := newSocket(nil, bufio.NewReadWriter(nil, bufio.NewWriter(b)), false)
+
+	if err := c.WriteMessage(OpcodeBinary, make([]byte, 200)); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	// Server endpoint receiving the masked frame.
+	r := bufio.NewReaderSize(bytes.NewReader(b.Bytes()), b.Len()+16)
+	s := newSocket(nil, bufio.NewReadWriter(r, nil), true)
+
+	if _, _, err := s.ReadInto(&bytes.Buffer{}); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	w := c.Stats()
+	e := Stats{FramesWritten: 1, PayloadBytesWritten: 200, HeaderBytesWritten: 4, KeyBytesWritten: 4}
+
+	if w != e {
+		t.Errorf("expected stats of client endpoint to be '%+v', but it is '%+v'", e, w)
+	}
+
+	q := s.Stats()
+	e = Stats{FramesRead: 1, PayloadBytesRead: 200, HeaderBytesRead: 4, KeyBytesRead: 4}
+
+	if q != e {
+		t.Errorf("expected stats of server endpoint to be '%+v', but it is '%+v'", e, q)
+	}
+
+	// Overhead must match the bytes actually sent.
+	if n := int64(b.Len()); n != w.PayloadBytesWritten+w.HeaderBytesWritten+w.KeyBytesWritten {
+		t.Errorf("expected '%d' bytes to be accounted for", n)
+	}
+}
+
+func TestSocketAbort(t *testing.T) {
+	done := make(chan bool, 1)
+
+	s, c := newSocketPair(t)
+	defer c.TCPClose()
+
+	s.CloseHandler = func(err error) {
+		if e, k := err.(*CloseError); !k {
+			t.Errorf("expected error instance to be of type *CloseError")
+		} else if e.Code != CloseAbnormalClosure {
+			t.Errorf("expected Close Error Code to be '%d', but it is '%d'", CloseAbnormalClosure, e.Code)
+		}
+
+		done <- true
+	}
+
+	go s.Listen()
+
+	n := time.Now()
+	s.Abort()
+
+	if d := time.Since(n); d >= closeLinger {
+		t.Errorf("expected Abort() to close the connection immediately, but it took '%v'", d)
+	}
+
+	select {
+	case <-done:
+		{
+
+		}
+	default:
+		{
+			t.Error("expected close handler to be invoked")
+		}
+	}
+
+	// No close frame is sent to the connected endpoint.
+	c.SetReadDeadline(time.Now().Add(time.Second * 2))
+
+	if _, err := newFrame(c.buf.Reader); err == nil {
+		t.Error("expected an error to be returned")
+	}
+}
+
+func TestSocketWriteWhileClosing(t *testing.T) {
+	s, c := newSocketPair(t)
+	defer s.TCPClose()
+	defer c.TCPClose()
+
+	s.Close()
+
+	if err := s.WriteMessage(OpcodeText, []byte("too late")); err != ErrSocketClosing {
+		t.Errorf(`expected error "%v" but got "%v"`, ErrSocketClosing, err)
+	}
+
+	// Control frames can still be sent.
+	if err := s.WriteMessage(OpcodePing, nil); err != nil {
+		t.Error("unexpected error returned", err)
+	}
+}
+
+func TestSocketReadMessageTimeout(t *testing.T) {
+	s, c := newSocketPair(t)
+	defer s.TCPClose()
+	defer c.TCPClose()
+
+	// Nothing is sent in time.
+	_, _, err := c.ReadMessageTimeout(time.Millisecond * 50)
+
+	if e, k := err.(net.Error); !k || !e.Timeout() {
+		t.Fatalf("expected a timeout error but got '%v'", err)
+	}
+
+	// The connection stays open and later reads are not affected.
+	if err := s.WriteMessage(OpcodeText, []byte("expected payload")); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	time.Sleep(time.Millisecond * 100)
+
+	o, p, err := c.ReadMessageTimeout(time.Second * 2)
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	if o != OpcodeText || string(p) != "expected payload" {
+		t.Errorf(`expected text message "expected payload", but got '%d' "%s"`, o, p)
+	}
+}
+
+func TestSocketMessageHash(t *testing.T) {
+	done := make(chan bool)
+	timeout := time.NewTicker(time.Second * 2)
+
+	s, c := newSocketPair(t)
+	defer s.TCPClose()
+	defer c.TCPClose()
+
+	p := []byte("expected payload")
+	e := sha256.Sum256(p)
+
+	s.MessageHash = sha256.New
+
+	s.ReadHandler = func(o int, p []byte) {
+		if d := s.Digest(); !bytes.Equal(d, e[:]) {
+			t.Errorf("expected digest to be '%x', but it is '%x'", e, d)
+		}
+
+		done <- true
+	}
+
+	go s.Listen()
+
+	if err := c.WriteMessage(OpcodeText, p); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	select {
+	case <-done:
+		{
+
+		}
+	case <-timeout.C:
+		{
+			t.Error("test case timed out")
+		}
+	}
+}
+
+func TestSocketMessageHashFragmented(t *testing.T) {
+	p := make([]byte, writeFromChunkSize*2+10)
+
+	for i := range p {
+		p[i] = byte(i)
+	}
+
+	e := sha256.Sum256(p)
+
+	b := &bytes.Buffer{}
+	c := newSocket(nil, bufio.NewReadWriter(nil, bufio.NewWriter(b)), false)
+
+	if _, err := c.WriteFrom(OpcodeBinary, bytes.NewReader(p)); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	r := bufio.NewReaderSize(bytes.NewReader(b.Bytes()), b.Len()+16)
+	s := newSocket(nil, bufio.NewReadWriter(r, nil), true)
+	s.MessageHash = sha256.New
+
+	if _, _, err := s.ReadInto(ioutil.Discard); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	if d := s.Digest(); !bytes.Equal(d, e[:]) {
+		t.Errorf("expected digest to be '%x', but it is '%x'", e, d)
+	}
+}
+
+func TestSocketMessageHashFragmentedListen(t *testing.T) {
+	p := make([]byte, writeFromChunkSize*2+10)
+
+	for i := range p {
+		p[i] = byte(i)
+	}
+
+	e := sha256.Sum256(p)
+
+	done := make(chan []byte, 1)
+
+	s, c := newSocketPair(t)
+	defer s.TCPClose()
+	defer c.TCPClose()
+
+	s.MessageHash = sha256.New
+
+	s.ReadHandler = func(o int, p []byte) {
+		done <- s.Digest()
+	}
+
+	go s.Listen()
+
+	if _, err := c.WriteFrom(OpcodeBinary, bytes.NewReader(p)); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	select {
+	case d := <-done:
+		if !bytes.Equal(d, e[:]) {
+			t.Errorf("expected digest to be '%x', but it is '%x'", e, d)
+		}
+	case <-time.After(time.Second * 2):
+		t.Error("test case timed out")
+	}
+}
+
+func TestSocketStrictRSV(t *testing.T) {
+	type testCase struct {
+		s bool
+	}
+
+	testCases := []testCase{
+		// Frames with RSV bits set fail the connection.
+		{s: true},
+		// Frames with RSV bits set are logged and read.
+		{s: false},
+	}
+
+	for i, tc := range testCases {
+		done := make(chan bool, 1)
+
+		s, c := newSocketPair(t)
+
+		l := &bytes.Buffer{}
+
+		s.StrictRSV = tc.s
+		s.ErrorLog = log.New(l, "", 0)
+
+		s.ReadHandler = func(o int, p []byte) {
+			done <- true
+		}
+
+		go s.Listen()
+
+		f := &frame{
+			fin:     true,
+			opcode:  OpcodeText,
+			key:     []byte{1, 2, 3, 4},
+			payload: []byte("expected payload"),
+		}
+
+		b, err := f.toBytes()
+
+		if err != nil {
+			t.Fatal("unexpected error returned", err)
+		}
+
+		// Set RSV1.
+		b[0] |= 64 /* 01000000 */
+
+		if _, err := c.conn.Write(b); err != nil {
+			t.Fatal("unexpected error returned", err)
+		}
+
+		if tc.s {
+			c.SetReadDeadline(time.Now().Add(time.Second * 2))
+
+			f, err := newFrame(c.buf.Reader)
+
+			if err != nil {
+				t.Fatalf("test case %d: unexpected error returned %v", i, err)
+			}
+
+			if e, _ := NewCloseError(f.payload); e.Code != CloseProtocolError {
+				t.Errorf("test case %d: expected Close Error Code to be '%d', but it is '%d'", i, CloseProtocolError, e.Code)
+			}
+		} else {
+			select {
+			case <-done:
+				{
+					if !strings.Contains(l.String(), "RSV") {
+						t.Errorf("test case %d: expected a warning to be logged", i)
+					}
+				}
+			case <-time.After(time.Second * 2):
+				{
+					t.Errorf("test case %d: timed out", i)
+				}
+			}
+		}
+
+		s.TCPClose()
+		c.TCPClose()
+	}
+}
+
+// newCertificate generates a self-signed certificate for the purpose ('u')
+// provided.
+func newCertificate(t *testing.T, u x509.ExtKeyUsage) tls.Certificate {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	c := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "websocket test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{u},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	d, err := x509.CreateCertificate(rand.Reader, c, c, &k.PublicKey, k)
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	l, err := x509.ParseCertificate(d)
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{d}, PrivateKey: k, Leaf: l}
+}
+
+func TestSocketPeerCertificates(t *testing.T) {
+	sc := newCertificate(t, x509.ExtKeyUsageServerAuth)
+	cc := newCertificate(t, x509.ExtKeyUsageClientAuth)
+
+	p := x509.NewCertPool()
+	p.AddCert(cc.Leaf)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	defer l.Close()
+
+	// Client endpoint presenting its certificate.
+	go func() {
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+			Certificates:       []tls.Certificate{cc},
+			InsecureSkipVerify: true,
+		})
+
+		if err != nil {
+			t.Error("unexpected error returned", err)
+			return
+		}
+
+		defer conn.Close()
+
+		r, err := http.NewRequest("GET", "http://"+l.Addr().String()+"/", nil)
+
+		if err != nil {
+			t.Error("unexpected error returned", err)
+			return
+		}
+
+		makeRequestValid(r)
+		r.Write(conn)
+
+		http.ReadResponse(bufio.NewReader(conn), r)
+	}()
+
+	conn, err := l.Accept()
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	q := &Request{
+		CheckOrigin: func(r *http.Request) bool {
+			return true
+		},
+		HandshakeTimeout: time.Second * 2,
+	}
+
+	s, err := q.UpgradeConn(tls.Server(conn, &tls.Config{
+		Certificates: []tls.Certificate{sc},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    p,
+	}))
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	defer s.TCPClose()
+
+	c := s.PeerCertificates()
+
+	if len(c) != 1 || !c[0].Equal(cc.Leaf) {
+		t.Error("expected client certificate to be available")
+	}
+
+	// Sockets which are not backed by TLS have no peer certificates.
+	n, m := newSocketPair(t)
+	defer n.TCPClose()
+	defer m.TCPClose()
+
+	if c := n.PeerCertificates(); c != nil {
+		t.Errorf("expected no peer certificates, but got '%v'", c)
+	}
+}
+
+func TestSocketForward(t *testing.T) {
+	done := make(chan bool)
+	timeout := time.NewTicker(time.Second * 2)
+
+	// Server socket receiving the message.
+	s, c := newSocketPair(t)
+	defer s.TCPClose()
+	defer c.TCPClose()
+
+	// Client socket the message is forwarded through.
+	u, d := newSocketPair(t)
+	defer u.TCPClose()
+	defer d.TCPClose()
+
+	s.ReadHandler = Forward(d)
+
+	u.ReadHandler = func(o int, p []byte) {
+		if o != OpcodeBinary {
+			t.Errorf("expected opcode to be '%d', but it is '%d'", OpcodeBinary, o)
+		}
+
+		if string(p) != "expected payload" {
+			t.Errorf(`expected payload to be "expected payload", but it is "%s"`, p)
+		}
+
+		done <- true
+	}
+
+	// The upstream server socket fails the connection if the forwarded frame
+	// isn't masked. Closures are only expected once the message is received.
+	received := make(chan bool)
+
+	u.CloseHandler = func(err error) {
+		select {
+		case <-received:
+		default:
+			t.Error("unexpected closure", err)
+		}
+	}
+
+	go s.Listen()
+	go u.Listen()
+
+	if err := c.WriteMessage(OpcodeBinary, []byte("expected payload")); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	select {
+	case <-done:
+		{
+			close(received)
+		}
+	case <-timeout.C:
+		{
+			t.Error("test case timed out")
+		}
+	}
+}
+
+func TestSocketClientRejectsMaskedFrameEarly(t *testing.T) {
+	s, c := newSocketPair(t)
+	defer s.TCPClose()
+	defer c.TCPClose()
+
+	go c.Listen()
+
+	// Header of a large masked frame sent by the server, without its payload
+	// data. The client must reject it without waiting for the payload data.
+	h := []byte{130 /* 10000010 */, 255 /* 11111111 */, 0, 0, 0, 0, 0, 1, 134, 160, 1, 2, 3, 4}
+
+	if _, err := s.conn.Write(h); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	s.SetReadDeadline(time.Now().Add(time.Second * 2))
+
+	f, err := newFrame(s.buf.Reader)
+
+	if err != nil {
+		t.Fatal("expected client to reject the frame straight away", err)
+	}
+
+	if f.opcode != OpcodeClose {
+		t.Fatalf("expected a close frame, but got opcode '%d'", f.opcode)
+	}
+
+	if e, _ := NewCloseError(f.payload); e.Code != CloseProtocolError {
+		t.Errorf("expected Close Error Code to be '%d', but it is '%d'", CloseProtocolError, e.Code)
+	}
+}
+
+func TestSocketFramePayloadTimeout(t *testing.T) {
+	done := make(chan bool, 1)
+
+	s, c := newSocketPair(t)
+	defer s.TCPClose()
+	defer c.TCPClose()
+
+	s.FramePayloadTimeout = time.Millisecond * 100
+
+	s.CloseHandler = func(err error) {
+		if e, k := err.(*CloseError); !k || e.Code != CloseAbnormalClosure {
+			t.Errorf("expected an abnormal closure error but got '%v'", err)
+		}
+
+		done <- true
+	}
+
+	go s.Listen()
+
+	// Header of a masked frame with 100 bytes of payload data which never
+	// arrives.
+	if _, err := c.conn.Write([]byte{130, 228, 1, 2, 3, 4}); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	select {
+	case <-done:
+		{
+
+		}
+	case <-time.After(time.Second * 2):
+		{
+			t.Error("expected connection to be closed")
+		}
+	}
+}
+
+func TestSocketReadFragmented(t *testing.T) {
+	done := make(chan bool, 1)
+
+	s, c := newSocketPair(t)
+	defer s.TCPClose()
+	defer c.TCPClose()
+
+	s.ReadHandler = func(o int, p []byte) {
+		if o != OpcodeText {
+			t.Errorf("expected opcode to be '%d', but it is '%d'", OpcodeText, o)
+		}
+
+		if string(p) != "hello world" {
+			t.Errorf(`expected payload to be "hello world", but it is "%s"`, p)
+		}
+
+		done <- true
+	}
+
+	go s.Listen()
+
+	var b []byte
+
+	l := []*frame{
+		{opcode: OpcodeText, key: []byte{1, 2, 3, 4}, payload: []byte("hello")},
+		{opcode: OpcodePing, fin: true, key: []byte{1, 2, 3, 4}},
+		{opcode: OpcodeContinuation, fin: true, key: []byte{1, 2, 3, 4}, payload: []byte(" world")},
+	}
+
+	for _, f := range l {
+		p, err := f.toBytes()
+
+		if err != nil {
+			t.Fatal("unexpected error returned", err)
+		}
+
+		b = append(b, p...)
+	}
+
+	if _, err := c.conn.Write(b); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	select {
+	case <-done:
+		{
+
+		}
+	case <-time.After(time.Second * 2):
+		{
+			t.Error("expected fragmented message to be read")
+		}
+	}
+}
+
+func TestSocketReadFragmentedClose(t *testing.T) {
+	done := make(chan bool, 1)
+
+	s, c := newSocketPair(t)
+	defer c.TCPClose()
+
+	s.ReadHandler = func(o int, p []byte) {
+		t.Errorf(`expected partial message not to be read, but "%s" was read`, p)
+	}
+
+	s.CloseHandler = func(err error) {
+		if e, k := err.(*CloseError); !k || e.Code != CloseNormalClosure {
+			t.Errorf("expected a normal closure error but got '%v'", err)
+		}
+
+		done <- true
+	}
+
+	go s.Listen()
+
+	var b []byte
+
+	l := []*frame{
+		{opcode: OpcodeText, key: []byte{1, 2, 3, 4}, payload: []byte("hello")},
+		{opcode: OpcodeClose, fin: true, key: []byte{1, 2, 3, 4}, payload: []byte{3, 232}},
+	}
+
+	for _, f := range l {
+		p, err := f.toBytes()
+
+		if err != nil {
+			t.Fatal("unexpected error returned", err)
+		}
+
+		b = append(b, p...)
+	}
+
+	if _, err := c.conn.Write(b); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	select {
+	case <-done:
+		{
+
+		}
+	case <-time.After(time.Second * 2):
+		{
+			t.Error("expected close frame to be handled")
+		}
+	}
+}
+
+func TestSocketMaxMessageSize(t *testing.T) {
+	type testCase struct {
+		l []*frame
+		e int
+	}
+
+	testCases := []testCase{
+		// Message within the limit.
+		{
+			l: []*frame{
+				{opcode: OpcodeBinary, key: []byte{1, 2, 3, 4}, payload: make([]byte, 4)},
+				{opcode: OpcodeContinuation, fin: true, key: []byte{1, 2, 3, 4}, payload: make([]byte, 4)},
+			},
+			e: 0,
+		},
+		// Single frame exceeding the limit.
+		{
+			l: []*frame{
+				{opcode: OpcodeBinary, fin: true, key: []byte{1, 2, 3, 4}, payload: make([]byte, 9)},
+			},
+			e: CloseMessageTooBig,
+		},
+		// Fragmented message exceeding the limit.
+		{
+			l: []*frame{
+				{opcode: OpcodeBinary, key: []byte{1, 2, 3, 4}, payload: make([]byte, 5)},
+				{opcode: OpcodeContinuation, fin: true, key: []byte{1, 2, 3, 4}, payload: make([]byte, 5)},
+			},
+			e: CloseMessageTooBig,
+		},
+	}
+
+	for i, tc := range testCases {
+		done := make(chan bool, 1)
+
+		s, c := newSocketPair(t)
+
+		s.MaxMessageSize = 8
+
+		s.ReadHandler = func(o int, p []byte) {
+			done <- true
+		}
+
+		go s.Listen()
+
+		var b []byte
+
+		for _, f := range tc.l {
+			p, err := f.toBytes()
+
+			if err != nil {
+				t.Fatal("unexpected error returned", err)
+			}
+
+			b = append(b, p...)
+		}
+
+		if _, err := c.conn.Write(b); err != nil {
+			t.Fatal("unexpected error returned", err)
+		}
+
+		if tc.e != 0 {
+			c.SetReadDeadline(time.Now().Add(time.Second * 2))
+
+			f, err := newFrame(c.buf.Reader)
+
+			if err != nil {
+				t.Fatalf("test case %d: unexpected error returned %v", i, err)
+			}
+
+			if e, _ := NewCloseError(f.payload); e.Code != tc.e {
+				t.Errorf("test case %d: expected Close Error Code to be '%d', but it is '%d'", i, tc.e, e.Code)
+			}
+		} else {
+			select {
+			case <-done:
+				{
+
+				}
+			case <-time.After(time.Second * 2):
+				{
+					t.Errorf("test case %d: timed out", i)
+				}
+			}
+		}
+
+		s.TCPClose()
+		c.TCPClose()
+	}
+}
+
+func TestSocketReadInvalidControlFrame(t *testing.T) {
+	type testCase struct {
+		b []byte
+	}
+
+	testCases := []testCase{
+		// Fragmented ping frame.
+		{b: []byte{9 /* 00001001 */, 128 /* 10000000 */, 1, 2, 3, 4}},
+		// Ping frame with 300 bytes of payload data.
+		{b: []byte{137 /* 10001001 */, 254 /* 11111110 */, 1, 44, 1, 2, 3, 4}},
+	}
+
+	for i, tc := range testCases {
+		s, c := newSocketPair(t)
+
+		s.PingHandler = func(p []byte) {
+			t.Errorf("test case %d: expected ping handler not to be invoked", i)
+		}
+
+		go s.Listen()
+
+		if _, err := c.conn.Write(tc.b); err != nil {
+			t.Fatal("unexpected error returned", err)
+		}
+
+		c.SetReadDeadline(time.Now().Add(time.Second * 2))
+
+		f, err := newFrame(c.buf.Reader)
+
+		if err != nil {
+			t.Fatalf("test case %d: unexpected error returned %v", i, err)
+		}
+
+		if e, _ := NewCloseError(f.payload); e.Code != CloseProtocolError {
+			t.Errorf("test case %d: expected Close Error Code to be '%d', but it is '%d'", i, CloseProtocolError, e.Code)
+		}
+
+		s.TCPClose()
+		c.TCPClose()
+	}
+}
+
+func TestSocketReadInvalidUTF8(t *testing.T) {
+	type testCase struct {
+		l []*frame
+		e int
+	}
+
+	// Euro sign (i.e. 0xE2 0x82 0xAC).
+	r := []byte("€")
+
+	testCases := []testCase{
+		// Rune split between fragments.
+		{
+			l: []*frame{
+				{opcode: OpcodeText, key: []byte{1, 2, 3, 4}, payload: r[:1]},
+				{opcode: OpcodeContinuation, fin: true, key: []byte{1, 2, 3, 4}, payload: r[1:]},
+			},
+			e: 0,
+		},
+		// Invalid text.
+		{
+			l: []*frame{
+				{opcode: OpcodeText, fin: true, key: []byte{1, 2, 3, 4}, payload: []byte{104, 255}},
+			},
+			e: CloseInvalidFramePayloadData,
+		},
+		// Message ending with an incomplete rune.
+		{
+			l: []*frame{
+				{opcode: OpcodeText, key: []byte{1, 2, 3, 4}, payload: r[:1]},
+				{opcode: OpcodeContinuation, fin: true, key: []byte{1, 2, 3, 4}, payload: r[1:2]},
+			},
+			e: CloseInvalidFramePayloadData,
+		},
+		// Overlong encodings.
+		{
+			l: []*frame{
+				{opcode: OpcodeText, fin: true, key: []byte{1, 2, 3, 4}, payload: []byte{0xC0, 0xAF}},
+			},
+			e: CloseInvalidFramePayloadData,
+		},
+		{
+			l: []*frame{
+				{opcode: OpcodeText, fin: true, key: []byte{1, 2, 3, 4}, payload: []byte{0xE0, 0x80, 0xAF}},
+			},
+			e: CloseInvalidFramePayloadData,
+		},
+		// Surrogate.
+		{
+			l: []*frame{
+				{opcode: OpcodeText, fin: true, key: []byte{1, 2, 3, 4}, payload: []byte{0xED, 0xA0, 0x80}},
+			},
+			e: CloseInvalidFramePayloadData,
+		},
+		// Overlong encoding split between fragments.
+		{
+			l: []*frame{
+				{opcode: OpcodeText, key: []byte{1, 2, 3, 4}, payload: []byte{0xE0}},
+				{opcode: OpcodeContinuation, fin: true, key: []byte{1, 2, 3, 4}, payload: []byte{0x80, 0xAF}},
+			},
+			e: CloseInvalidFramePayloadData,
+		},
+		// Surrogate split between fragments.
+		{
+			l: []*frame{
+				{opcode: OpcodeText, key: []byte{1, 2, 3, 4}, payload: []byte{0xED, 0xA0}},
+				{opcode: OpcodeContinuation, fin: true, key: []byte{1, 2, 3, 4}, payload: []byte{0x80}},
+			},
+			e: CloseInvalidFramePayloadData,
+		},
+		// Invalid reason of a close frame.
+		{
+			l: []*frame{
+				{opcode: OpcodeClose, fin: true, key: []byte{1, 2, 3, 4}, payload: []byte{3, 232, 255}},
+			},
+			e: CloseInvalidFramePayloadData,
+		},
+	}
+
+	for i, tc := range testCases {
+		done := make(chan bool, 1)
+
+		s, c := newSocketPair(t)
+
+		s.ReadHandler = func(o int, p []byte) {
+			if !bytes.Equal(p, r) {
+				t.Errorf(`test case %d: expected payload to be "%s", but it is "%s"`, i, r, p)
+			}
+
+			done <- true
+		}
+
+		go s.Listen()
+
+		var b []byte
+
+		for _, f := range tc.l {
+			p, err := f.toBytes()
+
+			if err != nil {
+				t.Fatal("unexpected error returned", err)
+			}
+
+			b = append(b, p...)
+		}
+
+		if _, err := c.conn.Write(b); err != nil {
+			t.Fatal("unexpected error returned", err)
+		}
+
+		if tc.e != 0 {
+			c.SetReadDeadline(time.Now().Add(time.Second * 2))
+
+			f, err := newFrame(c.buf.Reader)
+
+			if err != nil {
+				t.Fatalf("test case %d: unexpected error returned %v", i, err)
+			}
+
+			if e, _ := NewCloseError(f.payload); e.Code != tc.e {
+				t.Errorf("test case %d: expected Close Error Code to be '%d', but it is '%d'", i, tc.e, e.Code)
+			}
+		} else {
+			select {
+			case <-done:
+				{
+
+				}
+			case <-time.After(time.Second * 2):
+				{
+					t.Errorf("test case %d: timed out", i)
+				}
+			}
+		}
+
+		s.TCPClose()
+		c.TCPClose()
+	}
+}
+
+func TestSocketMissingReadHandler(t *testing.T) {
+	type testCase struct {
+		a MissingHandlerAction
+		o int
+		l bool
+	}
+
+	testCases := []testCase{
+		// Message is dropped silently.
+		{a: MissingHandlerDrop, o: OpcodePong, l: false},
+		// Message is dropped and a warning is logged.
+		{a: MissingHandlerWarn, o: OpcodePong, l: true},
+		// Connection is closed.
+		{a: MissingHandlerClose, o: OpcodeClose, l: false},
+	}
+
+	for i, tc := range testCases {
+		s, c := newSocketPair(t)
+
+		l := &bytes.Buffer{}
+
+		s.MissingReadHandler = tc.a
+		s.ErrorLog = log.New(l, "", 0)
+
+		// The server endpoint stops listening once the client endpoint closes
+		// the connection.
+		d := make(chan bool)
+
+		go func() {
+			s.Listen()
+			close(d)
+		}()
+
+		// Text frame followed by a ping frame, whose pong frame indicates that
+		// the text frame has been processed.
+		var b []byte
+
+		for _, f := range []*frame{
+			{opcode: OpcodeText, fin: true, key: []byte{1, 2, 3, 4}, payload: []byte("hello")},
+			{opcode: OpcodePing, fin: true, key: []byte{1, 2, 3, 4}},
+		} {
+			p, err := f.toBytes()
+
+			if err != nil {
+				t.Fatal("unexpected error returned", err)
+			}
+
+			b = append(b, p...)
+		}
+
+		if _, err := c.conn.Write(b); err != nil {
+			t.Fatal("unexpected error returned", err)
+		}
+
+		c.SetReadDeadline(time.Now().Add(time.Second * 2))
+
+		f, err := newFrame(c.buf.Reader)
+
+		if err != nil {
+			t.Fatalf("test case %d: unexpected error returned %v", i, err)
+		}
+
+		if f.opcode != tc.o {
+			t.Errorf("test case %d: expected opcode to be '%d', but it is '%d'", i, tc.o, f.opcode)
+		}
+
+		if f.opcode == OpcodeClose {
+			if e, _ := NewCloseError(f.payload); e.Code != CloseInternalServerErr {
+				t.Errorf("test case %d: expected Close Error Code to be '%d', but it is '%d'", i, CloseInternalServerErr, e.Code)
+			}
+		}
+
+		if v := strings.Contains(l.String(), "no read handler"); v != tc.l {
+			t.Errorf("test case %d: expected a warning to be logged '%t', but it is '%t'", i, tc.l, v)
+		}
+
+		c.TCPClose()
+		<-d
+	}
+}
+
+func TestSocketListenError(t *testing.T) {
+	type testCase struct {
+		e *CloseError
+		v int
+	}
+
+	testCases := []testCase{
+		// Normal closure.
+		{e: &CloseError{Code: CloseNormalClosure}, v: 0},
+		// Connected endpoint going away.
+		{e: &CloseError{Code: CloseGoingAway}, v: CloseGoingAway},
+		// Connected endpoint failing the connection.
+		{e: &CloseError{Code: CloseProtocolError, Reason: "bad frame"}, v: CloseProtocolError},
+	}
+
+	for i, tc := range testCases {
+		done := make(chan error, 1)
+
+		s, c := newSocketPair(t)
+
+		go func() {
+			done <- s.Listen()
+		}()
+
+		go c.Listen()
+
+		c.CloseWithError(tc.e)
+
+		select {
+		case err := <-done:
+			{
+				if tc.v == 0 {
+					if err != nil {
+						t.Errorf("test case %d: expected no error to be returned but got '%v'", i, err)
+					}
+				} else if e, k := err.(*CloseError); !k || e.Code != tc.v {
+					t.Errorf("test case %d: expected Close Error Code to be '%d', but got '%v'", i, tc.v, err)
+				}
+			}
+		case <-time.After(time.Second * 2):
+			{
+				t.Errorf("test case %d: timed out", i)
+			}
+		}
+
+		c.TCPClose()
+	}
+}
+
+func TestSocketWriteAndClose(t *testing.T) {
+	s, c := newSocketPair(t)
+	defer s.TCPClose()
+	defer c.TCPClose()
+
+	if err := s.WriteAndClose(OpcodeText, []byte("bye"), CloseGoingAway, "shutting down"); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	c.SetReadDeadline(time.Now().Add(time.Second * 2))
+
+	// The message must be received immediately before the close frame.
+	f, err := newFrame(c.buf.Reader)
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	if f.opcode != OpcodeText || string(f.payload) != "bye" {
+		t.Errorf(`expected text message "bye", but got opcode '%d' with payload "%s"`, f.opcode, f.payload)
+	}
+
+	f, err = newFrame(c.buf.Reader)
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	if f.opcode != OpcodeClose {
+		t.Fatalf("expected opcode to be '%d', but it is '%d'", OpcodeClose, f.opcode)
+	}
+
+	e, err := NewCloseError(f.payload)
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	if e.Code != CloseGoingAway || e.Reason != "shutting down" {
+		t.Errorf(`expected close error '%d' "shutting down", but got '%d' "%s"`, CloseGoingAway, e.Code, e.Reason)
+	}
+
+	// No more data messages can be sent.
+	if err := s.WriteAndClose(OpcodeText, []byte("bye"), CloseGoingAway, ""); err != ErrSocketClosing {
+		t.Errorf(`expected error "%v" but got "%v"`, ErrSocketClosing, err)
+	}
+}
+
+func TestSocketWriteAndCloseInvalid(t *testing.T) {
+	type testCase struct {
+		c int
+		r string
+		e error
+	}
+
+	testCases := []testCase{
+		// Status codes which can't be sent.
+		{c: CloseAbnormalClosure, r: "", e: errInvalidCloseCode},
+		{c: CloseNoStatusReceived, r: "", e: errInvalidCloseCode},
+		// Invalid reasons.
+		{c: CloseGoingAway, r: strings.Repeat("a", MaxCloseReason+1), e: errCloseReasonTooLong},
+		{c: CloseGoingAway, r: string([]byte{104, 255}), e: errInvalidCloseReason},
+	}
+
+	for i, tc := range testCases {
+		b := &bytes.Buffer{}
+		s := newSocket(nil, bufio.NewReadWriter(nil, bufio.NewWriter(b)), true)
+
+		if err := s.WriteAndClose(OpcodeText, []byte("bye"), tc.c, tc.r); err != tc.e {
+			t.Errorf(`test case %d: expected error "%v" but got "%v"`, i, tc.e, err)
+		}
+
+		if b.Len() != 0 {
+			t.Errorf("test case %d: expected nothing to be written, but %d bytes were written", i, b.Len())
+		}
+
+		if s.loadState() != stateOpened {
+			t.Errorf("test case %d: expected closing handshake not to be initiated", i)
+		}
+	}
+}
+
+func TestSocketMessageTimeout(t *testing.T) {
+	type testCase struct {
+		r bool
+	}
+
+	testCases := []testCase{
+		// Message read while listening.
+		{r: false},
+		// Message read using ReadInto.
+		{r: true},
+	}
+
+	for i, c := range testCases {
+		done := make(chan error, 1)
+
+		s, p := newSocketPair(t)
+
+		s.MessageTimeout = time.Millisecond * 200
+
+		s.CloseHandler = func(err error) {
+			if e, k := err.(*CloseError); !k || e.Code != ClosePolicyViolation {
+				t.Errorf("test case %d: expected a policy violation error but got '%v'", i, err)
+			}
+		}
+
+		go func() {
+			if c.r {
+				_, _, err := s.ReadInto(ioutil.Discard)
+				done <- err
+				return
+			}
+
+			s.ReadHandler = func(int, []byte) {
+				t.Errorf("test case %d: expected message not to be read", i)
+			}
+
+			s.Listen()
+			done <- nil
+		}()
+
+		// Fragments are sent slowly, so that the message isn't completed
+		// within the message timeout even though each fragment is received
+		// in time.
+		for _, f := range []*frame{
+			{opcode: OpcodeText, key: []byte{1, 2, 3, 4}, payload: []byte("hello")},
+			{opcode: OpcodeContinuation, key: []byte{1, 2, 3, 4}, payload: []byte(" world")},
+			{opcode: OpcodeContinuation, key: []byte{1, 2, 3, 4}, payload: []byte("!")},
+		} {
+			b, _ := f.toBytes()
+			p.conn.Write(b)
+			time.Sleep(time.Millisecond * 120)
+		}
+
+		select {
+		case err := <-done:
+			{
+				if c.r && err == nil {
+					t.Errorf("test case %d: expected read to fail", i)
+				}
+			}
+		case <-time.After(time.Second * 2):
+			{
+				t.Fatalf("test case %d: expected read to fail", i)
+			}
+		}
+
+		if s.loadState() != stateClosed {
+			t.Errorf("test case %d: expected connection to be closed", i)
+		}
+
+		// The connected endpoint is notified about the failure.
+		p.SetReadDeadline(time.Now().Add(time.Second * 2))
+
+		f, err := newFrame(p.buf.Reader)
+
+		if err != nil {
+			t.Fatalf("test case %d: unexpected error returned %v", i, err)
+		}
+
+		if e, _ := NewCloseError(f.payload); f.opcode != OpcodeClose || e == nil || e.Code != ClosePolicyViolation {
+			t.Errorf("test case %d: expected a policy violation close frame", i)
+		}
+
+		p.TCPClose()
+	}
+}
+
+func TestSocketCloseEchoReservedCode(t *testing.T) {
+	type testCase struct {
+		c int
+		e int
+	}
+
+	testCases := []testCase{
+		// Valid status codes are echoed.
+		{c: CloseNormalClosure, e: CloseNormalClosure},
+		{c: CloseServiceRestart, e: CloseServiceRestart},
+		{c: 4000, e: 4000},
+		// Status codes which must never be sent fail the connection.
+		{c: CloseNoStatusReceived, e: CloseProtocolError},
+		{c: CloseAbnormalClosure, e: CloseProtocolError},
+		{c: CloseTLSHandshake, e: CloseProtocolError},
+	}
+
+	for i, tc := range testCases {
+		done := make(chan int, 1)
+
+		s, c := newSocketPair(t)
+
+		// The close error still contains the status code received.
+		s.CloseHandler = func(err error) {
+			if e, k := err.(*CloseError); k {
+				done <- e.Code
+			}
+		}
+
+		go s.Listen()
+
+		e := &CloseError{Code: tc.c}
+		f := &frame{opcode: OpcodeClose, fin: true, key: []byte{1, 2, 3, 4}, payload: e.toBytesCode()}
+
+		b, err := f.toBytes()
+
+		if err != nil {
+			t.Fatal("unexpected error returned", err)
+		}
+
+		if _, err := c.conn.Write(b); err != nil {
+			t.Fatal("unexpected error returned", err)
+		}
+
+		c.SetReadDeadline(time.Now().Add(time.Second * 2))
+
+		f, err = newFrame(c.buf.Reader)
+
+		if err != nil {
+			t.Fatalf("test case %d: unexpected error returned %v", i, err)
+		}
+
+		if e, _ := NewCloseError(f.payload); e.Code != tc.e {
+			t.Errorf("test case %d: expected Close Error Code to be '%d', but it is '%d'", i, tc.e, e.Code)
+		}
+
+		select {
+		case v := <-done:
+			{
+				if v != tc.c {
+					t.Errorf("test case %d: expected close handler to receive '%d', but it is '%d'", i, tc.c, v)
+				}
+			}
+		case <-time.After(time.Second * 2):
+			{
+				t.Errorf("test case %d: timed out", i)
+			}
+		}
+
+		s.TCPClose()
+		c.TCPClose()
+	}
+}
+
+func TestSocketWriteMessageWithDeadline(t *testing.T) {
+	s, c := newSocketPair(t)
+	defer s.TCPClose()
+	defer c.TCPClose()
+
+	if err := s.WriteMessageWithDeadline(OpcodeText, []byte("hello"), time.Now().Add(time.Millisecond*100)); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	// The deadline of the previous write must not affect the next one.
+	time.Sleep(time.Millisecond * 200)
+
+	if err := s.WriteMessage(OpcodeText, []byte("world")); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	c.SetReadDeadline(time.Now().Add(time.Second * 2))
+
+	for _, e := range []string{"hello", "world"} {
+		f, err := newFrame(c.buf.Reader)
+
+		if err != nil {
+			t.Fatal("unexpected error returned", err)
+		}
+
+		if string(f.payload) != e {
+			t.Errorf(`expected payload to be "%s", but it is "%s"`, e, f.payload)
+		}
+	}
+
+	if s.loadState() != stateOpened {
+		t.Error("expected connection to be open")
+	}
+}
+
+func TestSocketWriteMessageWithDeadlineExceeded(t *testing.T) {
+	done := make(chan error, 1)
+
+	s, c := newSocketPair(t)
+	defer c.TCPClose()
+
+	s.CloseHandler = func(err error) {
+		done <- err
+	}
+
+	err := s.WriteMessageWithDeadline(OpcodeText, []byte("hello"), time.Now().Add(-time.Second))
+
+	if n, k := err.(net.Error); !k || !n.Timeout() {
+		t.Fatalf("expected a timeout error but got '%v'", err)
+	}
+
+	// The connection is closed with the error which occurred.
+	select {
+	case e := <-done:
+		{
+			if e != err {
+				t.Errorf(`expected error "%v" but got "%v"`, err, e)
+			}
+		}
+	case <-time.After(time.Second * 2):
+		{
+			t.Error("expected connection to be closed")
+		}
+	}
+}
+
+func TestSocketCloseWithCode(t *testing.T) {
+	type testCase struct {
+		c int
+		r string
+		e error
+	}
+
+	testCases := []testCase{
+		// Valid status code and reason.
+		{c: CloseGoingAway, r: "shutting down", e: nil},
+		{c: 4000, r: strings.Repeat("a", MaxCloseReason), e: nil},
+		// Status codes which can't be sent.
+		{c: CloseAbnormalClosure, r: "", e: errInvalidCloseCode},
+		{c: 999, r: "", e: errInvalidCloseCode},
+		// Invalid reasons.
+		{c: CloseGoingAway, r: strings.Repeat("a", MaxCloseReason+1), e: errCloseReasonTooLong},
+		{c: CloseGoingAway, r: string([]byte{104, 255}), e: errInvalidCloseReason},
+	}
+
+	for i, tc := range testCases {
+		s, c := newSocketPair(t)
+
+		if err := s.CloseWithCode(tc.c, tc.r); err != tc.e {
+			t.Errorf(`test case %d: expected error "%v" but got "%v"`, i, tc.e, err)
+		}
+
+		if tc.e != nil {
+			if s.loadState() != stateOpened {
+				t.Errorf("test case %d: expected closing handshake not to be initiated", i)
+			}
+		} else {
+			c.SetReadDeadline(time.Now().Add(time.Second * 2))
+
+			f, err := newFrame(c.buf.Reader)
+
+			if err != nil {
+				t.Fatalf("test case %d: unexpected error returned %v", i, err)
+			}
+
+			if e, _ := NewCloseError(f.payload); f.opcode != OpcodeClose || e.Code != tc.c || e.Reason != tc.r {
+				t.Errorf(`test case %d: expected close frame '%d' "%s", but got '%d' "%s"`, i, tc.c, tc.r, e.Code, e.Reason)
+			}
+		}
+
+		s.TCPClose()
+		c.TCPClose()
+	}
+}
+
+func TestSocketIdleTimeout(t *testing.T) {
+	done := make(chan bool, 1)
+
+	s, c := newSocketPair(t)
+	defer s.TCPClose()
+	defer c.TCPClose()
+
+	s.IdleTimeout = time.Millisecond * 200
+
+	n := 0
+
+	s.ReadHandler = func(o int, p []byte) {
+		n++
+	}
+
+	s.CloseHandler = func(err error) {
+		if e, k := err.(*CloseError); !k || e.Code != CloseAbnormalClosure {
+			t.Errorf("expected an abnormal closure error but got '%v'", err)
+		}
+
+		done <- true
+	}
+
+	go s.Listen()
+
+	f := &frame{opcode: OpcodeText, fin: true, key: []byte{1, 2, 3, 4}, payload: []byte("hello")}
+
+	b, err := f.toBytes()
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	// The idle timeout is refreshed once each frame is received, therefore
+	// frames received regularly keep the connection open even though they
+	// take longer than the idle timeout in total.
+	for i := 0; i < 4; i++ {
+		if _, err := c.conn.Write(b); err != nil {
+			t.Fatal("unexpected error returned", err)
+		}
+
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	// Send only part of a frame and stall.
+	if _, err := c.conn.Write(b[:3]); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	select {
+	case <-done:
+		{
+			if n != 4 {
+				t.Errorf("expected '4' messages to be read, but '%d' were read", n)
+			}
+		}
+	case <-time.After(time.Second * 2):
+		{
+			t.Error("expected connection to be closed")
+		}
+	}
+}
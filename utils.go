@@ -2,15 +2,27 @@ package websocket
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
 	"crypto/sha1"
 	"encoding/base64"
-	"encoding/binary"
 	"io"
-	"math/rand"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
+// DefaultResumptionHeader is the name of the header field used to carry
+// resumption tokens when no other name is configured.
+const DefaultResumptionHeader = "Resumption-Token"
+
+// EntropySource is the source of randomness used to generate masking keys and
+// the challenge keys sent with the client's opening handshake. It defaults to
+// crypto/rand.Reader and is meant to be replaced only by tests which require
+// deterministic output. It must not be changed while sockets are in use.
+var EntropySource io.Reader = rand.Reader
+
 // wsAcceptSalt is the GUID used by the WebSocket protocol to generate the
 // value for the "Sec-Websocket-Accept" response HTTP Header field.
 const wsAcceptSalt string = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
@@ -21,54 +33,42 @@ const wsAcceptSalt string = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
 //
 // Ref Spec: https://tools.ietf.org/html/rfc6455#section-1.3
 func makeAcceptKey(k string) string {
+	return makeAcceptKeyWithSalt(k, wsAcceptSalt)
+}
+
+// makeAcceptKeyWithSalt generates the Accept Key just like makeAcceptKey but
+// using the salt provided ('s') instead of the GUID defined by the websocket
+// rfc. This is mostly useful to generate invalid Accept Keys.
+func makeAcceptKeyWithSalt(k, s string) string {
 	h := sha1.New()
-	io.WriteString(h, k+wsAcceptSalt)
+	io.WriteString(h, k+s)
 	return base64.StdEncoding.EncodeToString(h.Sum(nil))
 }
 
 // readFromBuffer reads from the buffer (b) provided the number of specified
-// bytes (l).
+// bytes (l). The buffer is read from as many times as needed, with
+// io.ErrUnexpectedEOF being returned if it ends before all the bytes are read.
 func readFromBuffer(b *bufio.Reader, l uint64) ([]byte, error) {
 	p := make([]byte, l)
 
-	// If the number of buffered bytes will accommodate the number of bytes
-	// requested, read once and return the read bytes.
-	if uint64(b.Buffered()) >= l {
-		_, err := b.Read(p)
-		return p, err
+	if _, err := io.ReadFull(b, p); err != nil {
+		return nil, err
 	}
 
-	// If the user requires more bytes than there is buffered, the buffer will
-	// be read from multiple times.
-
-	// Total number of bytes read from buffer.
-	n := 0
-
-	for {
-		// Temporary slice of bytes.
-		t := make([]byte, l)
-
-		// Read from buffer and put read bytes in temporary slice of bytes.
-		i, err := b.Read(t)
-
-		if err != nil {
-			return nil, err
-		}
-
-		// Append bytes to the slice of bytes to be returned.
-		p = append(p[:n], t[:i]...)
-
-		// Increment the total number of bytes with the bytes read.
-		n += i
+	return p, nil
+}
 
-		// If the total number of bytes is the same as the number of bytes
-		// requested, stop read operation and read bytes.
-		if uint64(n) == l {
-			break
-		}
+// resizeReader returns a new buffered reader of size 'n' reading from 'r'
+// (the connection wrapped by buffered reader 'b'). Any bytes which are already
+// buffered in 'b' are preserved and returned first.
+func resizeReader(b *bufio.Reader, r io.Reader, n int) *bufio.Reader {
+	if b.Buffered() > 0 {
+		// Copy the buffered bytes, since Peek doesn't.
+		p, _ := b.Peek(b.Buffered())
+		r = io.MultiReader(bytes.NewReader(append([]byte{}, p...)), r)
 	}
 
-	return p, nil
+	return bufio.NewReaderSize(r, n)
 }
 
 // stringExists is a utility function used to check whether a slice of string
@@ -98,27 +98,40 @@ func headerToSlice(v string) []string {
 	return l
 }
 
-// randomByteSlice is used to generate a byte slice of random 32 bit integers.
-func randomByteSlice(i int) []byte {
-	// Slice of bytes which will grow to be 16 bytes in length once the
-	// operation is ready. This slice will then be used to generate the key to
-	// be sent with the clients opening handshake using the Sec-Websocket-Key
-	// Header.
-	var b []byte
+// tokenValid returns whether the string provided is a valid HTTP token (i.e.
+// non empty and made up of token characters only).
+//
+// From RFC7230: https://tools.ietf.org/html/rfc7230#section-3.2.6
+func tokenValid(v string) bool {
+	if v == "" {
+		return false
+	}
 
-	// Set seed.
-	rand.Seed(time.Now().UnixNano())
+	for _, c := range v {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+			{
+				continue
+			}
+		case strings.ContainsRune("!#$%&'*+-.^_`|~", c):
+			{
+				continue
+			}
+		}
+		return false
+	}
 
-	// The challenge key must be 16 bytes in length.
-	for l := 0; l < i; l++ {
-		// Temp slice
-		t := make([]byte, 4)
+	return true
+}
 
-		// Generate a random 32bit number and store its binary value in 't'.
-		binary.BigEndian.PutUint32(t, rand.Uint32())
+// randomByteSlice is used to generate a byte slice of 'i' random 32 bit
+// integers read from EntropySource. It panics if EntropySource fails, since
+// predictable masking and challenge keys must never be used.
+func randomByteSlice(i int) []byte {
+	b := make([]byte, i*4)
 
-		// Finally append the random generated number to 'b'.
-		b = append(b, t...)
+	if _, err := io.ReadFull(EntropySource, b); err != nil {
+		panic("websocket: failed to read random bytes: " + err.Error())
 	}
 
 	return b
@@ -128,10 +141,119 @@ func randomByteSlice(i int) []byte {
 // a valid error number or not.
 func closeErrorExist(i int) bool {
 	switch i {
-	case CloseNormalClosure, CloseGoingAway, CloseProtocolError, CloseUnsupportedData, CloseNoStatusReceived, CloseAbnormalClosure, CloseInvalidFramePayloadData, ClosePolicyViolation, CloseMessageTooBig, CloseMandatoryExtension, CloseInternalServerErr, CloseTLSHandshake:
+	case CloseNormalClosure, CloseGoingAway, CloseProtocolError, CloseUnsupportedData, CloseNoStatusReceived, CloseAbnormalClosure, CloseInvalidFramePayloadData, ClosePolicyViolation, CloseMessageTooBig, CloseMandatoryExtension, CloseInternalServerErr, CloseServiceRestart, CloseTryAgainLater, CloseBadGateway, CloseTLSHandshake:
 		{
 			return true
 		}
 	}
-	return false
+	return i >= CloseApplicationMin && i <= CloseApplicationMax
+}
+
+// closeCodeSendable returns whether the error number provided as an argument
+// can be sent in a close frame. 1005, 1006 and 1015 are recognized (i.e. can
+// be used to report the reason of a closure) but must never be sent.
+// Ref Spec: https://tools.ietf.org/html/rfc6455#section-7.4.1
+func closeCodeSendable(i int) bool {
+	switch i {
+	case CloseNoStatusReceived, CloseAbnormalClosure, CloseTLSHandshake:
+		{
+			return false
+		}
+	}
+	return closeErrorExist(i)
+}
+
+// contextErr returns the error of the context provided ('ctx'). Since the
+// deadline of the context is also set on the connection, a read may time out
+// just before the context itself expires, in which case
+// context.DeadlineExceeded is returned as well.
+func contextErr(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if d, k := ctx.Deadline(); k && !time.Now().Before(d) {
+		return context.DeadlineExceeded
+	}
+	return nil
+}
+
+// rateLimiter is a token bucket which refills at 'rate' tokens per second up to
+// a capacity of 'rate' tokens.
+type rateLimiter struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter is a constructor function to create a new rateLimiter instance
+// with a full bucket at time 't'.
+func newRateLimiter(r int, t time.Time) *rateLimiter {
+	return &rateLimiter{
+		rate:   float64(r),
+		tokens: float64(r),
+		last:   t,
+	}
+}
+
+// take removes 'n' tokens from the bucket at time 't' and returns how long the
+// caller should wait for the bucket to be refilled in order not to exceed the
+// rate. A duration which isn't positive means that there was no need to wait.
+func (l *rateLimiter) take(n int, t time.Time) time.Duration {
+	// Refill the bucket with the tokens accumulated since the last take.
+	l.tokens += t.Sub(l.last).Seconds() * l.rate
+	l.last = t
+
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+
+	l.tokens -= float64(n)
+
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// utf8Validator validates UTF-8 text received in chunks (ex: the fragments of
+// a text message), where a multi-byte rune may be split between two chunks.
+type utf8Validator struct {
+	pending []byte
+}
+
+// write validates the next chunk of text ('p'). An incomplete rune at the end
+// of the chunk is held back until the next chunk is written.
+func (v *utf8Validator) write(p []byte) bool {
+	b := p
+
+	if len(v.pending) > 0 {
+		b = append(v.pending, p...)
+		v.pending = nil
+	}
+
+	// Look for the start of the last rune.
+	i := len(b) - 1
+
+	for i > 0 && i > len(b)-utf8.UTFMax && !utf8.RuneStart(b[i]) {
+		i--
+	}
+
+	if i >= 0 && !utf8.FullRune(b[i:]) {
+		v.pending = append([]byte{}, b[i:]...)
+		b = b[:i]
+	}
+
+	return utf8.Valid(b)
+}
+
+// done reports whether the text written so far ends with a complete rune.
+func (v *utf8Validator) done() bool {
+	return len(v.pending) == 0
+}
+
+// resumptionHeader returns the name of the header field used to carry
+// resumption tokens, defaulting to DefaultResumptionHeader when 'h' is empty.
+func resumptionHeader(h string) string {
+	if h == "" {
+		return DefaultResumptionHeader
+	}
+	return h
 }
@@ -2,9 +2,12 @@ package websocket
 
 import (
 	"bufio"
+	"bytes"
+	"io"
 	"math/rand"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestMakeAcceptKey(t *testing.T) {
@@ -15,6 +18,18 @@ func TestMakeAcceptKey(t *testing.T) {
 	}
 }
 
+func TestMakeAcceptKeyWithSalt(t *testing.T) {
+	k := "dGhlIHNhbXBsZSBub25jZQ=="
+
+	if v := makeAcceptKeyWithSalt(k, wsAcceptSalt); v != makeAcceptKey(k) {
+		t.Errorf(`expected "%s" instead "%s" was returned.`, makeAcceptKey(k), v)
+	}
+
+	if v := makeAcceptKeyWithSalt(k, "alternate salt"); v == makeAcceptKey(k) {
+		t.Errorf(`expected accept key generated with an alternate salt to differ from "%s"`, v)
+	}
+}
+
 type payloadMock struct {
 	p []byte
 }
@@ -91,6 +106,102 @@ func TestReadFromBufferMultiRead(t *testing.T) {
 	}
 }
 
+// chunkedMock returns the bytes provided at most 'n' bytes at a time, with
+// io.EOF being returned together with the last bytes.
+type chunkedMock struct {
+	p []byte
+	n int
+}
+
+func (m *chunkedMock) Read(p []byte) (int, error) {
+	if len(m.p) == 0 {
+		return 0, io.EOF
+	}
+
+	if len(p) > m.n {
+		p = p[:m.n]
+	}
+
+	n := copy(p, m.p)
+	m.p = m.p[n:]
+
+	if len(m.p) == 0 {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+func TestReadFromBufferChunked(t *testing.T) {
+	p := []byte{120, 123, 54, 32, 102, 1, 2, 3}
+
+	type testCase struct {
+		p []byte
+		l uint64
+		e error
+	}
+
+	testCases := []testCase{
+		// All the bytes requested are received.
+		{p: p, l: uint64(len(p)), e: nil},
+		// Connection ends in the middle of the bytes requested.
+		{p: p[:5], l: uint64(len(p)), e: io.ErrUnexpectedEOF},
+		// Connection ends before any of the bytes requested are received.
+		{p: []byte{}, l: uint64(len(p)), e: io.EOF},
+	}
+
+	for i, c := range testCases {
+		// Use a small buffer so that the bytes requested are not buffered at
+		// once.
+		b := bufio.NewReaderSize(&chunkedMock{p: c.p, n: 2}, 16)
+
+		n, err := readFromBuffer(b, c.l)
+
+		if err != c.e {
+			t.Errorf(`test case %d: expected error "%v" but got "%v"`, i, c.e, err)
+			continue
+		}
+
+		if err == nil && !bytes.Equal(n, c.p) {
+			t.Errorf("test case %d: expected slice of bytes to be '%v', but it is '%v'", i, c.p, n)
+		}
+	}
+}
+
+func TestResizeReader(t *testing.T) {
+	p := []byte{120, 123, 54, 32, 102}
+	m := &payloadMock{p: p}
+	b := bufio.NewReaderSize(m, 16)
+
+	// Buffer some bytes.
+	if _, err := b.Peek(2); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	// Bytes still to be read from the mock.
+	m.p = []byte{1, 2, 3}
+
+	r := resizeReader(b, m, 8192)
+
+	if r.Size() != 8192 {
+		t.Errorf("expected size of buffer to be '8192' but it is '%d'", r.Size())
+	}
+
+	e := append(append([]byte{}, p...), 1, 2, 3)
+
+	n, err := readFromBuffer(r, uint64(len(e)))
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	for i, v := range e {
+		if n[i] != v {
+			t.Fatalf("expected slice of bytes to be '%v' but it is '%v'", e, n)
+		}
+	}
+}
+
 func TestStringExists(t *testing.T) {
 	l := []string{"one", "two", "three"}
 
@@ -139,6 +250,29 @@ func TestHeaderToSlice(t *testing.T) {
 	}
 }
 
+func TestTokenValid(t *testing.T) {
+	type testCase struct {
+		s string
+		v bool
+	}
+
+	testCases := []testCase{
+		{s: "chat", v: true},
+		{s: "v1.chat.example.com", v: true},
+		{s: "!#$%&'*+-.^_`|~", v: true},
+		{s: "", v: false},
+		{s: "chat, v1", v: false},
+		{s: "chat v1", v: false},
+		{s: "chat/v1", v: false},
+	}
+
+	for i, c := range testCases {
+		if v := tokenValid(c.s); v != c.v {
+			t.Errorf("test case %d: expected '%t' for \"%s\"", i, c.v, c.s)
+		}
+	}
+}
+
 func TestRandomByteSlice(t *testing.T) {
 	type testCase struct {
 		l int
@@ -156,6 +290,41 @@ func TestRandomByteSlice(t *testing.T) {
 	}
 }
 
+func TestRandomByteSliceUnique(t *testing.T) {
+	// Keys generated in quick succession must not repeat.
+	k := make(map[string]bool)
+
+	for i := 0; i < 1000; i++ {
+		b := string(randomByteSlice(4))
+
+		if k[b] {
+			t.Fatal("expected randomly generated slices of bytes to be unique")
+		}
+
+		k[b] = true
+	}
+}
+
+func TestRandomByteSliceEntropySource(t *testing.T) {
+	defer func(r io.Reader) {
+		EntropySource = r
+	}(EntropySource)
+
+	p := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+
+	EntropySource = bytes.NewReader(p)
+
+	if b := randomByteSlice(1); !bytes.Equal(b, p[:4]) {
+		t.Errorf("expected slice of bytes to be '%v', but it is '%v'", p[:4], b)
+	}
+
+	EntropySource = bytes.NewReader(p)
+
+	if k := makeChallengeKey(); k != "AQIDBAUGBwgJCgsMDQ4PEA==" {
+		t.Errorf(`expected challenge key to be "AQIDBAUGBwgJCgsMDQ4PEA==", but it is "%s"`, k)
+	}
+}
+
 func TestCloseErrorExist(t *testing.T) {
 	type testCase struct {
 		e int
@@ -167,6 +336,11 @@ func TestCloseErrorExist(t *testing.T) {
 		{e: 15, v: false},
 		// Should return true when opcode is valid.
 		{e: CloseNormalClosure, v: true},
+		{e: CloseBadGateway, v: true},
+		// Should return true for codes reserved for applications.
+		{e: 3000, v: true},
+		{e: 4999, v: true},
+		{e: 5000, v: false},
 	}
 
 	for i, c := range testCases {
@@ -175,3 +349,110 @@ func TestCloseErrorExist(t *testing.T) {
 		}
 	}
 }
+
+func TestRateLimiter(t *testing.T) {
+	n := time.Now()
+	l := newRateLimiter(100, n)
+
+	type testCase struct {
+		n int
+		t time.Duration
+		d time.Duration
+	}
+
+	testCases := []testCase{
+		// Burst within the capacity of the bucket.
+		{n: 100, t: 0, d: 0},
+		// Bucket is empty.
+		{n: 50, t: 0, d: time.Millisecond * 500},
+		// Bucket is refilled over time.
+		{n: 50, t: time.Second, d: 0},
+	}
+
+	for i, c := range testCases {
+		if d := l.take(c.n, n.Add(c.t)); d != c.d {
+			t.Errorf("test case %d: expected to wait '%v', but it is '%v'", i, c.d, d)
+		}
+	}
+}
+
+func TestUTF8Validator(t *testing.T) {
+	type testCase struct {
+		l [][]byte
+		v bool
+		d bool
+	}
+
+	// Euro sign (i.e. 0xE2 0x82 0xAC).
+	e := []byte("€")
+
+	testCases := []testCase{
+		// Valid text in a single chunk.
+		{l: [][]byte{[]byte("hello " + string(e))}, v: true, d: true},
+		// Rune split between chunks.
+		{l: [][]byte{append([]byte("hello "), e[:1]...), e[1:2], append(e[2:], '!')}, v: true, d: true},
+		// Text ending with an incomplete rune.
+		{l: [][]byte{append([]byte("hello "), e[:2]...)}, v: true, d: false},
+		// Invalid text.
+		{l: [][]byte{[]byte("hello"), {255}}, v: false},
+		// Invalid continuation of a split rune.
+		{l: [][]byte{e[:1], []byte("a")}, v: false},
+		// Overlong encodings.
+		{l: [][]byte{{0xC0, 0xAF}}, v: false},
+		{l: [][]byte{{0xE0, 0x80, 0xAF}}, v: false},
+		// Surrogate.
+		{l: [][]byte{{0xED, 0xA0, 0x80}}, v: false},
+		// Overlong encoding and surrogate split between chunks.
+		{l: [][]byte{{0xC0}, {0xAF}}, v: false},
+		{l: [][]byte{{0xE0}, {0x80, 0xAF}}, v: false},
+		{l: [][]byte{{0xE0, 0x80}, {0xAF}}, v: false},
+		{l: [][]byte{{0xED}, {0xA0}, {0x80}}, v: false},
+	}
+
+	for i, c := range testCases {
+		u := &utf8Validator{}
+		v := true
+
+		for _, p := range c.l {
+			if !u.write(p) {
+				v = false
+				break
+			}
+		}
+
+		if v != c.v {
+			t.Errorf("test case %d: expected text to be valid '%t', but it is '%t'", i, c.v, v)
+			continue
+		}
+
+		if v && u.done() != c.d {
+			t.Errorf("test case %d: expected text to be complete '%t', but it is '%t'", i, c.d, u.done())
+		}
+	}
+}
+
+func TestCloseCodeSendable(t *testing.T) {
+	type testCase struct {
+		e int
+		v bool
+	}
+
+	testCases := []testCase{
+		{e: CloseNormalClosure, v: true},
+		{e: CloseBadGateway, v: true},
+		{e: 3000, v: true},
+		// Recognized codes which must never be sent.
+		{e: CloseNoStatusReceived, v: false},
+		{e: CloseAbnormalClosure, v: false},
+		{e: CloseTLSHandshake, v: false},
+		// Unrecognized codes.
+		{e: 1004, v: false},
+		{e: 5000, v: false},
+	}
+
+	for i, c := range testCases {
+		if v := closeCodeSendable(c.e); v != c.v {
+			t.Errorf("test case %d: expected '%t' for '%d'", i, c.v, c.e)
+		}
+	}
+}
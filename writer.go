@@ -0,0 +1,215 @@
+package websocket
+
+import (
+	"errors"
+	"io"
+)
+
+// messageWriter sends the data written to it as fragments of a single message.
+type messageWriter struct {
+	/*
+		socket is the socket instance the message is sent through.
+	*/
+	socket *Socket
+
+	/*
+		opcode is the opcode of the next frame to be sent. Once the first
+		fragment is sent, the rest of the message is sent in continuation
+		frames.
+	*/
+	opcode int
+
+	/*
+		closed indicates that the final fragment has been sent.
+	*/
+	closed bool
+}
+
+// NextWriter returns a writer used to send a message with opcode 'o' (i.e.
+// OpcodeText or OpcodeBinary) without buffering it in its entirety. Each call to
+// Write sends its data as a fragment of the message, while Close sends the
+// final fragment.
+//
+// Only one writer can be open at a time. Until it is closed, sending data
+// frames (ex: using WriteMessage) fails with ErrWriterOpen, while control
+// frames (ex: pong frames) can still be sent in between the fragments.
+//
+// Ref Spec: https://tools.ietf.org/html/rfc6455#section-5.4
+func (s *Socket) NextWriter(o int) (io.WriteCloser, error) {
+	if o != OpcodeText && o != OpcodeBinary {
+		return nil, errors.New("messages must either be text or binary")
+	}
+
+	w, err := s.nextWriter(o)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// nextWriter opens the writer used to send a message with opcode 'o', which is
+// expected to have been validated by the caller.
+func (s *Socket) nextWriter(o int) (*messageWriter, error) {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	if err := s.checkWriter(o); err != nil {
+		return nil, err
+	}
+
+	s.writerOpen = true
+
+	return &messageWriter{
+		socket: s,
+		opcode: o,
+	}, nil
+}
+
+// Write sends 'p' as the next fragment of the message.
+func (w *messageWriter) Write(p []byte) (int, error) {
+	// Empty fragments are not sent, since they don't contribute to the
+	// message.
+	if len(p) == 0 && !w.closed {
+		return 0, nil
+	}
+
+	if err := w.writeFrame(p, false); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// Close sends the final fragment of the message, allowing other messages to
+// be sent.
+func (w *messageWriter) Close() error {
+	return w.writeFrame(nil, true)
+}
+
+// abort gives up on the message without sending the final fragment. If none of
+// the message has been sent yet the writer is released, otherwise it is kept
+// open so that no other messages are sent in the middle of the one started, in
+// which case true is returned and the connection is expected to be failed.
+func (w *messageWriter) abort() bool {
+	s := w.socket
+
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	if w.closed {
+		return false
+	}
+
+	w.closed = true
+
+	if w.opcode == OpcodeContinuation {
+		return true
+	}
+
+	s.writerOpen = false
+
+	return false
+}
+
+// writeFrame sends a fragment of the message with payload data 'p'. When 'f'
+// is true, the fragment is the final fragment of the message.
+func (w *messageWriter) writeFrame(p []byte, f bool) error {
+	s := w.socket
+
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	if w.closed {
+		return errors.New("writer has been closed")
+	}
+
+	g := &frame{
+		fin:     f,
+		opcode:  w.opcode,
+		payload: p,
+	}
+
+	// If the socket instance represents a client endpoint, the payload data
+	// must be masked.
+	if !s.server {
+		g.key = randomByteSlice(1)
+	}
+
+	// Once closed the writer is released, even if the final fragment couldn't
+	// be sent.
+	if f {
+		w.closed = true
+		s.writerOpen = false
+	}
+
+	if err := s.writeFrame(g); err != nil {
+		return err
+	}
+
+	w.opcode = OpcodeContinuation
+
+	return nil
+}
+
+// WriteTx is a write transaction started by BeginWrite. Messages written using
+// a transaction are buffered and sent together once it ends.
+type WriteTx struct {
+	/*
+		socket is the socket instance the messages are sent through.
+	*/
+	socket *Socket
+
+	/*
+		ended indicates that the transaction has ended.
+	*/
+	ended bool
+}
+
+// BeginWrite starts a write transaction, used to send a group of messages
+// with a single flush of the underlying connection. No other frames (including
+// the ones sent automatically while listening) are sent until the transaction
+// ends, therefore End must always be invoked.
+func (s *Socket) BeginWrite() *WriteTx {
+	s.writeMutex.Lock()
+	s.batching = true
+
+	return &WriteTx{
+		socket: s,
+	}
+}
+
+// WriteMessage buffers a message with opcode 'o' and payload data 'p', just
+// like Socket.WriteMessage, to be sent once the transaction ends.
+func (t *WriteTx) WriteMessage(o int, p []byte) error {
+	if t.ended {
+		return errors.New("write transaction has ended")
+	}
+
+	s := t.socket
+
+	if err := s.checkWriter(o); err != nil {
+		return err
+	}
+
+	return s.writeFrame(s.messageFrame(o, p))
+}
+
+// End ends the transaction, sending the messages written. If they can't be
+// sent the connection is closed and the error is returned.
+func (t *WriteTx) End() error {
+	if t.ended {
+		return errors.New("write transaction has ended")
+	}
+
+	t.ended = true
+
+	s := t.socket
+
+	s.batching = false
+	err := s.flush()
+	s.writeMutex.Unlock()
+
+	return err
+}
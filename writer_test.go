@@ -0,0 +1,190 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+func TestNextWriter(t *testing.T) {
+	// Client endpoint sending the message.
+	b := &bytes.Buffer{}
+	c := newSocket(nil, bufio.NewReadWriter(nil, bufio.NewWriter(b)), false)
+
+	w, err := c.NextWriter(OpcodeText)
+
+	if err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	if _, err := w.Write([]byte("hello")); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	// Data frames can't be sent while the writer is open.
+	if err := c.WriteMessage(OpcodeText, []byte("other")); err != ErrWriterOpen {
+		t.Errorf(`expected error "%v" but got "%v"`, ErrWriterOpen, err)
+	}
+
+	if _, err := c.NextWriter(OpcodeBinary); err != ErrWriterOpen {
+		t.Errorf(`expected error "%v" but got "%v"`, ErrWriterOpen, err)
+	}
+
+	// Control frames can be sent in between fragments.
+	if err := c.WriteMessage(OpcodePing, nil); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	if _, err := w.Write([]byte(" world")); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	if _, err := w.Write([]byte("!")); err == nil {
+		t.Error("expected an error when writing to a closed writer")
+	}
+
+	if err := c.WriteMessage(OpcodeText, []byte("next")); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	// Server endpoint receiving the messages.
+	r := bufio.NewReaderSize(bytes.NewReader(b.Bytes()), b.Len()+16)
+	s := newSocket(nil, bufio.NewReadWriter(r, nil), true)
+
+	n := 0
+
+	s.PingHandler = func(p []byte) {
+		n++
+	}
+
+	type testCase struct {
+		v string
+	}
+
+	testCases := []testCase{
+		{v: "hello world"},
+		{v: "next"},
+	}
+
+	for i, tc := range testCases {
+		m := &bytes.Buffer{}
+
+		o, _, err := s.ReadInto(m)
+
+		if err != nil {
+			t.Fatalf("test case %d: unexpected error returned %v", i, err)
+		}
+
+		if o != OpcodeText {
+			t.Errorf("test case %d: expected opcode to be '%d', but it is '%d'", i, OpcodeText, o)
+		}
+
+		if m.String() != tc.v {
+			t.Errorf(`test case %d: expected payload to be "%s", but it is "%s"`, i, tc.v, m)
+		}
+	}
+
+	if n != 1 {
+		t.Errorf("expected ping handler to be invoked '1' time but it was invoked '%d' times", n)
+	}
+}
+
+// countingWriter is an io.Writer which counts the number of writes done.
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+func TestBeginWrite(t *testing.T) {
+	b := &countingWriter{}
+	c := newSocket(nil, bufio.NewReadWriter(nil, bufio.NewWriter(b)), false)
+
+	x := c.BeginWrite()
+
+	// Message sent while the transaction is in progress.
+	done := make(chan bool)
+
+	go func() {
+		c.WriteMessage(OpcodeText, []byte("four"))
+		done <- true
+	}()
+
+	for _, p := range []string{"one", "two", "three"} {
+		if err := x.WriteMessage(OpcodeText, []byte(p)); err != nil {
+			t.Fatal("unexpected error returned", err)
+		}
+	}
+
+	if b.writes != 0 {
+		t.Errorf("expected messages not to be sent before the transaction ends, but '%d' writes were done", b.writes)
+	}
+
+	if err := x.End(); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	if err := x.WriteMessage(OpcodeText, nil); err == nil {
+		t.Error("expected an error when writing using a transaction which has ended")
+	}
+
+	<-done
+
+	// The messages written using the transaction are sent using a single
+	// write, followed by the message sent in the meantime.
+	if b.writes != 2 {
+		t.Errorf("expected messages to be sent using '2' writes, but '%d' writes were done", b.writes)
+	}
+
+	r := bufio.NewReaderSize(bytes.NewReader(b.Bytes()), b.Len()+16)
+	s := newSocket(nil, bufio.NewReadWriter(r, nil), true)
+
+	type testCase struct {
+		v string
+	}
+
+	testCases := []testCase{
+		{v: "one"},
+		{v: "two"},
+		{v: "three"},
+		{v: "four"},
+	}
+
+	for i, tc := range testCases {
+		m := &bytes.Buffer{}
+
+		if _, _, err := s.ReadInto(m); err != nil {
+			t.Fatalf("test case %d: unexpected error returned %v", i, err)
+		}
+
+		if m.String() != tc.v {
+			t.Errorf(`test case %d: expected payload to be "%s", but it is "%s"`, i, tc.v, m)
+		}
+	}
+}
+
+func TestBeginWriteError(t *testing.T) {
+	s, c := newSocketPair(t)
+	defer s.TCPClose()
+
+	// Writing to the connection fails once it is closed.
+	c.conn.Close()
+
+	x := c.BeginWrite()
+
+	if err := x.WriteMessage(OpcodeText, []byte("hello")); err != nil {
+		t.Fatal("unexpected error returned", err)
+	}
+
+	if err := x.End(); err == nil {
+		t.Error("expected the error which occurred while sending the messages to be returned")
+	}
+}